@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/frantjc/sindri/internal/dagger"
 	"github.com/opencontainers/go-digest"
@@ -18,6 +19,21 @@ type Backend interface {
 	Close() error
 }
 
+// TagBackend is a Backend that keeps an index of the digest that each
+// tag was last stored as so that it need not be rebuilt on every pull.
+type TagBackend interface {
+	Backend
+	// Tag returns the digest that the name and reference were last stored as and when.
+	Tag(context.Context, string, string) (digest.Digest, time.Time, error)
+}
+
+// PingBackend is a Backend that can check whether what it stores images in is reachable.
+type PingBackend interface {
+	Backend
+	// Ping returns an error if the backend's storage is unreachable.
+	Ping(context.Context) error
+}
+
 type AuthBackend interface {
 	Backend
 	Root(context.Context) (http.Handler, error)
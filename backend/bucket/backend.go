@@ -12,16 +12,22 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/frantjc/sindri/backend"
 	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/distribution"
 	"github.com/frantjc/sindri/internal/httputil"
 	"github.com/frantjc/sindri/internal/logutil"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/uuid"
 	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gocloud.dev/blob"
 	"gocloud.dev/blob/azureblob"
 	"gocloud.dev/blob/fileblob"
@@ -72,6 +78,11 @@ func init() {
 	)
 }
 
+var (
+	_ backend.TagBackend  = new(Bucket)
+	_ backend.PingBackend = new(Bucket)
+)
+
 type Bucket struct {
 	Bucket        *blob.Bucket
 	UseSignedURLs bool
@@ -98,9 +109,17 @@ func beforeWrite(getContentLength func() (int64, error)) func(func(any) bool) er
 
 // Manifest implements backend.Backend
 func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagger.Client, name, reference string) (digest.Digest, error) {
+	key, err := tagKey(name, reference)
+	if err != nil {
+		return "", err
+	}
+
 	tmp := filepath.Join(b.WorkDir, uuid.NewString()+".tar")
 
-	if _, err := container.AsTarball().Export(ctx, tmp); err != nil {
+	exportCtx, span := otel.Tracer(tracerName).Start(ctx, "Export")
+	_, err = container.AsTarball().Export(exportCtx, tmp)
+	endSpan(span, err)
+	if err != nil {
 		return "", err
 	}
 	defer os.Remove(tmp)
@@ -128,10 +147,12 @@ func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagg
 		return "", err
 	}
 
-	eg.Go(func() error {
+	eg.Go(func() (err error) {
 		key := path.Join("manifests", d.String())
+		ctx, span := startUploadSpan(egctx, key)
+		defer func() { endSpan(span, err) }()
 
-		if ok, err := b.Bucket.Exists(egctx, key); ok {
+		if ok, err := b.Bucket.Exists(ctx, key); ok {
 			return nil
 		} else if err != nil {
 			return err
@@ -139,7 +160,7 @@ func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagg
 
 		log.Debug("cacheing manifest in bucket", "key", key)
 
-		if err := b.Bucket.WriteAll(egctx, key, rawManifest, &blob.WriterOptions{
+		if err := b.Bucket.WriteAll(ctx, key, rawManifest, &blob.WriterOptions{
 			ContentType: string(manifest.MediaType),
 			BeforeWrite: beforeWrite(func() (int64, error) {
 				return int64(len(rawManifest)), nil
@@ -151,10 +172,12 @@ func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagg
 		return nil
 	})
 
-	eg.Go(func() error {
+	eg.Go(func() (err error) {
 		key := path.Join("blobs", manifest.Config.Digest.String())
+		ctx, span := startUploadSpan(egctx, key)
+		defer func() { endSpan(span, err) }()
 
-		if ok, err := b.Bucket.Exists(egctx, key); ok {
+		if ok, err := b.Bucket.Exists(ctx, key); ok {
 			return nil
 		} else if err != nil {
 			return err
@@ -167,7 +190,7 @@ func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagg
 			return err
 		}
 
-		if err := b.Bucket.WriteAll(egctx, key, rawConfig, &blob.WriterOptions{
+		if err := b.Bucket.WriteAll(ctx, key, rawConfig, &blob.WriterOptions{
 			ContentType: string(manifest.Config.MediaType),
 			BeforeWrite: beforeWrite(func() (int64, error) {
 				return int64(len(rawConfig)), nil
@@ -185,15 +208,17 @@ func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagg
 	}
 
 	for _, layer := range layers {
-		eg.Go(func() error {
+		eg.Go(func() (err error) {
 			hash, err := layer.Digest()
 			if err != nil {
 				return err
 			}
 
 			key := path.Join("blobs", hash.String())
+			ctx, span := startUploadSpan(egctx, key)
+			defer func() { endSpan(span, err) }()
 
-			if ok, err := b.Bucket.Exists(egctx, key); ok {
+			if ok, err := b.Bucket.Exists(ctx, key); ok {
 				return nil
 			} else if err != nil {
 				return err
@@ -212,7 +237,7 @@ func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagg
 				return err
 			}
 
-			if err = b.Bucket.Upload(egctx, key, rc, &blob.WriterOptions{
+			if err = b.Bucket.Upload(ctx, key, rc, &blob.WriterOptions{
 				ContentType: string(mediaType),
 				BeforeWrite: beforeWrite(layer.Size),
 			}); err != nil {
@@ -227,9 +252,84 @@ func (b *Bucket) Store(ctx context.Context, container *dagger.Container, _ *dagg
 		return "", err
 	}
 
+	log.Debug("indexing tag in bucket", "key", key)
+
+	indexCtx, span := startUploadSpan(ctx, key)
+	err = b.Bucket.WriteAll(indexCtx, key, []byte(d.String()), &blob.WriterOptions{
+		ContentType: "text/plain",
+		BeforeWrite: beforeWrite(func() (int64, error) {
+			return int64(len(d.String())), nil
+		}),
+	})
+	endSpan(span, err)
+	if err != nil {
+		return "", err
+	}
+
 	return d, nil
 }
 
+const tracerName = "github.com/frantjc/sindri/backend/bucket"
+
+// startUploadSpan starts a span for uploading key to the bucket.
+func startUploadSpan(ctx context.Context, key string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "Upload", trace.WithAttributes(
+		attribute.String("sindri.bucket.key", key),
+	))
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// tagKey returns the key that the tag reference of name is indexed at,
+// refusing names and references that could escape the "tags" prefix.
+// References are kept under "_tags" beneath the name so that, e.g., foo:bar
+// and foo/bar:latest do not collide; no path component of a valid name can
+// start with an underscore.
+func tagKey(name, reference string) (string, error) {
+	if err := distribution.ValidateName(name); err != nil {
+		return "", httputil.NewError(err, http.StatusBadRequest)
+	}
+
+	if err := distribution.ValidateTag(reference); err != nil {
+		return "", httputil.NewError(err, http.StatusBadRequest)
+	}
+
+	return path.Join("tags", name, "_tags", reference), nil
+}
+
+// Tag implements backend.TagBackend.
+func (b *Bucket) Tag(ctx context.Context, name, reference string) (digest.Digest, time.Time, error) {
+	key, err := tagKey(name, reference)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	attr, err := b.Bucket.Attributes(ctx, key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	raw, err := b.Bucket.ReadAll(ctx, key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	d, err := digest.Parse(string(raw))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return d, attr.ModTime, nil
+}
+
 // Manifest implements backend.Backend.
 func (b *Bucket) Manifest(ctx context.Context, name string, reference digest.Digest) (http.Handler, error) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -306,6 +406,18 @@ func (b *Bucket) Blob(ctx context.Context, name string, reference digest.Digest)
 	}), nil
 }
 
+// Ping implements backend.PingBackend.
+func (b *Bucket) Ping(ctx context.Context) error {
+	ok, err := b.Bucket.IsAccessible(ctx)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("bucket is not accessible")
+	}
+
+	return nil
+}
+
 func (b *Bucket) Close() error {
 	return b.Bucket.Close()
 }
@@ -0,0 +1,77 @@
+package bucket
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+)
+
+func TestTagKey(t *testing.T) {
+	keys := map[string]string{}
+	for _, image := range []struct {
+		name      string
+		reference string
+	}{
+		{"foo", "bar"},
+		{"foo/bar", "latest"},
+		{"foo/bar", "bar"},
+		{"foo/bar/latest", "bar"},
+		{"foo/_tags/bar", "latest"},
+	} {
+		key, err := tagKey(image.name, image.reference)
+		if image.name == "foo/_tags/bar" {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+
+		other, ok := keys[key]
+		require.False(t, ok, "%s:%s collides with %s", image.name, image.reference, other)
+		keys[key] = image.name + ":" + image.reference
+	}
+
+	for _, image := range []struct {
+		name      string
+		reference string
+	}{
+		{"../foo", "bar"},
+		{"foo", "../bar"},
+		{"foo", "bar/baz"},
+		{"Foo", "bar"},
+	} {
+		_, err := tagKey(image.name, image.reference)
+		require.Error(t, err, "%s:%s", image.name, image.reference)
+	}
+}
+
+func TestBucketTag(t *testing.T) {
+	var (
+		ctx = context.Background()
+		b   = &Bucket{Bucket: memblob.OpenBucket(nil)}
+	)
+	t.Cleanup(func() { _ = b.Close() })
+
+	images := map[[2]string]digest.Digest{
+		{"foo", "bar"}:        digest.FromString("foo:bar"),
+		{"foo/bar", "latest"}: digest.FromString("foo/bar:latest"),
+	}
+
+	for image, d := range images {
+		key, err := tagKey(image[0], image[1])
+		require.NoError(t, err)
+		require.NoError(t, b.Bucket.WriteAll(ctx, key, []byte(d.String()), nil))
+	}
+
+	for image, expected := range images {
+		d, storedAt, err := b.Tag(ctx, image[0], image[1])
+		require.NoError(t, err)
+		require.Equal(t, expected, d)
+		require.False(t, storedAt.IsZero())
+	}
+
+	_, _, err := b.Tag(ctx, "foo/bar", "bar")
+	require.Error(t, err)
+}
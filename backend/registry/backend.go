@@ -4,14 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
 	ghauth "github.com/cli/go-gh/v2/pkg/auth"
 	"github.com/fluxcd/pkg/auth"
 	"github.com/fluxcd/pkg/auth/aws"
@@ -22,15 +30,42 @@ import (
 	"github.com/frantjc/sindri/internal/httputil"
 	"github.com/frantjc/sindri/internal/logutil"
 	xslices "github.com/frantjc/x/slices"
+	"github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/uuid"
 	specs "github.com/opencontainers/distribution-spec/specs-go/v1"
 	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/sync/singleflight"
 )
 
 const Scheme = "registry"
 
 const (
-	tokenPathParamKey = "token_path"
-	tlsVerifyParamKey = "tls_verify"
+	tokenPathParamKey             = "token_path"
+	tlsVerifyParamKey             = "tls_verify"
+	upstreamAuthParamKey          = "upstream_auth"
+	caFileParamKey                = "ca_file"
+	certFileParamKey              = "cert_file"
+	keyFileParamKey               = "key_file"
+	insecureSkipVerifyParamKey    = "insecure_skip_verify"
+	followRedirectsParamKey       = "follow_redirects"
+	blobCacheDirParamKey          = "blob_cache_dir"
+	blobCacheMaxBytesParamKey     = "blob_cache_max_bytes"
+	blobCacheMaxAgeParamKey       = "blob_cache_max_age"
+	repositoryTemplateParamKey    = "repository_template"
+	nameRegexpParamKey            = "name_regexp"
+	nameReplacementParamKey       = "name_replacement"
+	nameSeparatorParamKey         = "name_separator"
+	createRepositoriesParamKey    = "create_repositories"
+	ecrImageTagMutabilityParamKey = "ecr_image_tag_mutability"
+	ecrLifecyclePolicyParamKey    = "ecr_lifecycle_policy_file"
+	ghcrVisibilityParamKey        = "ghcr_visibility"
+	ghcrSourceRepositoryParamKey  = "ghcr_source_repository"
 )
 
 func init() {
@@ -43,12 +78,21 @@ func init() {
 				host        = u.Host
 				repository  = strings.TrimPrefix(u.Path, "/")
 				tokenPath   = "/token"
+				q           = u.Query()
 			)
 
-			if tlsVerify, err := strconv.ParseBool(u.Query().Get(tlsVerifyParamKey)); err == nil && !tlsVerify {
+			if tlsVerify, err := strconv.ParseBool(q.Get(tlsVerifyParamKey)); err == nil && !tlsVerify {
 				scheme = "http"
 			}
 
+			upstreamAuth := false
+			if upstreamAuthParam := q.Get(upstreamAuthParamKey); upstreamAuthParam != "" {
+				var err error
+				if upstreamAuth, err = strconv.ParseBool(upstreamAuthParam); err != nil {
+					return nil, err
+				}
+			}
+
 			switch host {
 			case "ghcr.io":
 				if repository == "" {
@@ -58,17 +102,155 @@ func init() {
 				tokenPath = "/v2/token"
 			}
 
-			if paramTokenPath := u.Query().Get(tokenPathParamKey); paramTokenPath != "" {
+			if paramTokenPath := q.Get(tokenPathParamKey); paramTokenPath != "" {
 				tokenPath = paramTokenPath
 			}
 
+			followRedirects := false
+			if followRedirectsParam := q.Get(followRedirectsParamKey); followRedirectsParam != "" {
+				var err error
+				if followRedirects, err = strconv.ParseBool(followRedirectsParam); err != nil {
+					return nil, err
+				}
+			}
+
+			blobCacheDir := q.Get(blobCacheDirParamKey)
+			if blobCacheDir != "" {
+				if err := os.MkdirAll(blobCacheDir, 0755); err != nil {
+					return nil, err
+				}
+			}
+
+			var blobCacheMaxBytes int64
+			if blobCacheMaxBytesParam := q.Get(blobCacheMaxBytesParamKey); blobCacheMaxBytesParam != "" {
+				var err error
+				if blobCacheMaxBytes, err = strconv.ParseInt(blobCacheMaxBytesParam, 10, 64); err != nil {
+					return nil, err
+				}
+			}
+
+			var blobCacheMaxAge time.Duration
+			if blobCacheMaxAgeParam := q.Get(blobCacheMaxAgeParamKey); blobCacheMaxAgeParam != "" {
+				var err error
+				if blobCacheMaxAge, err = time.ParseDuration(blobCacheMaxAgeParam); err != nil {
+					return nil, err
+				}
+			}
+
+			var mapping *RepositoryMapping
+			if nameRegexp, nameSeparator, repositoryTemplate := q.Get(nameRegexpParamKey), q.Get(nameSeparatorParamKey), q.Get(repositoryTemplateParamKey); nameRegexp != "" || nameSeparator != "" || repositoryTemplate != "" {
+				mapping = &RepositoryMapping{
+					Replacement: q.Get(nameReplacementParamKey),
+					Separator:   nameSeparator,
+				}
+
+				if nameRegexp != "" {
+					var err error
+					if mapping.Regexp, err = regexp.Compile(nameRegexp); err != nil {
+						return nil, err
+					}
+				}
+
+				if repositoryTemplate != "" {
+					var err error
+					if mapping.Template, err = NewRepositoryTemplate(repositoryTemplate); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			var provisioner RepositoryProvisioner
+			if _, _, ok := parseECRHost(host); ok {
+				createRepositories := true
+				if createRepositoriesParam := q.Get(createRepositoriesParamKey); createRepositoriesParam != "" {
+					var err error
+					if createRepositories, err = strconv.ParseBool(createRepositoriesParam); err != nil {
+						return nil, err
+					}
+				}
+
+				if createRepositories {
+					imageTagMutability := ecrtypes.ImageTagMutability(strings.ToUpper(q.Get(ecrImageTagMutabilityParamKey)))
+					if imageTagMutability != "" && !slices.Contains(imageTagMutability.Values(), imageTagMutability) {
+						return nil, fmt.Errorf("%s must be one of %v: %s", ecrImageTagMutabilityParamKey, imageTagMutability.Values(), q.Get(ecrImageTagMutabilityParamKey))
+					}
+
+					ecrProvisioner, err := NewECRProvisioner(ctx, host)
+					if err != nil {
+						return nil, err
+					}
+
+					ecrProvisioner.ImageTagMutability = imageTagMutability
+
+					if lifecyclePolicyFile := q.Get(ecrLifecyclePolicyParamKey); lifecyclePolicyFile != "" {
+						lifecyclePolicy, err := os.ReadFile(lifecyclePolicyFile)
+						if err != nil {
+							return nil, err
+						}
+
+						ecrProvisioner.LifecyclePolicy = string(lifecyclePolicy)
+					}
+
+					provisioner = ecrProvisioner
+				}
+			}
+
+			var githubPackages *GitHubPackages
+			if host == "ghcr.io" {
+				if q.Has(ghcrVisibilityParamKey) {
+					return nil, fmt.Errorf("%s is not supported: GitHub has no API to change a package's visibility, so link packages to a repository with %s instead or change it in each package's settings", ghcrVisibilityParamKey, ghcrSourceRepositoryParamKey)
+				}
+
+				if sourceRepository := q.Get(ghcrSourceRepositoryParamKey); sourceRepository != "" {
+					if _, _, ok := strings.Cut(sourceRepository, "/"); !ok {
+						return nil, fmt.Errorf("%s must be <owner>/<repo>: %s", ghcrSourceRepositoryParamKey, sourceRepository)
+					}
+
+					githubPackages = &GitHubPackages{
+						SourceRepository: sourceRepository,
+					}
+				}
+			} else if q.Has(ghcrVisibilityParamKey) || q.Has(ghcrSourceRepositoryParamKey) {
+				logutil.SloggerFrom(ctx).Warn("ignoring ghcr.io query parameters for another host", "host", host)
+			}
+
+			insecureSkipVerify := false
+			if insecureSkipVerifyParam := q.Get(insecureSkipVerifyParamKey); insecureSkipVerifyParam != "" {
+				var err error
+				if insecureSkipVerify, err = strconv.ParseBool(insecureSkipVerifyParam); err != nil {
+					return nil, err
+				}
+			}
+
+			var rt http.RoundTripper
+			if caFile, certFile, keyFile := q.Get(caFileParamKey), q.Get(certFileParamKey), q.Get(keyFileParamKey); caFile != "" || certFile != "" || keyFile != "" || insecureSkipVerify {
+				tlsConfig, err := newTLSConfig(caFile, certFile, keyFile, insecureSkipVerify)
+				if err != nil {
+					return nil, err
+				}
+
+				t := http.DefaultTransport.(*http.Transport).Clone()
+				t.TLSClientConfig = tlsConfig
+				rt = t
+			}
+
 			return &Registry{
-				Scheme:     scheme,
-				Host:       host,
-				Username:   username,
-				Password:   password,
-				Repository: repository,
-				TokenPath:  tokenPath,
+				Scheme:            scheme,
+				Host:              host,
+				Username:          username,
+				Password:          password,
+				Repository:        repository,
+				TokenPath:         tokenPath,
+				UpstreamAuth:      upstreamAuth,
+				Transport:         rt,
+				FollowRedirects:   followRedirects,
+				BlobCacheDir:      blobCacheDir,
+				BlobCacheMaxBytes: blobCacheMaxBytes,
+				BlobCacheMaxAge:   blobCacheMaxAge,
+				Mapping:           mapping,
+				Provisioner:       provisioner,
+				GitHubPackages:    githubPackages,
+				WorkDir:           os.TempDir(),
 			}, nil
 		}),
 		Scheme,
@@ -124,19 +306,88 @@ type Registry struct {
 	Host       string
 	Repository string
 	TokenPath  string
+	// UpstreamAuth makes Sindri authenticate to the upstream registry with its own
+	// credentials when proxying manifests and blobs instead of passing the client's
+	// credentials through, so that clients need no credentials for the upstream.
+	UpstreamAuth bool
+	// Transport is used for every request to the upstream registry. If nil,
+	// http.DefaultTransport is used. When set, images are pushed by Sindri through
+	// Transport instead of being published by the Dagger engine, since the engine
+	// cannot be handed Sindri's TLS configuration.
+	Transport http.RoundTripper
+	// FollowRedirects makes Sindri follow redirects from the upstream, e.g. to a CDN,
+	// and stream the content to the client itself instead of passing them through.
+	FollowRedirects bool
+	// BlobCacheDir, if set, is a directory that blobs streamed through Sindri
+	// are cached in so that subsequent pulls of them are served locally.
+	// Unless UpstreamAuth is set, the upstream is still asked whether the
+	// client can pull each blob before it is served from BlobCacheDir.
+	BlobCacheDir string
+	// BlobCacheMaxBytes, if positive, is how large BlobCacheDir may grow before
+	// the least recently served blobs are evicted from it.
+	BlobCacheMaxBytes int64
+	// BlobCacheMaxAge, if positive, is how long a blob may go unserved
+	// before it is evicted from BlobCacheDir.
+	BlobCacheMaxAge time.Duration
+	// Mapping maps each <name> to the repository that it is stored in.
+	// If nil, <name> is stored in Repository/<name>.
+	Mapping *RepositoryMapping
+	// Provisioner, if set, is used to create each repository before the first push to it.
+	Provisioner RepositoryProvisioner
+	// GitHubPackages, if set, configures ghcr.io container packages as they are published.
+	GitHubPackages *GitHubPackages
+	// WorkDir is where images are exported to before Sindri pushes them itself.
+	WorkDir string
+
+	transportsMu    sync.Mutex
+	transports      map[string]*repositoryTransport
+	transportsGroup singleflight.Group
+	provisioned     sync.Map
+	// pruneMu serializes evictions from BlobCacheDir.
+	pruneMu sync.Mutex
 }
 
 var (
 	_ backend.AuthBackend = new(Registry)
+	_ backend.TagBackend  = new(Registry)
+	_ backend.PingBackend = new(Registry)
 )
 
 // Store implements backend.Backend.
 func (r *Registry) Store(ctx context.Context, container *dagger.Container, dag *dagger.Client, name, reference string) (digest.Digest, error) {
+	repository, err := r.repository(name)
+	if err != nil {
+		return "", httputil.NewError(err, http.StatusBadRequest)
+	}
+
+	if err := r.provision(ctx, repository); err != nil {
+		return "", err
+	}
+
 	ref := fmt.Sprintf("%s:%s",
-		path.Join(r.Host, r.Repository, name),
+		path.Join(r.Host, repository),
 		reference,
 	)
 
+	if r.GitHubPackages != nil {
+		container = r.GitHubPackages.WithSource(container)
+	}
+
+	d, err := r.publish(ctx, container, dag, ref)
+	if err != nil {
+		return "", err
+	}
+
+	return d, nil
+}
+
+// publish publishes the container to ref, either through the Dagger engine
+// or by Sindri itself if r.Transport is set.
+func (r *Registry) publish(ctx context.Context, container *dagger.Container, dag *dagger.Client, ref string) (digest.Digest, error) {
+	if r.Transport != nil {
+		return r.push(ctx, container, ref)
+	}
+
 	username, password, ok, err := r.getRegistryAuth(ctx, ref)
 	if err != nil {
 		return "", err
@@ -157,14 +408,131 @@ func (r *Registry) Store(ctx context.Context, container *dagger.Container, dag *
 	return digest.Digest(d), nil
 }
 
+// push exports the container and pushes it to ref through r.Transport. The Dagger
+// engine only trusts the CAs and presents the client certificates that it was
+// started with, which Sindri cannot hand it per backend, so Sindri pushes itself
+// when r.Transport carries its own TLS configuration, at the cost of exporting
+// each image to r.WorkDir first.
+func (r *Registry) push(ctx context.Context, container *dagger.Container, ref string) (digest.Digest, error) {
+	tmp := filepath.Join(r.WorkDir, uuid.NewString()+".tar")
+
+	if _, err := container.AsTarball().Export(ctx, tmp); err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	image, err := tarball.ImageFromPath(tmp, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return r.write(ctx, image, ref)
+}
+
+// write pushes image to ref through r.Transport.
+func (r *Registry) write(ctx context.Context, image v1.Image, ref string) (digest.Digest, error) {
+	opts := []gcrname.Option{}
+	if r.Scheme == "http" {
+		opts = append(opts, gcrname.Insecure)
+	}
+
+	tag, err := gcrname.NewTag(ref, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := remote.Write(tag, image,
+		remote.WithContext(ctx),
+		remote.WithTransport(r.transport()),
+		remote.WithAuth(&authenticator{registry: r, ref: ref}),
+	); err != nil {
+		return "", err
+	}
+
+	hash, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return digest.Parse(hash.String())
+}
+
+// Tag implements backend.TagBackend by resolving the tag in the upstream. The upstream
+// does not say when the tag was pushed, so the time returned is always zero: the tag
+// is never fresh enough to skip a build and is only served as-is when builds are disabled.
+func (r *Registry) Tag(ctx context.Context, name, reference string) (digest.Digest, time.Time, error) {
+	repository, err := r.repository(name)
+	if err != nil {
+		return "", time.Time{}, httputil.NewError(err, http.StatusBadRequest)
+	}
+
+	opts := []gcrname.Option{}
+	if r.Scheme == "http" {
+		opts = append(opts, gcrname.Insecure)
+	}
+
+	ref := fmt.Sprintf("%s:%s",
+		path.Join(r.Host, repository),
+		reference,
+	)
+
+	tag, err := gcrname.NewTag(ref, opts...)
+	if err != nil {
+		return "", time.Time{}, httputil.NewError(err, http.StatusBadRequest)
+	}
+
+	desc, err := remote.Head(tag,
+		remote.WithContext(ctx),
+		remote.WithTransport(r.transport()),
+		remote.WithAuth(&authenticator{registry: r, ref: ref}),
+	)
+	if terr := new(transport.Error); errors.As(err, &terr) {
+		return "", time.Time{}, httputil.NewError(err, terr.StatusCode)
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+
+	d, err := digest.Parse(desc.Digest.String())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return d, time.Time{}, nil
+}
+
 // Manifest implements backend.Backend.
-func (b *Registry) Manifest(_ context.Context, name string, reference digest.Digest) (http.Handler, error) {
-	return b.proxy("", "/v2", b.Repository, name, "manifests", reference.String()), nil
+func (b *Registry) Manifest(ctx context.Context, name string, reference digest.Digest) (http.Handler, error) {
+	repository, err := b.repository(name)
+	if err != nil {
+		return nil, httputil.NewError(err, http.StatusBadRequest)
+	}
+
+	rt, err := b.roundTripper(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.proxy(rt, "", "/v2", repository, "manifests", reference.String()), nil
 }
 
 // Blob implements backend.Backend.
-func (b *Registry) Blob(_ context.Context, name string, reference digest.Digest) (http.Handler, error) {
-	return b.proxy("", "/v2", b.Repository, name, "blobs", reference.String()), nil
+func (b *Registry) Blob(ctx context.Context, name string, reference digest.Digest) (http.Handler, error) {
+	repository, err := b.repository(name)
+	if err != nil {
+		return nil, httputil.NewError(err, http.StatusBadRequest)
+	}
+
+	rt, err := b.roundTripper(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := b.proxy(rt, "", "/v2", repository, "blobs", reference.String())
+	if b.BlobCacheDir != "" {
+		return b.cache(rt, repository, reference, handler), nil
+	}
+
+	return handler, nil
 }
 
 // Close implements backend.Backend.
@@ -172,13 +540,46 @@ func (b *Registry) Close() error {
 	return nil
 }
 
+// Ping implements backend.PingBackend. The upstream is reachable if it
+// responds to the base API without a server error, e.g. with a challenge.
+func (b *Registry) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.getURL("/v2/").String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := b.transport().RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream responded %s", res.Status)
+	}
+
+	return nil
+}
+
 // Root implements backend.AuthBackend.
 func (b *Registry) Root(context.Context) (http.Handler, error) {
-	return b.proxy("", "/v2/"), nil
+	if b.UpstreamAuth {
+		// NB: Sindri authenticates to the upstream itself, so there
+		// is nothing for the client to authenticate to here.
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		}), nil
+	}
+
+	return b.proxy(b.transport(), "", "/v2/"), nil
 }
 
 // Token implements backend.AuthBackend.
 func (b *Registry) Token(context.Context) (http.Handler, error) {
+	if b.UpstreamAuth {
+		return nil, httputil.NewError(fmt.Errorf("token not supported when using %s", upstreamAuthParamKey), http.StatusNotFound)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log := logutil.SloggerFrom(r.Context())
 		q := r.URL.Query()
@@ -189,11 +590,155 @@ func (b *Registry) Token(context.Context) (http.Handler, error) {
 		scope := "repository:" + b.Repository + ":pull"
 		log.Debug("scope", "before", q.Get("scope"), "after", scope)
 		q.Set("scope", scope)
-		b.proxy(q.Encode(), b.TokenPath).ServeHTTP(w, r)
+		b.proxy(b.transport(), q.Encode(), b.TokenPath).ServeHTTP(w, r)
 	}), nil
 }
 
-func (b *Registry) proxy(query string, elem ...string) http.Handler {
+const (
+	// maxTransports is how many repositories' transports are kept at once.
+	maxTransports = 1024
+	// transportTTL is how long a repository's transport is kept before
+	// it is replaced, e.g. to pick up credentials that changed.
+	transportTTL = time.Hour
+	// transportTimeout bounds the token round trip of building a transport,
+	// which is not canceled along with the request that asked for it since
+	// concurrent requests for the same repository share it.
+	transportTimeout = time.Minute
+)
+
+// repositoryTransport is a transport that authenticates as Sindri to one repository.
+type repositoryTransport struct {
+	http.RoundTripper
+	createdAt time.Time
+}
+
+// roundTripper returns the http.RoundTripper to use to proxy requests for the
+// given repository to the upstream. Unless b.UpstreamAuth is set, this is just
+// b.transport() and the client's credentials are passed through as-is.
+// Otherwise, it is a transport that authenticates as Sindri, cached per repository
+// so that its token is reused across requests. Concurrent requests for a repository
+// that has none share the one that is built, outside of b.transportsMu.
+func (b *Registry) roundTripper(ctx context.Context, repository string) (http.RoundTripper, error) {
+	if !b.UpstreamAuth {
+		return b.transport(), nil
+	}
+
+	b.transportsMu.Lock()
+	t, ok := b.transports[repository]
+	b.transportsMu.Unlock()
+	if ok && time.Since(t.createdAt) < transportTTL {
+		return t, nil
+	}
+
+	v, err, _ := b.transportsGroup.Do(repository, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), transportTimeout)
+		defer cancel()
+
+		opts := []gcrname.Option{}
+		if b.Scheme == "http" {
+			opts = append(opts, gcrname.Insecure)
+		}
+
+		reg, err := gcrname.NewRegistry(b.Host, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		rt, err := transport.NewWithContext(
+			ctx,
+			reg,
+			&authenticator{registry: b, ref: path.Join(b.Host, repository)},
+			b.transport(),
+			[]string{reg.Repo(repository).Scope(transport.PullScope)},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		t := &repositoryTransport{RoundTripper: rt, createdAt: time.Now()}
+
+		b.transportsMu.Lock()
+		defer b.transportsMu.Unlock()
+
+		if b.transports == nil {
+			b.transports = map[string]*repositoryTransport{}
+		}
+		b.evictTransports()
+		b.transports[repository] = t
+
+		return t, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*repositoryTransport), nil
+}
+
+// evictTransports makes room for another transport in b.transports by evicting
+// the expired ones and then, if there are still too many, the oldest ones.
+// b.transportsMu must be held.
+func (b *Registry) evictTransports() {
+	for repository, t := range b.transports {
+		if time.Since(t.createdAt) >= transportTTL {
+			delete(b.transports, repository)
+		}
+	}
+
+	for len(b.transports) >= maxTransports {
+		var (
+			oldest    string
+			createdAt time.Time
+		)
+		for repository, t := range b.transports {
+			if createdAt.IsZero() || t.createdAt.Before(createdAt) {
+				oldest, createdAt = repository, t.createdAt
+			}
+		}
+		delete(b.transports, oldest)
+	}
+}
+
+// transport returns b.Transport, or http.DefaultTransport if it is nil,
+// tracing each round trip through it as a child of its request's span.
+func (b *Registry) transport() http.RoundTripper {
+	rt := http.DefaultTransport
+	if b.Transport != nil {
+		rt = b.Transport
+	}
+
+	return otelhttp.NewTransport(rt)
+}
+
+// authenticator implements authn.Authenticator by way of getRegistryAuth
+// so that credentials are re-resolved whenever the upstream token is refreshed.
+type authenticator struct {
+	registry *Registry
+	ref      string
+}
+
+var (
+	_ authn.ContextAuthenticator = new(authenticator)
+)
+
+// Authorization implements authn.Authenticator.
+func (a *authenticator) Authorization() (*authn.AuthConfig, error) {
+	return a.AuthorizationContext(context.Background())
+}
+
+// AuthorizationContext implements authn.ContextAuthenticator.
+func (a *authenticator) AuthorizationContext(ctx context.Context) (*authn.AuthConfig, error) {
+	username, password, ok, err := a.registry.getRegistryAuth(ctx, a.ref)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return &authn.AuthConfig{}, nil
+	}
+
+	return &authn.AuthConfig{Username: username, Password: password}, nil
+}
+
+func (b *Registry) proxy(rt http.RoundTripper, query string, elem ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log := logutil.SloggerFrom(r.Context())
 
@@ -207,15 +752,28 @@ func (b *Registry) proxy(query string, elem ...string) http.Handler {
 			return
 		}
 		req.Header = r.Header.Clone()
+		if b.UpstreamAuth {
+			req.Header.Del("Authorization")
+		}
 
 		w.Header().Set("X-Redirected", req.URL.String())
 
-		res, err := http.DefaultTransport.RoundTrip(req)
+		res, err := rt.RoundTrip(req)
 		if err != nil {
 			log.Error(err.Error())
 			http.Error(w, err.Error(), httputil.HTTPStatusCode(err))
 			return
 		}
+
+		if b.FollowRedirects && isRedirect(res.StatusCode) {
+			log.Debug("following redirect", "location", res.Header.Get("Location"))
+
+			if res, err = b.follow(req, res); err != nil {
+				log.Error(err.Error())
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
 		defer res.Body.Close()
 
 		var body io.Reader = res.Body
@@ -247,7 +805,10 @@ func (b *Registry) proxy(query string, elem ...string) http.Handler {
 			}
 		}
 
-		if wwwAuth := res.Header.Get("Www-Authenticate"); wwwAuth != "" {
+		if b.UpstreamAuth {
+			// NB: The client cannot do anything about a challenge for Sindri's own credentials.
+			w.Header().Del("Www-Authenticate")
+		} else if wwwAuth := res.Header.Get("Www-Authenticate"); wwwAuth != "" {
 			scheme := "http"
 
 			if r != nil {
@@ -263,12 +824,44 @@ func (b *Registry) proxy(query string, elem ...string) http.Handler {
 			w.Header().Set("Www-Authenticate", rewrittenWwwAuth)
 		}
 
-		// Hopefully this is a redirect so we don't have to proxy massive blobs.
+		// Hopefully this is a redirect so we don't have to proxy massive blobs,
+		// unless b.FollowRedirects is set, in which case we have to.
 		w.WriteHeader(res.StatusCode)
 		_, _ = io.Copy(w, body)
 	})
 }
 
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// follow follows the redirect res from the upstream in response to req.
+func (b *Registry) follow(req *http.Request, res *http.Response) (*http.Response, error) {
+	defer res.Body.Close()
+
+	location, err := res.Location()
+	if err != nil {
+		return nil, err
+	}
+
+	redirect, err := http.NewRequestWithContext(req.Context(), req.Method, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	redirect.Header = req.Header.Clone()
+	// NB: Don't leak credentials for the upstream to wherever it redirects to,
+	// e.g. S3 which rejects requests with multiple means of authentication.
+	redirect.Header.Del("Authorization")
+
+	// NB: Use an *http.Client to follow any further redirects.
+	return (&http.Client{Transport: b.transport()}).Do(redirect)
+}
+
 func (b *Registry) getURL(elem ...string) *url.URL {
 	return (&url.URL{
 		Scheme: b.Scheme,
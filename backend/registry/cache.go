@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+// cache serves the blob reference from b.BlobCacheDir if it is there and the
+// client may pull it from repository. Otherwise, it serves it from handler,
+// caching it on the way through.
+func (b *Registry) cache(rt http.RoundTripper, repository string, reference digest.Digest, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := logutil.SloggerFrom(r.Context())
+		name := filepath.Join(b.BlobCacheDir, reference.Algorithm().String(), reference.Encoded())
+
+		if f, fi := b.cached(name); f != nil {
+			defer f.Close()
+
+			if b.authorized(r, rt, repository, reference) {
+				log.Debug("serving blob from cache", "path", name)
+
+				// NB: Mark the blob as served so that it is evicted after those that have not been since.
+				now := time.Now()
+				_ = os.Chtimes(name, now, now)
+
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+				w.Header().Set("Docker-Content-Digest", reference.String())
+
+				if r.Method != http.MethodHead {
+					_, _ = io.Copy(w, f)
+				}
+				return
+			}
+		}
+
+		if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			log.Error(err.Error())
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		tmp, err := os.Create(filepath.Join(filepath.Dir(name), uuid.NewString()+tmpExt))
+		if err != nil {
+			log.Error(err.Error())
+			handler.ServeHTTP(w, r)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		cw := &cacheResponseWriter{
+			ResponseWriter: w,
+			w:              tmp,
+			verifier:       reference.Verifier(),
+		}
+
+		handler.ServeHTTP(cw, r)
+
+		if cw.statusCode != http.StatusOK || cw.err != nil || !cw.verifier.Verified() {
+			return
+		}
+
+		if err := tmp.Close(); err != nil {
+			log.Error(err.Error())
+			return
+		}
+
+		if err := os.Rename(tmp.Name(), name); err != nil {
+			log.Error(err.Error())
+			return
+		}
+
+		log.Debug("cached blob", "path", name)
+
+		b.prune(log)
+	})
+}
+
+// tmpExt is the extension of blobs that are still being cached.
+const tmpExt = ".tmp"
+
+// cached opens the blob cached at name, unless it has gone unserved for longer
+// than b.BlobCacheMaxAge, in which case it is evicted.
+func (b *Registry) cached(name string) (*os.File, os.FileInfo) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil
+	}
+
+	if b.BlobCacheMaxAge > 0 && time.Since(fi.ModTime()) > b.BlobCacheMaxAge {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return nil, nil
+	}
+
+	return f, fi
+}
+
+// authorized reports whether the client that made r may pull the blob reference
+// from repository. Sindri's own credentials are what the blob was cached with when
+// b.UpstreamAuth is set, so any client may. Otherwise, the upstream is asked with
+// the client's credentials so that its access control is not bypassed by the cache.
+func (b *Registry) authorized(r *http.Request, rt http.RoundTripper, repository string, reference digest.Digest) bool {
+	if b.UpstreamAuth {
+		return true
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodHead, b.getURL("/v2", repository, "blobs", reference.String()).String(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Range")
+
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		logutil.SloggerFrom(r.Context()).Warn("checking access to cached blob", "err", err.Error())
+		return false
+	}
+	_ = res.Body.Close()
+
+	// NB: A redirect, e.g. to a CDN, means the upstream would serve the blob.
+	return res.StatusCode < http.StatusBadRequest
+}
+
+// prune evicts blobs from b.BlobCacheDir that have gone unserved for longer than
+// b.BlobCacheMaxAge and then the least recently served ones until what is left
+// fits in b.BlobCacheMaxBytes.
+func (b *Registry) prune(log *slog.Logger) {
+	if b.BlobCacheMaxBytes <= 0 && b.BlobCacheMaxAge <= 0 {
+		return
+	}
+
+	b.pruneMu.Lock()
+	defer b.pruneMu.Unlock()
+
+	type blob struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var (
+		blobs []blob
+		now   = time.Now()
+	)
+	if err := filepath.WalkDir(b.BlobCacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() || strings.HasSuffix(path, tmpExt) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		blobs = append(blobs, blob{path: path, size: fi.Size(), modTime: fi.ModTime()})
+		return nil
+	}); err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	// Most recently served first.
+	slices.SortFunc(blobs, func(a, b blob) int {
+		return cmp.Compare(b.modTime.UnixNano(), a.modTime.UnixNano())
+	})
+
+	var size int64
+	for _, blob := range blobs {
+		size += blob.size
+
+		if (b.BlobCacheMaxAge <= 0 || now.Sub(blob.modTime) <= b.BlobCacheMaxAge) &&
+			(b.BlobCacheMaxBytes <= 0 || size <= b.BlobCacheMaxBytes) {
+			continue
+		}
+
+		if err := os.Remove(blob.path); err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		size -= blob.size
+		log.Debug("evicted blob from cache", "path", blob.path)
+	}
+}
+
+// cacheResponseWriter tees everything written to the client
+// to w so long as the response is successful.
+type cacheResponseWriter struct {
+	http.ResponseWriter
+	w          io.Writer
+	verifier   digest.Verifier
+	statusCode int
+	err        error
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *cacheResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements http.ResponseWriter.
+func (w *cacheResponseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+
+	if w.statusCode == http.StatusOK && w.err == nil {
+		if _, w.err = w.w.Write(p); w.err == nil {
+			_, _ = w.verifier.Write(p)
+		}
+	}
+
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,230 @@
+package registry_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/backend/registry"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	upstreamToken = "Bearer upstream"
+)
+
+// blobStandIn is a minimal stand-in for a registry that serves blobs to
+// clients with upstreamToken by redirecting them to a "CDN".
+type blobStandIn struct {
+	mu    sync.Mutex
+	blobs map[digest.Digest]string
+	gets  map[digest.Digest]int
+	// cdnAuthorization is the Authorization header of the last request to the CDN.
+	cdnAuthorization string
+}
+
+func (s *blobStandIn) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v2/{repository...}", func(w http.ResponseWriter, r *http.Request) {
+		repository, reference, ok := strings.Cut(r.PathValue("repository"), "/blobs/")
+		if !ok || repository != "sindri/steamapps/valheim" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Header.Get("Authorization") != upstreamToken {
+			w.Header().Set("Www-Authenticate", `Bearer realm="https://auth.example.com/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		s.mu.Lock()
+		_, ok = s.blobs[digest.Digest(reference)]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Redirect to the "CDN" by way of another redirect.
+		http.Redirect(w, r, "/redirect/"+reference, http.StatusTemporaryRedirect)
+	})
+
+	mux.HandleFunc("/redirect/{digest}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/cdn/"+r.PathValue("digest"), http.StatusFound)
+	})
+
+	mux.HandleFunc("/cdn/{digest}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		d := digest.Digest(r.PathValue("digest"))
+		s.cdnAuthorization = r.Header.Get("Authorization")
+		s.gets[d]++
+		_, _ = io.WriteString(w, s.blobs[d])
+	})
+
+	return mux
+}
+
+func (s *blobStandIn) getsOf(d digest.Digest) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.gets[d]
+}
+
+func newBlobStandIn(t *testing.T, blobs ...string) (*blobStandIn, *url.URL) {
+	standIn := &blobStandIn{
+		blobs: map[digest.Digest]string{},
+		gets:  map[digest.Digest]int{},
+	}
+	for _, blob := range blobs {
+		standIn.blobs[digest.FromString(blob)] = blob
+	}
+
+	srv := httptest.NewServer(standIn.handler())
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	return standIn, u
+}
+
+func getBlob(t *testing.T, r *registry.Registry, d digest.Digest, authorization string) *http.Response {
+	t.Helper()
+
+	handler, err := r.Blob(t.Context(), "steamapps/valheim", d)
+	require.NoError(t, err)
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/v2/steamapps/valheim/blobs/"+d.String(), nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec.Result()
+}
+
+func TestRegistryBlobFollowRedirects(t *testing.T) {
+	var (
+		blob       = "valheim"
+		d          = digest.FromString(blob)
+		standIn, u = newBlobStandIn(t, blob)
+		r          = &registry.Registry{
+			Scheme:     u.Scheme,
+			Host:       u.Host,
+			Repository: "sindri",
+		}
+	)
+
+	// Redirects are passed through to the client by default.
+	res := getBlob(t, r, d, upstreamToken)
+	require.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+	require.Equal(t, "/redirect/"+d.String(), res.Header.Get("Location"))
+	require.Zero(t, standIn.getsOf(d))
+
+	// Each redirect is followed without the client's credentials for the upstream.
+	r.FollowRedirects = true
+	res = getBlob(t, r, d, upstreamToken)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, blob, string(body))
+	require.Equal(t, 1, standIn.getsOf(d))
+	require.Empty(t, standIn.cdnAuthorization)
+}
+
+func TestRegistryBlobCache(t *testing.T) {
+	var (
+		blob       = "valheim"
+		d          = digest.FromString(blob)
+		standIn, u = newBlobStandIn(t, blob)
+		r          = &registry.Registry{
+			Scheme:          u.Scheme,
+			Host:            u.Host,
+			Repository:      "sindri",
+			FollowRedirects: true,
+			BlobCacheDir:    t.TempDir(),
+		}
+		cached = filepath.Join(r.BlobCacheDir, d.Algorithm().String(), d.Encoded())
+	)
+
+	// Clients that the upstream turns away are turned away before the blob is cached...
+	res := getBlob(t, r, d, "")
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	require.NoFileExists(t, cached)
+
+	// ...and after.
+	require.Equal(t, http.StatusOK, getBlob(t, r, d, upstreamToken).StatusCode)
+	require.FileExists(t, cached)
+	require.Equal(t, 1, standIn.getsOf(d))
+
+	res = getBlob(t, r, d, "")
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	require.NotEmpty(t, res.Header.Get("Www-Authenticate"))
+
+	// Clients that the upstream would serve are served from the cache.
+	res = getBlob(t, r, d, upstreamToken)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, d.String(), res.Header.Get("Docker-Content-Digest"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, blob, string(body))
+	require.Equal(t, 1, standIn.getsOf(d))
+}
+
+func TestRegistryBlobCacheLimits(t *testing.T) {
+	var (
+		blobs      = []string{"corekeeper", "valheim000", "palworld00"}
+		standIn, u = newBlobStandIn(t, blobs...)
+		r          = &registry.Registry{
+			Scheme:          u.Scheme,
+			Host:            u.Host,
+			Repository:      "sindri",
+			FollowRedirects: true,
+			BlobCacheDir:    t.TempDir(),
+			// Room for two of the blobs.
+			BlobCacheMaxBytes: 20,
+			BlobCacheMaxAge:   time.Hour,
+		}
+		cached = func(blob string) string {
+			d := digest.FromString(blob)
+			return filepath.Join(r.BlobCacheDir, d.Algorithm().String(), d.Encoded())
+		}
+		age = func(blob string, ago time.Duration) {
+			at := time.Now().Add(-ago)
+			require.NoError(t, os.Chtimes(cached(blob), at, at))
+		}
+	)
+
+	for _, blob := range blobs[:2] {
+		require.Equal(t, http.StatusOK, getBlob(t, r, digest.FromString(blob), upstreamToken).StatusCode)
+	}
+	age(blobs[0], time.Minute*2)
+	age(blobs[1], time.Minute)
+
+	// The least recently served blob is evicted to make room.
+	require.Equal(t, http.StatusOK, getBlob(t, r, digest.FromString(blobs[2]), upstreamToken).StatusCode)
+	require.NoFileExists(t, cached(blobs[0]))
+	require.FileExists(t, cached(blobs[1]))
+	require.FileExists(t, cached(blobs[2]))
+
+	// Blobs that have gone unserved for too long are fetched from the upstream again.
+	age(blobs[1], time.Hour*2)
+	require.Equal(t, http.StatusOK, getBlob(t, r, digest.FromString(blobs[1]), upstreamToken).StatusCode)
+	require.Equal(t, 2, standIn.getsOf(digest.FromString(blobs[1])))
+	require.Equal(t, 1, standIn.getsOf(digest.FromString(blobs[2])))
+}
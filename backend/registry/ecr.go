@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/frantjc/sindri/internal/logutil"
+)
+
+var ecrHostRegexp = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// parseECRHost returns the registry ID and region of
+// the given ECR host or false if it is not one.
+func parseECRHost(host string) (string, string, bool) {
+	matches := ecrHostRegexp.FindStringSubmatch(host)
+	if matches == nil {
+		return "", "", false
+	}
+
+	return matches[1], matches[2], true
+}
+
+// ECRProvisioner implements RepositoryProvisioner by creating repositories
+// through the ECR API, since ECR does not create them on push.
+type ECRProvisioner struct {
+	Client     *ecr.Client
+	RegistryID string
+	// ImageTagMutability is set on each repository when it is created.
+	// Note that Sindri pushes tags more than once as they are rebuilt,
+	// so types.ImageTagMutabilityImmutable is rarely what you want.
+	ImageTagMutability types.ImageTagMutability
+	// LifecyclePolicy, if set, is the JSON lifecycle policy put on each repository
+	// that Sindri pushes to, replacing any other policy that it has.
+	LifecyclePolicy string
+}
+
+var (
+	_ RepositoryProvisioner = new(ECRProvisioner)
+)
+
+// NewECRProvisioner returns an *ECRProvisioner for the given ECR host
+// using the default AWS credentials chain.
+func NewECRProvisioner(ctx context.Context, host string) (*ECRProvisioner, error) {
+	registryID, region, ok := parseECRHost(host)
+	if !ok {
+		return nil, fmt.Errorf("not an ECR host: %s", host)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECRProvisioner{
+		Client:     ecr.NewFromConfig(cfg),
+		RegistryID: registryID,
+	}, nil
+}
+
+// Provision implements RepositoryProvisioner. The lifecycle policy is put on
+// repositories that already exist too, e.g. because putting it failed after
+// creating them, unless they already have it.
+func (p *ECRProvisioner) Provision(ctx context.Context, repository string) error {
+	log := logutil.SloggerFrom(ctx).With("repository", repository)
+
+	if _, err := p.Client.CreateRepository(ctx, &ecr.CreateRepositoryInput{
+		RepositoryName:     aws.String(repository),
+		RegistryId:         p.registryID(),
+		ImageTagMutability: p.ImageTagMutability,
+	}); err != nil {
+		if alreadyExists := new(types.RepositoryAlreadyExistsException); !errors.As(err, &alreadyExists) {
+			return err
+		}
+	} else {
+		log.Info("created ECR repository")
+	}
+
+	if p.LifecyclePolicy == "" {
+		return nil
+	}
+
+	if ok, err := p.hasLifecyclePolicy(ctx, repository); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	if _, err := p.Client.PutLifecyclePolicy(ctx, &ecr.PutLifecyclePolicyInput{
+		RepositoryName:      aws.String(repository),
+		RegistryId:          p.registryID(),
+		LifecyclePolicyText: aws.String(p.LifecyclePolicy),
+	}); err != nil {
+		return err
+	}
+
+	log.Debug("put ECR repository lifecycle policy")
+
+	return nil
+}
+
+// hasLifecyclePolicy reports whether repository already has p.LifecyclePolicy,
+// comparing them as JSON since ECR does not return the text as it was put.
+func (p *ECRProvisioner) hasLifecyclePolicy(ctx context.Context, repository string) (bool, error) {
+	out, err := p.Client.GetLifecyclePolicy(ctx, &ecr.GetLifecyclePolicyInput{
+		RepositoryName: aws.String(repository),
+		RegistryId:     p.registryID(),
+	})
+	if notFound := new(types.LifecyclePolicyNotFoundException); errors.As(err, &notFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var have, want any
+	if err := json.Unmarshal([]byte(aws.ToString(out.LifecyclePolicyText)), &have); err != nil {
+		return false, nil
+	}
+
+	if err := json.Unmarshal([]byte(p.LifecyclePolicy), &want); err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(have, want), nil
+}
+
+func (p *ECRProvisioner) registryID() *string {
+	if p.RegistryID == "" {
+		return nil
+	}
+
+	return aws.String(p.RegistryID)
+}
@@ -0,0 +1,207 @@
+package registry_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/frantjc/sindri/backend"
+	"github.com/frantjc/sindri/backend/registry"
+	"github.com/stretchr/testify/require"
+)
+
+// ecrStandIn is a minimal stand-in for the ECR API
+// that supports only what Sindri uses.
+type ecrStandIn struct {
+	mu                 sync.Mutex
+	repositories       map[string]string
+	lifecyclePolicies  map[string]string
+	createRepositories int
+	putLifecyclePolicy int
+	// failPutLifecyclePolicy is how many more times PutLifecyclePolicy fails.
+	failPutLifecyclePolicy int
+}
+
+func (s *ecrStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+	_, operation, _ := strings.Cut(r.Header.Get("X-Amz-Target"), ".")
+	switch operation {
+	case "CreateRepository":
+		s.createRepositories++
+
+		if _, ok := s.repositories[body["repositoryName"]]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "RepositoryAlreadyExistsException",
+				"message": "The repository with name '" + body["repositoryName"] + "' already exists",
+			})
+			return
+		}
+
+		s.repositories[body["repositoryName"]] = body["imageTagMutability"]
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"repository": map[string]string{
+				"repositoryName":     body["repositoryName"],
+				"registryId":         body["registryId"],
+				"imageTagMutability": body["imageTagMutability"],
+			},
+		})
+	case "GetLifecyclePolicy":
+		lifecyclePolicy, ok := s.lifecyclePolicies[body["repositoryName"]]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"__type": "LifecyclePolicyNotFoundException",
+			})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"repositoryName":      body["repositoryName"],
+			"lifecyclePolicyText": lifecyclePolicy,
+		})
+	case "PutLifecyclePolicy":
+		s.putLifecyclePolicy++
+
+		if s.failPutLifecyclePolicy > 0 {
+			s.failPutLifecyclePolicy--
+			// NB: Not a ServerException, which the client would retry itself.
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"__type": "InvalidParameterException",
+			})
+			return
+		}
+
+		if _, ok := s.repositories[body["repositoryName"]]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"__type": "RepositoryNotFoundException",
+			})
+			return
+		}
+
+		s.lifecyclePolicies[body["repositoryName"]] = body["lifecyclePolicyText"]
+
+		_ = json.NewEncoder(w).Encode(body)
+	default:
+		http.Error(w, "unsupported operation "+operation, http.StatusBadRequest)
+	}
+}
+
+func newECRStandIn(t *testing.T) (*ecrStandIn, *ecr.Client) {
+	standIn := &ecrStandIn{
+		repositories:      map[string]string{},
+		lifecyclePolicies: map[string]string{},
+	}
+	srv := httptest.NewServer(standIn)
+	t.Cleanup(srv.Close)
+
+	return standIn, ecr.New(ecr.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	})
+}
+
+func TestECRProvisionerProvision(t *testing.T) {
+	var (
+		ctx             = t.Context()
+		standIn, client = newECRStandIn(t)
+		lifecyclePolicy = `{"rules":[{"rulePriority":1,"selection":{"tagStatus":"untagged","countType":"sinceImagePushed","countUnit":"days","countNumber":1},"action":{"type":"expire"}}]}`
+		provisioner     = &registry.ECRProvisioner{
+			Client:             client,
+			RegistryID:         "123456789012",
+			ImageTagMutability: types.ImageTagMutabilityMutable,
+			LifecyclePolicy:    lifecyclePolicy,
+		}
+	)
+
+	require.NoError(t, provisioner.Provision(ctx, "sindri/corekeeper"))
+	require.Equal(t, "MUTABLE", standIn.repositories["sindri/corekeeper"])
+	require.Equal(t, lifecyclePolicy, standIn.lifecyclePolicies["sindri/corekeeper"])
+
+	// Provisioning a repository that already exists is not an error,
+	// nor is its lifecycle policy put again if it already has it.
+	require.NoError(t, provisioner.Provision(ctx, "sindri/corekeeper"))
+	require.Equal(t, 2, standIn.createRepositories)
+	require.Equal(t, 1, standIn.putLifecyclePolicy)
+}
+
+func TestECRProvisionerProvisionRetriesLifecyclePolicy(t *testing.T) {
+	var (
+		ctx             = t.Context()
+		standIn, client = newECRStandIn(t)
+		lifecyclePolicy = `{"rules":[{"rulePriority":1,"selection":{"tagStatus":"any","countType":"imageCountMoreThan","countNumber":10},"action":{"type":"expire"}}]}`
+		provisioner     = &registry.ECRProvisioner{
+			Client:          client,
+			LifecyclePolicy: lifecyclePolicy,
+		}
+	)
+	standIn.failPutLifecyclePolicy = 1
+
+	// The repository is created, but putting its lifecycle policy fails...
+	require.Error(t, provisioner.Provision(ctx, "sindri/palworld"))
+	require.Contains(t, standIn.repositories, "sindri/palworld")
+	require.Empty(t, standIn.lifecyclePolicies)
+
+	// ...so it is put when the repository is provisioned again.
+	require.NoError(t, provisioner.Provision(ctx, "sindri/palworld"))
+	require.Equal(t, lifecyclePolicy, standIn.lifecyclePolicies["sindri/palworld"])
+
+	// A lifecycle policy that differs is replaced.
+	standIn.lifecyclePolicies["sindri/palworld"] = `{"rules":[]}`
+	require.NoError(t, provisioner.Provision(ctx, "sindri/palworld"))
+	require.Equal(t, lifecyclePolicy, standIn.lifecyclePolicies["sindri/palworld"])
+	require.Equal(t, 3, standIn.putLifecyclePolicy)
+}
+
+func TestECRProvisionerProvisionWithoutLifecyclePolicy(t *testing.T) {
+	var (
+		ctx             = t.Context()
+		standIn, client = newECRStandIn(t)
+		provisioner     = &registry.ECRProvisioner{
+			Client:             client,
+			ImageTagMutability: types.ImageTagMutabilityImmutable,
+		}
+	)
+
+	require.NoError(t, provisioner.Provision(ctx, "sindri/valheim"))
+	require.Equal(t, "IMMUTABLE", standIn.repositories["sindri/valheim"])
+	require.Empty(t, standIn.lifecyclePolicies)
+}
+
+func TestOpenECRImageTagMutability(t *testing.T) {
+	ctx := t.Context()
+
+	b, err := backend.OpenBackend(ctx, "registry://123456789012.dkr.ecr.us-east-1.amazonaws.com?ecr_image_tag_mutability=immutable")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.Close() })
+
+	r, ok := b.(*registry.Registry)
+	require.True(t, ok)
+	provisioner, ok := r.Provisioner.(*registry.ECRProvisioner)
+	require.True(t, ok)
+	require.Equal(t, types.ImageTagMutabilityImmutable, provisioner.ImageTagMutability)
+
+	_, err = backend.OpenBackend(ctx, "registry://123456789012.dkr.ecr.us-east-1.amazonaws.com?ecr_image_tag_mutability=sometimes")
+	require.ErrorContains(t, err, "ecr_image_tag_mutability must be one of")
+}
@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"github.com/frantjc/sindri/internal/dagger"
+)
+
+// GitHubPackages configures ghcr.io container packages as Sindri publishes them,
+// since ghcr.io creates new container packages as private.
+//
+// GitHub has no API to change a package's visibility, so that cannot be automated.
+// Instead, packages can be linked to a repository, from which they inherit access.
+type GitHubPackages struct {
+	// SourceRepository, if set, is the "<owner>/<repo>" that each package is linked to
+	// by way of the "org.opencontainers.image.source" label, from which it inherits access.
+	SourceRepository string
+}
+
+const (
+	sourceLabel = "org.opencontainers.image.source"
+)
+
+// WithSource links the container to p.SourceRepository, if set.
+func (p *GitHubPackages) WithSource(container *dagger.Container) *dagger.Container {
+	if p.SourceRepository == "" {
+		return container
+	}
+
+	return container.WithLabel(sourceLabel, "https://github.com/"+p.SourceRepository)
+}
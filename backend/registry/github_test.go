@@ -0,0 +1,29 @@
+package registry_test
+
+import (
+	"testing"
+
+	"github.com/frantjc/sindri/backend"
+	"github.com/frantjc/sindri/backend/registry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenGitHubPackages(t *testing.T) {
+	ctx := t.Context()
+
+	b, err := backend.OpenBackend(ctx, "registry://ghcr.io/frantjc?ghcr_source_repository=frantjc/sindri")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.Close() })
+
+	r, ok := b.(*registry.Registry)
+	require.True(t, ok)
+	require.NotNil(t, r.GitHubPackages)
+	require.Equal(t, "frantjc/sindri", r.GitHubPackages.SourceRepository)
+
+	// GitHub has no API to change a package's visibility, so asking for one is an error rather than silently ignored.
+	_, err = backend.OpenBackend(ctx, "registry://ghcr.io/frantjc?ghcr_visibility=public")
+	require.ErrorContains(t, err, "ghcr_visibility is not supported")
+
+	_, err = backend.OpenBackend(ctx, "registry://ghcr.io/frantjc?ghcr_source_repository=sindri")
+	require.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package registry_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/Khan/genqlient/graphql"
+	"github.com/dagger/querybuilder"
+	"github.com/frantjc/sindri/backend/registry"
+	"github.com/frantjc/sindri/internal/dagger"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	fieldRegexp = regexp.MustCompile(`\{(\w+)`)
+	pathRegexp  = regexp.MustCompile(`export\(path:"([^"]+)"\)`)
+)
+
+// engineStandIn is a minimal stand-in for the Dagger engine's GraphQL API
+// that answers the queries that publishing an image makes.
+type engineStandIn struct {
+	mu sync.Mutex
+	// image is what the engine publishes or exports.
+	image v1.Image
+	// queries are the queries that the engine was asked.
+	queries []string
+}
+
+func (e *engineStandIn) MakeRequest(_ context.Context, req *graphql.Request, res *graphql.Response) error {
+	e.mu.Lock()
+	e.queries = append(e.queries, req.Query)
+	e.mu.Unlock()
+
+	var (
+		fields = fieldRegexp.FindAllStringSubmatch(req.Query, -1)
+		data   any
+	)
+	switch field := fields[len(fields)-1][1]; field {
+	case "id":
+		data = "secret"
+	case "publish":
+		hash, err := e.image.Digest()
+		if err != nil {
+			return err
+		}
+
+		data = "published@" + hash.String()
+	case "export":
+		path := pathRegexp.FindStringSubmatch(req.Query)
+		if path == nil {
+			return fmt.Errorf("export without path")
+		}
+
+		tag, err := gcrname.NewTag("sindri:latest")
+		if err != nil {
+			return err
+		}
+
+		if err := tarball.WriteToFile(path[1], tag, e.image); err != nil {
+			return err
+		}
+
+		data = path[1]
+	default:
+		return fmt.Errorf("unexpected field %s", field)
+	}
+
+	for i := len(fields) - 1; i >= 0; i-- {
+		data = map[string]any{fields[i][1]: data}
+	}
+	*res.Data.(*any) = data
+
+	return nil
+}
+
+func (e *engineStandIn) client() *dagger.Client {
+	return &dagger.Client{Query: new(dagger.Query).WithGraphQLQuery(querybuilder.Query().Client(e))}
+}
+
+func TestRegistryStore(t *testing.T) {
+	srv := httptest.NewTLSServer(ggcrregistry.New())
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	image, err := random.Image(64, 1)
+	require.NoError(t, err)
+
+	hash, err := image.Digest()
+	require.NoError(t, err)
+
+	t.Run("publish", func(t *testing.T) {
+		var (
+			engine = &engineStandIn{image: image}
+			dag    = engine.client()
+			r      = &registry.Registry{
+				Scheme:     "https",
+				Host:       u.Host,
+				Username:   upstreamUsername,
+				Password:   upstreamPassword,
+				Repository: "sindri",
+			}
+		)
+
+		// Without a Transport of its own, the Dagger engine publishes to the registry.
+		d, err := r.Store(t.Context(), dag.Container(), dag, "steamapps/valheim", "latest")
+		require.NoError(t, err)
+		require.Equal(t, hash.String(), d.String())
+
+		require.Len(t, engine.queries, 2)
+		require.Contains(t, engine.queries[0], "setSecret")
+		require.Contains(t, engine.queries[1], fmt.Sprintf(`publish(address:"%s/sindri/steamapps/valheim:latest")`, u.Host))
+		require.Contains(t, engine.queries[1], fmt.Sprintf(`username:"%s"`, upstreamUsername))
+		require.NotContains(t, engine.queries[1], "export")
+
+		// So nothing was pushed to the registry by Sindri.
+		_, err = remote.Head(mustTag(t, u.Host+"/sindri/steamapps/valheim:latest"), remote.WithTransport(srv.Client().Transport))
+		require.Error(t, err)
+	})
+
+	t.Run("push", func(t *testing.T) {
+		var (
+			engine = &engineStandIn{image: image}
+			dag    = engine.client()
+			r      = &registry.Registry{
+				Scheme:     "https",
+				Host:       u.Host,
+				Repository: "sindri",
+				Transport:  srv.Client().Transport,
+				WorkDir:    t.TempDir(),
+			}
+		)
+
+		// With a Transport of its own, e.g. one that trusts a private CA, Sindri
+		// exports the image from the Dagger engine and pushes it through Transport.
+		d, err := r.Store(t.Context(), dag.Container(), dag, "steamapps/corekeeper", "latest")
+		require.NoError(t, err)
+		require.Equal(t, hash.String(), d.String())
+
+		require.Len(t, engine.queries, 1)
+		require.Contains(t, engine.queries[0], "asTarball")
+		require.NotContains(t, engine.queries[0], "publish")
+
+		desc, err := remote.Head(mustTag(t, u.Host+"/sindri/steamapps/corekeeper:latest"), remote.WithTransport(srv.Client().Transport))
+		require.NoError(t, err)
+		require.Equal(t, hash, desc.Digest)
+	})
+}
+
+func mustTag(t *testing.T, ref string) gcrname.Tag {
+	t.Helper()
+
+	tag, err := gcrname.NewTag(ref)
+	require.NoError(t, err)
+
+	return tag
+}
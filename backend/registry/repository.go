@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// RepositoryMapping maps a <name> to the repository in the upstream registry that
+// it is stored in. Each of its fields is applied to <name> in order, if set.
+type RepositoryMapping struct {
+	// Regexp is matched against <name>, which is then replaced by Replacement.
+	Regexp      *regexp.Regexp
+	Replacement string
+	// Separator replaces each "/" in <name> to flatten multi-segment names
+	// such as "github.com/owner/repo/path" into a single path segment for
+	// registries that do not support nested repositories.
+	Separator string
+	// Template is executed with a RepositoryTemplateData to get the repository.
+	// Defaults to the equivalent of "{{ .Repository }}/{{ .Name }}".
+	Template *template.Template
+}
+
+// RepositoryTemplateData is the data that RepositoryMapping.Template is executed with.
+type RepositoryTemplateData struct {
+	// Repository is the repository from the backend URL, e.g. "<user>" from "registry://ghcr.io/<user>".
+	Repository string
+	// Name is the <name> after RepositoryMapping.Regexp and RepositoryMapping.Separator are applied to it.
+	Name string
+}
+
+// RepositoryTemplateFuncs are the functions available to RepositoryMapping.Template.
+var RepositoryTemplateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"replace": strings.ReplaceAll,
+	"base":    path.Base,
+	"dir":     path.Dir,
+}
+
+// NewRepositoryTemplate parses text into a template for RepositoryMapping.Template.
+func NewRepositoryTemplate(text string) (*template.Template, error) {
+	return template.New("repository").Funcs(RepositoryTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// Map returns the repository that name is stored in given the base repository.
+func (m *RepositoryMapping) Map(repository, name string) (string, error) {
+	if m != nil {
+		if m.Regexp != nil {
+			name = m.Regexp.ReplaceAllString(name, m.Replacement)
+		}
+
+		if m.Separator != "" {
+			name = strings.ReplaceAll(name, "/", m.Separator)
+		}
+
+		if m.Template != nil {
+			buf := new(bytes.Buffer)
+			if err := m.Template.Execute(buf, &RepositoryTemplateData{Repository: repository, Name: name}); err != nil {
+				return "", err
+			}
+
+			return strings.Trim(path.Clean(buf.String()), "/"), nil
+		}
+	}
+
+	return path.Join(repository, name), nil
+}
+
+// RepositoryProvisioner creates repositories in the upstream registry
+// for registries that do not create them on push.
+type RepositoryProvisioner interface {
+	// Provision creates repository in the upstream registry if it does not already exist.
+	Provision(ctx context.Context, repository string) error
+}
+
+// RepositoryProvisionerFunc implements RepositoryProvisioner.
+type RepositoryProvisionerFunc func(context.Context, string) error
+
+// Provision implements RepositoryProvisioner.
+func (f RepositoryProvisionerFunc) Provision(ctx context.Context, repository string) error {
+	return f(ctx, repository)
+}
+
+// repository returns the repository, relative to b.Host, that name is stored in.
+func (b *Registry) repository(name string) (string, error) {
+	repository, err := b.Mapping.Map(b.Repository, name)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := gcrname.NewRepository(path.Join(b.Host, repository)); err != nil {
+		return "", fmt.Errorf("%s maps to invalid repository %s: %w", name, repository, err)
+	}
+
+	return repository, nil
+}
+
+// provision calls b.Provisioner for repository once.
+func (b *Registry) provision(ctx context.Context, repository string) error {
+	if b.Provisioner == nil {
+		return nil
+	}
+
+	if _, ok := b.provisioned.Load(repository); ok {
+		return nil
+	}
+
+	if err := b.Provisioner.Provision(ctx, repository); err != nil {
+		return err
+	}
+
+	b.provisioned.Store(repository, struct{}{})
+
+	return nil
+}
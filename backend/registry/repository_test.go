@@ -0,0 +1,66 @@
+package registry_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/frantjc/sindri/backend/registry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryMappingMap(t *testing.T) {
+	tmpl, err := registry.NewRepositoryTemplate("{{ .Repository }}/mirror/{{ .Name | lower }}")
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name       string
+		mapping    *registry.RepositoryMapping
+		repository string
+		in         string
+		out        string
+	}{
+		{
+			name:       "nil",
+			repository: "frantjc/sindri",
+			in:         "corekeeper",
+			out:        "frantjc/sindri/corekeeper",
+		},
+		{
+			name:       "empty repository",
+			mapping:    &registry.RepositoryMapping{},
+			repository: "",
+			in:         "corekeeper",
+			out:        "corekeeper",
+		},
+		{
+			name:       "flatten",
+			mapping:    &registry.RepositoryMapping{Separator: "-"},
+			repository: "frantjc",
+			in:         "github.com/frantjc/sindri/testdata/git/std",
+			out:        "frantjc/github.com-frantjc-sindri-testdata-git-std",
+		},
+		{
+			name: "regexp",
+			mapping: &registry.RepositoryMapping{
+				Regexp:      regexp.MustCompile(`^github\.com/([^/]+)/([^/]+)(/.*)?$`),
+				Replacement: "gh/$1/$2",
+			},
+			repository: "sindri",
+			in:         "github.com/frantjc/sindri/testdata/git/std",
+			out:        "sindri/gh/frantjc/sindri",
+		},
+		{
+			name:       "template",
+			mapping:    &registry.RepositoryMapping{Template: tmpl, Separator: "_"},
+			repository: "frantjc",
+			in:         "Go/1.25",
+			out:        "frantjc/mirror/go_1.25",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := c.mapping.Map(c.repository, c.in)
+			require.NoError(t, err)
+			require.Equal(t, c.out, out)
+		})
+	}
+}
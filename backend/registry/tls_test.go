@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsFiles are PEM files for a CA that signed a client certificate
+// and for the CA of an httptest.Server.
+type tlsFiles struct {
+	serverCA   string
+	clientCA   *x509.CertPool
+	clientCert string
+	clientKey  string
+	garbage    string
+}
+
+func writePEM(t *testing.T, name, typ string, b []byte) string {
+	t.Helper()
+
+	name = filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600))
+
+	return name
+}
+
+func newTLSFiles(t *testing.T, srv *httptest.Server) *tlsFiles {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sindri test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "sindri"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	clientCA := x509.NewCertPool()
+	clientCA.AddCert(ca)
+
+	garbage := filepath.Join(t.TempDir(), "garbage.crt")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a certificate"), 0600))
+
+	return &tlsFiles{
+		serverCA:   writePEM(t, "ca.crt", "CERTIFICATE", srv.Certificate().Raw),
+		clientCA:   clientCA,
+		clientCert: writePEM(t, "tls.crt", "CERTIFICATE", certDER),
+		clientKey:  writePEM(t, "tls.key", "EC PRIVATE KEY", keyDER),
+		garbage:    garbage,
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	var (
+		srv   = httptest.NewTLSServer(http.NotFoundHandler())
+		files = newTLSFiles(t, srv)
+	)
+	t.Cleanup(srv.Close)
+
+	for _, c := range []struct {
+		name               string
+		caFile             string
+		certFile           string
+		keyFile            string
+		insecureSkipVerify bool
+		err                bool
+		rootCAs            bool
+		certificates       int
+	}{
+		{name: "ca", caFile: files.serverCA, rootCAs: true},
+		{name: "client cert", certFile: files.clientCert, keyFile: files.clientKey, certificates: 1},
+		{name: "ca and client cert", caFile: files.serverCA, certFile: files.clientCert, keyFile: files.clientKey, rootCAs: true, certificates: 1},
+		{name: "insecure", insecureSkipVerify: true},
+		{name: "insecure and client cert", certFile: files.clientCert, keyFile: files.clientKey, insecureSkipVerify: true, certificates: 1},
+		{name: "ca without certificates", caFile: files.garbage, err: true},
+		{name: "missing ca", caFile: filepath.Join(t.TempDir(), "missing.crt"), err: true},
+		{name: "cert without key", certFile: files.clientCert, err: true},
+		{name: "key without cert", keyFile: files.clientKey, err: true},
+		{name: "mismatched cert and key", certFile: files.serverCA, keyFile: files.clientKey, err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(c.caFile, c.certFile, c.keyFile, c.insecureSkipVerify)
+			if c.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, c.insecureSkipVerify, tlsConfig.InsecureSkipVerify)
+			require.Equal(t, c.rootCAs, tlsConfig.RootCAs != nil)
+			require.Len(t, tlsConfig.Certificates, c.certificates)
+			require.GreaterOrEqual(t, tlsConfig.MinVersion, uint16(tls.VersionTLS12))
+		})
+	}
+}
+
+func TestRegistryWrite(t *testing.T) {
+	var (
+		mtlsSrv = httptest.NewUnstartedServer(ggcrregistry.New())
+		srv     = httptest.NewTLSServer(ggcrregistry.New())
+	)
+	mtlsSrv.StartTLS()
+	t.Cleanup(mtlsSrv.Close)
+	t.Cleanup(srv.Close)
+
+	files := newTLSFiles(t, mtlsSrv)
+	mtlsSrv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	mtlsSrv.TLS.ClientCAs = files.clientCA
+
+	srvCA := writePEM(t, "srv-ca.crt", "CERTIFICATE", srv.Certificate().Raw)
+
+	image, err := random.Image(64, 1)
+	require.NoError(t, err)
+
+	hash, err := image.Digest()
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name               string
+		srv                *httptest.Server
+		caFile             string
+		certFile           string
+		keyFile            string
+		insecureSkipVerify bool
+		err                bool
+	}{
+		{name: "ca", srv: srv, caFile: srvCA},
+		{name: "insecure", srv: srv, insecureSkipVerify: true},
+		{name: "unknown ca", srv: srv, err: true},
+		{name: "ca and client cert", srv: mtlsSrv, caFile: files.serverCA, certFile: files.clientCert, keyFile: files.clientKey},
+		{name: "insecure and client cert", srv: mtlsSrv, certFile: files.clientCert, keyFile: files.clientKey, insecureSkipVerify: true},
+		{name: "ca without client cert", srv: mtlsSrv, caFile: files.serverCA, err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(c.caFile, c.certFile, c.keyFile, c.insecureSkipVerify)
+			require.NoError(t, err)
+
+			u, err := url.Parse(c.srv.URL)
+			require.NoError(t, err)
+
+			rt := http.DefaultTransport.(*http.Transport).Clone()
+			rt.TLSClientConfig = tlsConfig
+
+			r := &Registry{
+				Scheme:     "https",
+				Host:       u.Host,
+				Repository: "sindri",
+				Transport:  rt,
+			}
+
+			d, err := r.write(t.Context(), image, u.Host+"/sindri/steamapps/valheim:latest")
+			if c.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, hash.String(), d.String())
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package sindri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/frantjc/sindri/backend"
+	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/engine"
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Builder builds images with the module and stores them in a backend
+// the same way that pulls of tags that need building do.
+type Builder struct {
+	dag Dagger
+	o   *HandlerOpts
+
+	mu sync.Mutex
+	b  *builderBackend
+}
+
+// builderBackend is a backend that builds store in, counting the builds
+// that are using it so that it is known when it is no longer in use.
+type builderBackend struct {
+	backend.Backend
+	name     string
+	builds   int
+	replaced bool
+	drained  chan struct{}
+}
+
+func newBuilderBackend(b backend.Backend) *builderBackend {
+	return &builderBackend{
+		Backend: b,
+		name:    backendName(b),
+		drained: make(chan struct{}),
+	}
+}
+
+// NewBuilder returns a Builder that builds with dag and stores in b. Of opts, only
+// BuildTimeout, Scheduler, Failures, Metrics and NoBuild apply.
+func NewBuilder(dag Dagger, b backend.Backend, opts ...HandlerOpt) *Builder {
+	o := &HandlerOpts{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return newBuilder(dag, b, o)
+}
+
+func newBuilder(dag Dagger, b backend.Backend, o *HandlerOpts) *Builder {
+	return &Builder{
+		dag: dag,
+		o:   o,
+		b:   newBuilderBackend(b),
+	}
+}
+
+// SetBackend makes builds that start from now on store in b, e.g. when configuration
+// is reloaded. Builds that are already running keep storing in the previous backend,
+// so it must not be closed until the returned channel is closed once they have
+// finished. A nil *Builder has no builds, so the returned channel is already closed.
+func (bu *Builder) SetBackend(b backend.Backend) <-chan struct{} {
+	if bu == nil {
+		drained := make(chan struct{})
+		close(drained)
+		return drained
+	}
+
+	bu.mu.Lock()
+	defer bu.mu.Unlock()
+
+	prev := bu.b
+	bu.b = newBuilderBackend(b)
+
+	prev.replaced = true
+	if prev.builds == 0 {
+		close(prev.drained)
+	}
+
+	return prev.drained
+}
+
+// acquire returns the backend that a build that is starting should store in.
+func (bu *Builder) acquire() *builderBackend {
+	bu.mu.Lock()
+	defer bu.mu.Unlock()
+
+	bu.b.builds++
+	return bu.b
+}
+
+// release records that a build that stored in b has finished.
+func (bu *Builder) release(b *builderBackend) {
+	bu.mu.Lock()
+	defer bu.mu.Unlock()
+
+	b.builds--
+	if b.replaced && b.builds == 0 {
+		close(b.drained)
+	}
+}
+
+// Build builds name and reference at priority through the Scheduler, sharing
+// the build with any other of the same name and reference that is queued or
+// running, and stores it in the backend that is set when it starts running,
+// returning its digest. Builds that failed recently fail fast with the same
+// error instead.
+func (bu *Builder) Build(ctx context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error) {
+	var (
+		log = logutil.SloggerFrom(ctx)
+		o   = bu.o
+	)
+
+	if o.NoBuild {
+		return "", fmt.Errorf("%w: %s:%s: builds are disabled", errNotBuilt, name, reference)
+	}
+
+	if err := o.Failures.Get(name, reference); err != nil {
+		return "", err
+	}
+
+	return o.Scheduler.Do(ctx, name, reference, priority, limit.ClientFrom(ctx), func(ctx context.Context) (digest.Digest, error) {
+		if o.BuildTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, o.BuildTimeout)
+			defer cancel()
+		}
+
+		b := bu.acquire()
+		defer bu.release(b)
+
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "Store", trace.WithAttributes(
+			attribute.String("sindri.backend", b.name),
+			attribute.String("sindri.name", name),
+			attribute.String("sindri.reference", reference),
+		))
+		defer span.End()
+
+		lease, err := bu.dag.Acquire(ctx, name)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return "", err
+		}
+
+		client := lease.Client
+		if lease.Engine != "" {
+			span.SetAttributes(attribute.String("sindri.engine", lease.Engine))
+			log.Debug("building", "engine", lease.Engine)
+		}
+
+		d, err := b.Store(
+			ctx,
+			// FIXME(frantjc): Hopefuly a temporary workaround for dag.Sindri() not being generated.
+			new(dagger.Sindri{}).WithGraphQLQuery(client.QueryBuilder().Select("sindri")).Image(name, reference),
+			client,
+			name,
+			reference,
+		)
+		err = lease.Release(ctx, err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.String("sindri.digest", d.String()))
+		}
+		o.Metrics.backendError(b.name, "store", err)
+		// Builds that were canceled or interrupted by the Dagger session dying did not fail.
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, engine.ErrUnavailable) {
+			o.Failures.Put(name, reference, err)
+		}
+
+		return d, err
+	})
+}
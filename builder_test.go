@@ -0,0 +1,86 @@
+package sindri_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri"
+	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingBackend is a tagBackend whose stores signal storing and then block until unblock is closed.
+type blockingBackend struct {
+	*tagBackend
+	storing chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingBackend) Store(ctx context.Context, container *dagger.Container, client *dagger.Client, name, reference string) (digest.Digest, error) {
+	b.storing <- struct{}{}
+	<-b.unblock
+	return b.tagBackend.Store(ctx, container, client, name, reference)
+}
+
+func TestBuilderSetBackend(t *testing.T) {
+	var (
+		prev = &blockingBackend{
+			tagBackend: &tagBackend{
+				tags:      map[string]digest.Digest{},
+				manifests: map[digest.Digest]string{},
+				built:     make(chan string, 1),
+			},
+			storing: make(chan struct{}),
+			unblock: make(chan struct{}),
+		}
+		next = &tagBackend{
+			tags:      map[string]digest.Digest{},
+			manifests: map[digest.Digest]string{},
+			built:     make(chan string, 1),
+		}
+		builder = sindri.NewBuilder(fakeDagger{}, prev)
+		errs    = make(chan error, 1)
+	)
+
+	go func() {
+		_, err := builder.Build(t.Context(), "test", "prev", scheduler.PriorityAnonymous)
+		errs <- err
+	}()
+	<-prev.storing
+
+	// Reload in the middle of the build.
+	built := builder.SetBackend(next)
+
+	select {
+	case <-built:
+		t.Fatal("previous backend released while a build is storing in it")
+	default:
+	}
+
+	// Builds that start after the reload store in the next backend.
+	_, err := builder.Build(t.Context(), "test", "next", scheduler.PriorityAnonymous)
+	require.NoError(t, err)
+	require.Equal(t, "next", <-next.built)
+
+	close(prev.unblock)
+	require.NoError(t, <-errs)
+	require.Equal(t, "prev", <-prev.built)
+	require.Contains(t, prev.tags, "prev")
+	require.NotContains(t, prev.tags, "next")
+
+	select {
+	case <-built:
+	case <-time.After(time.Second * 5):
+		t.Fatal("previous backend not released after the build finished")
+	}
+
+	// Replacing a backend that no builds are using releases it immediately.
+	select {
+	case <-builder.SetBackend(prev):
+	default:
+		t.Fatal("unused backend not released")
+	}
+}
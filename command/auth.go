@@ -0,0 +1,87 @@
+package command
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/config"
+)
+
+// newAuthService returns the *auth.Service that cfg describes, or nil if it is not enabled.
+// Tokens are signed with key if cfg does not set a signing key file.
+func newAuthService(cfg *config.Auth, key crypto.Signer) (*auth.Service, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	s := &auth.Service{
+		Service: cfg.Service,
+		Realm:   cfg.Realm,
+		TTL:     cfg.TokenTTL.Duration(),
+		Tokens:  map[string]auth.StaticToken{},
+		Key:     key,
+	}
+
+	var err error
+	if cfg.SigningKeyFile != "" {
+		if s.Key, err = auth.ReadSigningKey(cfg.SigningKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.HtpasswdFile != "" {
+		if s.Htpasswd, err = auth.ReadHtpasswd(cfg.HtpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, token := range cfg.Tokens {
+		b, err := os.ReadFile(token.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		t := strings.TrimSpace(string(b))
+		if t == "" {
+			return nil, fmt.Errorf("token file %s is empty", token.TokenFile)
+		}
+
+		username := token.Username
+		if username == "" {
+			username = token.Subject
+		}
+
+		s.Tokens[t] = auth.StaticToken{Username: username, Subject: token.Subject}
+	}
+
+	for _, oidc := range cfg.OIDC {
+		s.OIDC = append(s.OIDC, &auth.OIDCProvider{
+			Issuer:       oidc.Issuer,
+			Audience:     oidc.Audience,
+			SubjectClaim: oidc.SubjectClaim,
+		})
+	}
+
+	for _, rule := range cfg.Access {
+		subjects, err := auth.CompileGlobs(rule.Subjects)
+		if err != nil {
+			return nil, err
+		}
+
+		repositories, err := auth.CompileGlobs(rule.Repositories)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Rules = append(s.Rules, auth.Rule{
+			Anonymous:    rule.Anonymous,
+			Subjects:     subjects,
+			Repositories: repositories,
+		})
+	}
+
+	return s, nil
+}
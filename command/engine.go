@@ -0,0 +1,45 @@
+package command
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/frantjc/sindri/internal/config"
+	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/engine"
+)
+
+// newEnginePool returns the *engine.Pool that cfg describes, connecting to each of
+// its engines with opts. Without a configured pool, it has a single engine: the one
+// that the Dagger CLI would use.
+func newEnginePool(cfg *config.Engine, probeTimeout time.Duration, opts ...dagger.ClientOpt) *engine.Pool {
+	members := cfg.Pool
+	if len(members) == 0 {
+		members = []config.EngineMember{{Name: "default"}}
+	}
+
+	pool := &engine.Pool{Strategy: engine.Strategy(cfg.Strategy)}
+	for _, member := range members {
+		memberOpts := opts
+		if member.RunnerHost != "" {
+			memberOpts = append(slices.Clone(opts), dagger.WithRunnerHost(member.RunnerHost))
+		}
+
+		pool.Members = append(pool.Members, &engine.Member{
+			Name: member.Name,
+			Conn: &engine.Conn{
+				Connect: func(ctx context.Context) (*dagger.Client, error) {
+					return dagger.Connect(ctx, memberOpts...)
+				},
+				ProbeInterval: cfg.ProbeInterval.Duration(),
+				ProbeTimeout:  probeTimeout,
+				Backoff:       cfg.Backoff.Duration(),
+				MaxBackoff:    cfg.MaxBackoff.Duration(),
+			},
+			MaxConcurrent: member.MaxConcurrent,
+		})
+	}
+
+	return pool
+}
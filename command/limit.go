@@ -0,0 +1,53 @@
+package command
+
+import (
+	"regexp"
+
+	"github.com/frantjc/sindri/internal/config"
+	"github.com/frantjc/sindri/internal/failure"
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"golang.org/x/time/rate"
+)
+
+// newScheduler returns the *scheduler.Scheduler that cfg describes.
+func newScheduler(cfg *config.BuildLimits) *scheduler.Scheduler {
+	return &scheduler.Scheduler{
+		MaxConcurrent:          cfg.MaxConcurrent,
+		MaxConcurrentPerClient: cfg.MaxConcurrentPerClient,
+		MaxQueued:              cfg.MaxQueued,
+		RetryAfter:             cfg.RetryAfter.Duration(),
+	}
+}
+
+// newRateLimit returns the *limit.Rate that cfg describes, or nil if it does not limit requests.
+func newRateLimit(cfg *config.RateLimit) *limit.Rate {
+	if cfg.RequestsPerSecond <= 0 {
+		return nil
+	}
+
+	return &limit.Rate{
+		Limit: rate.Limit(cfg.RequestsPerSecond),
+		Burst: cfg.Burst,
+	}
+}
+
+// newFailureCache returns the *failure.Cache that cfg describes.
+func newFailureCache(cfg *config.Failures) (*failure.Cache, error) {
+	c := &failure.Cache{
+		Backoff:              cfg.Backoff.Duration(),
+		MaxBackoff:           cfg.MaxBackoff.Duration(),
+		PermanentStatusCodes: cfg.PermanentStatusCodes,
+	}
+
+	for _, expr := range cfg.PermanentErrors {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		c.PermanentErrors = append(c.PermanentErrors, re)
+	}
+
+	return c, nil
+}
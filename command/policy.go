@@ -0,0 +1,70 @@
+package command
+
+import (
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/config"
+	"github.com/frantjc/sindri/internal/policy"
+)
+
+// newPolicy returns the *policy.Policy that cfg describes, or nil if it has no rules.
+func newPolicy(cfg *config.Policy) (*policy.Policy, error) {
+	if len(cfg.Rules) == 0 && cfg.Default != config.PolicyEffectDeny {
+		return nil, nil
+	}
+
+	p := &policy.Policy{
+		Default: policy.Effect(cfg.Default),
+	}
+
+	for _, rule := range cfg.Rules {
+		subjects, err := compileMatchers(rule.Subjects, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		names, err := compileMatchers(rule.Names, rule.NameRegexps)
+		if err != nil {
+			return nil, err
+		}
+
+		references, err := compileMatchers(rule.References, rule.ReferenceRegexps)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Rules = append(p.Rules, policy.Rule{
+			Effect:     policy.Effect(rule.Effect),
+			Actions:    rule.Actions,
+			Anonymous:  rule.Anonymous,
+			Subjects:   subjects,
+			Names:      names,
+			References: references,
+		})
+	}
+
+	return p, nil
+}
+
+func compileMatchers(globs, regexps []string) ([]policy.Matcher, error) {
+	matchers := []policy.Matcher{}
+
+	for _, pattern := range globs {
+		g, err := auth.CompileGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		matchers = append(matchers, g)
+	}
+
+	for _, expr := range regexps {
+		re, err := policy.CompileRegexp(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		matchers = append(matchers, re)
+	}
+
+	return matchers, nil
+}
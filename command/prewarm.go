@@ -0,0 +1,157 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/frantjc/sindri/internal/admin"
+	"github.com/frantjc/sindri/internal/config"
+	"github.com/spf13/cobra"
+)
+
+// newPrewarm returns the command that builds images ahead of pulls through the
+// admin API of the sindri that the configuration returned by cfg describes.
+func newPrewarm(cfg func() *config.Config) *cobra.Command {
+	var (
+		adminURL string
+		username string
+		password string
+		cmd      = &cobra.Command{
+			Use:   "prewarm [file]",
+			Short: "Build images ahead of pulls",
+			Long: "Build each <name>:<reference> listed in file, or stdin, one per line, through the admin API of a running sindri, " +
+				"the same way that pulls do. Blank lines and lines starting with # are ignored.",
+			Args: cobra.MaximumNArgs(1),
+		}
+	)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		in := cmd.InOrStdin()
+		if len(args) > 0 && args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			in = f
+		}
+
+		images, err := readImages(in)
+		if err != nil {
+			return err
+		}
+
+		if adminURL == "" {
+			adminURL = defaultAdminURL(cfg())
+		}
+
+		body, err := json.Marshal(&admin.BuildRequest{Images: images})
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(cmd.Context(), http.MethodPost, strings.TrimSuffix(adminURL, "/")+"/admin/builds", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		if username != "" || password != "" {
+			req.SetBasicAuth(username, password)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(res.Body)
+			return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+		}
+
+		var (
+			dec    = json.NewDecoder(res.Body)
+			failed = 0
+		)
+		for {
+			status := &admin.BuildStatus{}
+			if err := dec.Decode(status); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if status.Error != "" {
+				failed++
+				fmt.Fprintf(cmd.ErrOrStderr(), "%s: %s\n", status.Image, status.Error)
+				continue
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", status.Image, status.Digest)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d images failed to build", failed, len(images))
+		}
+
+		return nil
+	}
+
+	cmd.Flags().StringVar(&adminURL, "url", "", "URL of sindri's admin API (default from the configuration's listeners)")
+	cmd.Flags().StringVarP(&username, "username", "u", "", "Username to authenticate to the admin API with")
+	cmd.Flags().StringVarP(&password, "password", "p", "", "Password or token to authenticate to the admin API with")
+
+	return cmd
+}
+
+// readImages reads the <name>:<reference>s listed in r, one per line.
+func readImages(r io.Reader) ([]string, error) {
+	var (
+		images  = []string{}
+		scanner = bufio.NewScanner(r)
+	)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, _, err := admin.ParseImage(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i, err)
+		}
+
+		images = append(images, line)
+	}
+
+	return images, scanner.Err()
+}
+
+// defaultAdminURL returns the URL of the admin API that cfg describes on this host.
+func defaultAdminURL(cfg *config.Config) string {
+	lis := &cfg.Listeners.Registry
+	if cfg.Listeners.Admin.Addr != "" {
+		lis = &cfg.Listeners.Admin
+	}
+
+	scheme := "http"
+	if lis.TLS.Enabled() {
+		scheme = "https"
+	}
+
+	host := lis.Addr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+
+	return scheme + "://" + host
+}
@@ -2,6 +2,8 @@ package command
 
 import (
 	"context"
+	"crypto"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -9,115 +11,515 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/frantjc/sindri"
 	"github.com/frantjc/sindri/backend"
+	"github.com/frantjc/sindri/internal/admin"
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/config"
 	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/engine"
+	"github.com/frantjc/sindri/internal/failure"
+	"github.com/frantjc/sindri/internal/health"
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/frantjc/sindri/internal/limit"
 	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/frantjc/sindri/internal/rebuild"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/frantjc/sindri/internal/tlsutil"
+	"github.com/frantjc/sindri/internal/webhook"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
 
-var (
-	cache = path.Join(xdg.CacheHome, "sindri")
+const (
+	configWatchInterval = time.Second * 10
 )
 
 func NewSindri(version string) *cobra.Command {
 	var (
-		address    string
-		storage    string
-		certFile   string
-		keyFile    string
-		slogConfig = new(logutil.SlogConfig)
-		cmd        = &cobra.Command{
+		configFile  string
+		printConfig bool
+		cfg         *config.Config
+		level       = new(slog.LevelVar)
+		slogConfig  = new(logutil.SlogConfig)
+		cmd         = &cobra.Command{
 			Use:           "sindri",
 			Version:       version,
 			SilenceErrors: true,
 			SilenceUsage:  true,
-			PersistentPreRun: func(cmd *cobra.Command, _ []string) {
-				handler := slog.NewTextHandler(cmd.OutOrStdout(), &slog.HandlerOptions{
-					Level: slogConfig,
-				})
-				cmd.SetContext(logutil.SloggerInto(cmd.Context(), slog.New(handler)))
-			},
-			RunE: func(cmd *cobra.Command, _ []string) error {
-				var (
-					eg, ctx = errgroup.WithContext(cmd.Context())
-					srv     = &http.Server{
-						ReadHeaderTimeout: time.Second * 5,
-						BaseContext: func(_ net.Listener) context.Context {
-							return cmd.Context()
-						},
-						ErrorLog: log.New(io.Discard, "", 0),
-					}
-					log = logutil.SloggerFrom(ctx)
-				)
+		}
+	)
 
-				lis, err := net.Listen("tcp", address)
-				if err != nil {
-					return err
-				}
-				defer lis.Close()
+	// loadConfig loads the configuration file, environment and flags, in order of increasing precedence.
+	loadConfig := func() (*config.Config, error) {
+		cfg, err := config.Load(configFile)
+		if err != nil {
+			return nil, err
+		}
 
-				if os.MkdirAll(filepath.Join(xdg.StateHome, "sindri"), 0755); err != nil {
-					return err
-				}
+		if cmd.Flag("addr").Changed {
+			cfg.Listeners.Registry.Addr = cmd.Flag("addr").Value.String()
+		}
 
-				daggerLog, err := os.Create(filepath.Join(xdg.StateHome, "sindri/dagger.log"))
-				if err != nil {
-					return err
+		if cmd.Flag("backend").Changed {
+			cfg.Backend.URL = cmd.Flag("backend").Value.String()
+		}
+
+		if cmd.Flag("tls-crt").Changed {
+			cfg.Listeners.Registry.TLS.CertFile = cmd.Flag("tls-crt").Value.String()
+		}
+
+		if cmd.Flag("tls-key").Changed {
+			cfg.Listeners.Registry.TLS.KeyFile = cmd.Flag("tls-key").Value.String()
+		}
+
+		if cmd.Flag("tls-client-ca").Changed {
+			cfg.Listeners.Registry.TLS.ClientCAFile = cmd.Flag("tls-client-ca").Value.String()
+		}
+
+		if cmd.Flag("tls-client-auth").Changed {
+			cfg.Listeners.Registry.TLS.ClientAuth = cmd.Flag("tls-client-auth").Value.String()
+		}
+
+		if cmd.Flag("no-build").Changed {
+			cfg.Engine.Disabled = true
+		}
+
+		if cmd.Flag("debug").Changed || cmd.Flag("quiet").Changed || cmd.Flag("verbose").Changed || os.Getenv("DEBUG") != "" {
+			cfg.Logging.Level = strings.ToLower(slogConfig.Level().String())
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration:\n%w", err)
+		}
+
+		return cfg, nil
+	}
+
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, _ []string) error {
+		var err error
+		if cfg, err = loadConfig(); err != nil {
+			return err
+		}
+
+		l, err := cfg.Logging.SlogLevel()
+		if err != nil {
+			return err
+		}
+		level.Set(l)
+
+		var (
+			handlerOpts = &slog.HandlerOptions{Level: level}
+			handler     slog.Handler
+		)
+		switch cfg.Logging.Format {
+		case "json":
+			handler = slog.NewJSONHandler(cmd.OutOrStdout(), handlerOpts)
+		default:
+			handler = slog.NewTextHandler(cmd.OutOrStdout(), handlerOpts)
+		}
+
+		cmd.SetContext(logutil.SloggerInto(cmd.Context(), slog.New(handler)))
+
+		return nil
+	}
+
+	cmd.RunE = func(cmd *cobra.Command, _ []string) error {
+		if printConfig {
+			b, err := cfg.Marshal()
+			if err != nil {
+				return err
+			}
+
+			_, err = cmd.OutOrStdout().Write(b)
+			return err
+		}
+
+		var (
+			eg, ctx = errgroup.WithContext(cmd.Context())
+			srv     = &http.Server{
+				ReadHeaderTimeout: cfg.Limits.ReadHeaderTimeout.Duration(),
+				MaxHeaderBytes:    cfg.Limits.MaxHeaderBytes,
+				BaseContext: func(_ net.Listener) context.Context {
+					return cmd.Context()
+				},
+				ErrorLog: log.New(io.Discard, "", 0),
+			}
+			log = logutil.SloggerFrom(ctx)
+		)
+
+		lis, err := net.Listen("tcp", cfg.Listeners.Registry.Addr)
+		if err != nil {
+			return err
+		}
+		defer lis.Close()
+
+		var certificateReloader *tlsutil.CertificateReloader
+		if srv.TLSConfig, certificateReloader, err = newTLSConfig(&cfg.Listeners.Registry.TLS); err != nil {
+			return err
+		}
+
+		var (
+			adminSrv                 *http.Server
+			adminLis                 net.Listener
+			adminCertificateReloader *tlsutil.CertificateReloader
+		)
+		if cfg.Listeners.Admin.Addr != "" {
+			adminSrv = &http.Server{
+				ReadHeaderTimeout: srv.ReadHeaderTimeout,
+				MaxHeaderBytes:    srv.MaxHeaderBytes,
+				BaseContext:       srv.BaseContext,
+				ErrorLog:          srv.ErrorLog,
+			}
+
+			if adminLis, err = net.Listen("tcp", cfg.Listeners.Admin.Addr); err != nil {
+				return err
+			}
+			defer adminLis.Close()
+
+			if adminSrv.TLSConfig, adminCertificateReloader, err = newTLSConfig(&cfg.Listeners.Admin.TLS); err != nil {
+				return err
+			}
+		}
+
+		shutdownTracing, err := setupTracing(ctx, &cfg.Tracing, version)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := shutdownTracing(context.WithoutCancel(ctx)); err != nil {
+				log.Error(err.Error())
+			}
+		}()
+
+		if err := os.MkdirAll(filepath.Join(xdg.StateHome, "sindri"), 0755); err != nil {
+			return err
+		}
+
+		var (
+			dag  sindri.Dagger
+			pool *engine.Pool
+		)
+		if cfg.Engine.Disabled {
+			log.Info("builds disabled, serving only what is already stored")
+		} else {
+			daggerLog, err := os.Create(filepath.Join(xdg.StateHome, "sindri/dagger.log"))
+			if err != nil {
+				return err
+			}
+			defer daggerLog.Close()
+
+			daggerOpts := []dagger.ClientOpt{
+				dagger.WithLogOutput(daggerLog),
+				dagger.WithVerbosity(int(level.Level() / 4)),
+			}
+			if cfg.Module.Dir != "" {
+				daggerOpts = append(daggerOpts, dagger.WithWorkdir(cfg.Module.Dir))
+			}
+
+			pool = newEnginePool(&cfg.Engine, cfg.Health.Timeout.Duration(), daggerOpts...)
+			if err := pool.Open(ctx); err != nil {
+				return err
+			}
+			defer pool.Close()
+
+			dag = pool
+		}
+
+		b, err := openBackend(ctx, cfg)
+		if err != nil {
+			return err
+		}
+
+		var mu sync.Mutex
+		defer func() {
+			mu.Lock()
+			defer mu.Unlock()
+			_ = b.Close()
+		}()
+
+		// The scheduler, limits, failures, builder and rebuilder are kept across reloads so that
+		// builds in flight keep counting against them and running, failures are remembered and
+		// pulls keep counting.
+		failures, err := newFailureCache(&cfg.Failures)
+		if err != nil {
+			return err
+		}
+
+		metricsRepositories, err := auth.CompileGlobs(cfg.Metrics.Repositories)
+		if err != nil {
+			return err
+		}
+
+		signingKey, err := auth.GenerateSigningKey()
+		if err != nil {
+			return err
+		}
+
+		sh := &shared{
+			scheduler:     newScheduler(&cfg.Limits.Builds),
+			rate:          newRateLimit(&cfg.Limits.Rate),
+			failures:      failures,
+			metrics:       sindri.NewMetrics(metricsRepositories),
+			registry:      prometheus.NewRegistry(),
+			rebuilder:     &rebuild.Rebuilder{Pulls: &rebuild.Pulls{}},
+			invalidations: &rebuild.Invalidations{},
+			signingKey:    signingKey,
+		}
+		sh.registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+			sh.scheduler,
+			sh.failures,
+			sh.metrics,
+		)
+		if pool != nil {
+			sh.registry.MustRegister(pool)
+		}
+		if !cfg.Engine.Disabled {
+			sh.builder = sindri.NewBuilder(dag, b,
+				sindri.WithBuildTimeout(cfg.Limits.BuildTimeout.Duration()),
+				sindri.WithScheduler(sh.scheduler),
+				sindri.WithFailures(sh.failures),
+				sindri.WithMetrics(sh.metrics),
+			)
+		}
+
+		h, err := newHandlers(ctx, dag, cfg, sh, b)
+		if err != nil {
+			return err
+		}
+
+		if err := sh.rebuilder.Update(sh.builder, h.rebuilds); err != nil {
+			return err
+		}
+
+		checker := &health.Checker{
+			TTL:     cfg.Health.TTL.Duration(),
+			Timeout: cfg.Health.Timeout.Duration(),
+		}
+		if pool != nil {
+			checker.Add("dagger", pool.Check)
+		}
+		checker.Add("backend", func(ctx context.Context) error {
+			mu.Lock()
+			pb, ok := b.(backend.PingBackend)
+			mu.Unlock()
+
+			if !ok {
+				return nil
+			}
+
+			return pb.Ping(ctx)
+		})
+
+		var (
+			swapHandler    = httputil.NewSwapHandler(h.registry)
+			adminHandler   = httputil.NewSwapHandler(h.admin)
+			webhookHandler = httputil.NewSwapHandler(h.webhook)
+			mux            = http.NewServeMux()
+		)
+		mux.Handle("/", swapHandler)
+		mux.Handle("POST /webhooks/", webhookHandler)
+		mux.Handle("GET /healthz", health.LiveHandler())
+		mux.Handle("GET /readyz", checker.ReadyHandler())
+		// The admin API and metrics are served on the admin listener if there is one.
+		adminMux := mux
+		if adminSrv != nil {
+			adminMux = http.NewServeMux()
+			adminSrv.Handler = adminMux
+		}
+		if cfg.Admin.Enabled {
+			adminMux.Handle("/admin/", adminHandler)
+		}
+		if cfg.Metrics.Enabled {
+			adminMux.Handle("GET /metrics", promhttp.HandlerFor(sh.registry, promhttp.HandlerOpts{}))
+		}
+		srv.Handler = mux
+
+		// reload swaps in a new backend and handler from the reloaded configuration,
+		// closing the previous backend once the requests it is serving and the builds
+		// storing in it, including those that outlive requests, finish.
+		reload := func() {
+			log.Info("reloading configuration", "file", configFile)
+
+			next, err := loadConfig()
+			if err != nil {
+				log.Error(err.Error())
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if listenerChanged(&next.Listeners.Registry, &cfg.Listeners.Registry) ||
+				listenerChanged(&next.Listeners.Admin, &cfg.Listeners.Admin) ||
+				!reflect.DeepEqual(next.Module, cfg.Module) ||
+				!reflect.DeepEqual(next.Engine, cfg.Engine) ||
+				next.Logging.Format != cfg.Logging.Format ||
+				!reflect.DeepEqual(next.Limits, cfg.Limits) ||
+				!reflect.DeepEqual(next.Failures, cfg.Failures) ||
+				next.Health != cfg.Health ||
+				next.Tracing != cfg.Tracing ||
+				next.Admin.Enabled != cfg.Admin.Enabled ||
+				!reflect.DeepEqual(next.Metrics, cfg.Metrics) {
+				log.Warn("changes to listeners, module, engine, limits, failures, health, tracing, enabling admin or metrics or logging format require a restart, keeping them as they were")
+			}
+			// NB: What requires a restart is kept as it was so that what is reloaded
+			// is consistent with the listeners, engines, scheduler and builder running.
+			if listenerChanged(&next.Listeners.Registry, &cfg.Listeners.Registry) {
+				next.Listeners.Registry = cfg.Listeners.Registry
+			}
+			if listenerChanged(&next.Listeners.Admin, &cfg.Listeners.Admin) {
+				next.Listeners.Admin = cfg.Listeners.Admin
+			}
+			next.Module, next.Engine, next.Limits, next.Failures = cfg.Module, cfg.Engine, cfg.Limits, cfg.Failures
+			next.Health, next.Tracing, next.Metrics = cfg.Health, cfg.Tracing, cfg.Metrics
+			next.Admin.Enabled, next.Logging.Format = cfg.Admin.Enabled, cfg.Logging.Format
+
+			if certificateReloader != nil && next.Listeners.Registry.TLS.Enabled() {
+				if err := certificateReloader.SetFiles(next.Listeners.Registry.TLS.CertFile, next.Listeners.Registry.TLS.KeyFile); err != nil {
+					log.Error(err.Error())
+					return
 				}
-				defer daggerLog.Close()
+			}
 
-				dag, err := dagger.Connect(ctx,
-					dagger.WithLogOutput(daggerLog),
-					dagger.WithVerbosity(int(slogConfig.Level()/4)),
-				)
-				if err != nil {
-					return err
+			if adminCertificateReloader != nil && next.Listeners.Admin.TLS.Enabled() {
+				if err := adminCertificateReloader.SetFiles(next.Listeners.Admin.TLS.CertFile, next.Listeners.Admin.TLS.KeyFile); err != nil {
+					log.Error(err.Error())
+					return
 				}
-				defer dag.Close()
+			}
 
-				if !cmd.Flag("backend").Changed {
-					if os.MkdirAll(cache, 0755); err != nil {
-						return err
-					}
+			nextB, err := openBackend(ctx, next)
+			if err != nil {
+				log.Error(err.Error())
+				return
+			}
+
+			nextH, err := newHandlers(ctx, dag, next, sh, nextB)
+			if err != nil {
+				_ = nextB.Close()
+				log.Error(err.Error())
+				return
+			}
+
+			if err := sh.rebuilder.Update(sh.builder, nextH.rebuilds); err != nil {
+				_ = nextB.Close()
+				log.Error(err.Error())
+				return
+			}
+
+			if l, err := next.Logging.SlogLevel(); err == nil {
+				level.Set(l)
+			}
+
+			var (
+				prevB   = b
+				drained = swapHandler.Swap(nextH.registry)
+				built   = sh.builder.SetBackend(nextB)
+			)
+			adminHandler.Swap(nextH.admin)
+			webhookHandler.Swap(nextH.webhook)
+			cfg, b = next, nextB
+
+			go func() {
+				<-drained
+				<-built
+				if err := prevB.Close(); err != nil {
+					log.Error(err.Error())
 				}
+			}()
+
+			log.Info("reloaded configuration")
+		}
+
+		if pool != nil {
+			eg.Go(func() error {
+				return pool.Supervise(ctx)
+			})
+		}
 
-				b, err := backend.OpenBackend(ctx, storage)
-				if err != nil {
+		eg.Go(func() error {
+			return sh.rebuilder.Run(ctx)
+		})
+
+		eg.Go(func() error {
+			<-ctx.Done()
+			if err = srv.Shutdown(context.WithoutCancel(ctx)); err != nil {
+				return err
+			}
+			if adminSrv != nil {
+				if err = adminSrv.Shutdown(context.WithoutCancel(ctx)); err != nil {
 					return err
 				}
-				defer b.Close()
+			}
+			return ctx.Err()
+		})
 
-				srv.Handler = sindri.Handler(dag, b)
+		eg.Go(func() error {
+			var (
+				hup     = make(chan os.Signal, 1)
+				ticker  = time.NewTicker(configWatchInterval)
+				modTime = configModTime(configFile)
+			)
+			defer ticker.Stop()
 
-				eg.Go(func() error {
-					<-ctx.Done()
-					if err = srv.Shutdown(context.WithoutCancel(ctx)); err != nil {
-						return err
-					}
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+
+			for {
+				select {
+				case <-ctx.Done():
 					return ctx.Err()
-				})
+				case <-hup:
+					modTime = configModTime(configFile)
+					reload()
+				case <-ticker.C:
+					if latest := configModTime(configFile); !latest.Equal(modTime) {
+						modTime = latest
+						reload()
+					}
+				}
+			}
+		})
 
-				eg.Go(func() error {
-					log.Info("listening...", "addr", lis.Addr().String())
+		eg.Go(func() error {
+			log.Info("listening...", "addr", lis.Addr().String())
 
-					if certFile != "" {
-						return srv.ServeTLS(lis, certFile, keyFile)
-					}
+			if srv.TLSConfig != nil {
+				return srv.ServeTLS(lis, "", "")
+			}
+
+			return srv.Serve(lis)
+		})
 
-					return srv.Serve(lis)
-				})
+		if adminSrv != nil {
+			eg.Go(func() error {
+				log.Info("listening for admin...", "addr", adminLis.Addr().String())
 
-				return eg.Wait()
-			},
+				if adminSrv.TLSConfig != nil {
+					return adminSrv.ServeTLS(adminLis, "", "")
+				}
+
+				return adminSrv.Serve(adminLis)
+			})
 		}
-	)
+
+		return eg.Wait()
+	}
 
 	cmd.Flags().BoolP("help", "h", false, "Help for "+cmd.Name())
 	cmd.Flags().Bool("version", false, "Version for "+cmd.Name())
@@ -125,12 +527,229 @@ func NewSindri(version string) *cobra.Command {
 
 	slogConfig.AddFlags(cmd.Flags())
 
-	cmd.Flags().StringVar(&address, "addr", ":5000", "Address to listen on")
-	cmd.Flags().StringVar(&storage, "backend", fmt.Sprintf("file://%s", cache), "Storage backend URL")
+	cmd.Flags().StringVarP(&configFile, "config", "c", config.DefaultFile, "Configuration file, reloaded on change or SIGHUP")
+	cmd.Flags().BoolVar(&printConfig, "print-config", false, "Print the effective configuration and exit")
+
+	cmd.Flags().String("addr", config.Default().Listeners.Registry.Addr, "Address to listen on")
+	cmd.Flags().String("backend", config.DefaultBackendURL, "Storage backend URL")
+	cmd.Flags().Bool("no-build", false, "Serve only what is already stored in the backend, never building")
 
-	cmd.Flags().StringVar(&certFile, "tls-crt", "", "TLS certificate file")
-	cmd.Flags().StringVar(&keyFile, "tls-key", "", "TLS private key file")
+	cmd.Flags().String("tls-crt", "", "TLS certificate file, reloaded on change")
+	cmd.Flags().String("tls-key", "", "TLS private key file, reloaded on change")
 	cmd.MarkFlagsRequiredTogether("tls-crt", "tls-key")
 
+	cmd.Flags().String("tls-client-ca", "", "CA bundle to verify client certificates with")
+	cmd.Flags().String("tls-client-auth", config.ClientAuthNone, "Client certificate verification mode (none, request, require)")
+
+	cmd.AddCommand(newPrewarm(func() *config.Config {
+		return cfg
+	}))
+
 	return cmd
 }
+
+// shared is what the handlers that are created on each reload share.
+type shared struct {
+	scheduler *scheduler.Scheduler
+	rate      *limit.Rate
+	failures  *failure.Cache
+	metrics   *sindri.Metrics
+	registry  *prometheus.Registry
+	rebuilder *rebuild.Rebuilder
+	// invalidations are tags invalidated by webhooks.
+	invalidations *rebuild.Invalidations
+	// builder builds with the backend of the latest configuration, or is nil if builds are disabled.
+	builder *sindri.Builder
+	// signingKey signs tokens if auth.signingKeyFile is not set, so that reloads do not invalidate them.
+	signingKey crypto.Signer
+}
+
+// handlers are created from each configuration that is loaded.
+type handlers struct {
+	registry http.Handler
+	admin    http.Handler
+	webhook  http.Handler
+	// rebuilds are the scheduled rebuilds to run with the shared builder.
+	rebuilds []*rebuild.Schedule
+}
+
+// openBackend opens the backend that cfg describes.
+func openBackend(ctx context.Context, cfg *config.Config) (backend.Backend, error) {
+	if cfg.Backend.URL == config.DefaultBackendURL {
+		if err := os.MkdirAll(config.DefaultCacheDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	backendURL, err := cfg.BackendURL()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := backend.OpenBackend(ctx, backendURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := b.(backend.TagBackend); cfg.Engine.Disabled && !ok {
+		_ = b.Close()
+		return nil, fmt.Errorf("engine.disabled: backend does not index tags")
+	}
+
+	return b, nil
+}
+
+// newHandlers returns handlers that serve from b.
+func newHandlers(ctx context.Context, dag sindri.Dagger, cfg *config.Config, sh *shared, b backend.Backend) (*handlers, error) {
+	a, err := newAuthService(&cfg.Auth, sh.signingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if a != nil && cfg.Auth.SigningKeyFile == "" {
+		logutil.SloggerFrom(ctx).Warn("auth.signingKeyFile not set, issued tokens will not survive restarts")
+	}
+
+	p, err := newPolicy(&cfg.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	adminSubjects, err := auth.CompileGlobs(cfg.Admin.Subjects)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookOpts, err := newWebhookOpts(&cfg.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+
+	rebuilds, err := newRebuildSchedules(cfg.Rebuilds)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rebuilds) > 0 && cfg.Engine.Disabled {
+		logutil.SloggerFrom(ctx).Warn("builds disabled, not running scheduled rebuilds")
+		rebuilds = nil
+	}
+
+	handlerOpts := []sindri.HandlerOpt{
+		sindri.WithTagMaxAge(cfg.Tags.MaxAge.Duration()),
+		sindri.WithTagStaleWhileRevalidate(cfg.Tags.StaleWhileRevalidate.Duration()),
+		sindri.WithBuildTimeout(cfg.Limits.BuildTimeout.Duration()),
+		sindri.WithAuth(a),
+		sindri.WithPolicy(p),
+		sindri.WithScheduler(sh.scheduler),
+		sindri.WithRateLimit(sh.rate),
+		sindri.WithFailures(sh.failures),
+		sindri.WithMetrics(sh.metrics),
+		sindri.WithNoBuild(cfg.Engine.Disabled),
+		sindri.WithPulls(sh.rebuilder.Pulls),
+		sindri.WithInvalidations(sh.invalidations),
+		sindri.WithBuilder(sh.builder),
+	}
+
+	adminOpts := []admin.HandlerOpt{
+		admin.WithAuth(a),
+		admin.WithSubjects(adminSubjects),
+		admin.WithScheduler(sh.scheduler),
+		admin.WithFailures(sh.failures),
+		admin.WithPolicy(p),
+		admin.WithRateLimit(sh.rate),
+		admin.WithRebuilder(sh.rebuilder),
+	}
+
+	if sh.builder != nil {
+		adminOpts = append(adminOpts, admin.WithBuilder(sh.builder))
+
+		if cfg.Webhooks.Action == config.WebhookActionRebuild {
+			webhookOpts = append(webhookOpts, webhook.WithBuilder(sh.builder))
+		}
+	}
+
+	webhookOpts = append(webhookOpts,
+		webhook.WithPulls(sh.rebuilder.Pulls),
+		webhook.WithInvalidations(sh.invalidations),
+	)
+
+	return &handlers{
+		registry: sindri.Handler(dag, b, handlerOpts...),
+		admin:    admin.Handler(adminOpts...),
+		webhook:  webhook.Handler(webhookOpts...),
+		rebuilds: rebuilds,
+	}, nil
+}
+
+// newRebuildSchedules returns the schedules that cfg describes.
+func newRebuildSchedules(cfg []config.Rebuild) ([]*rebuild.Schedule, error) {
+	schedules := make([]*rebuild.Schedule, len(cfg))
+	for i, r := range cfg {
+		schedules[i] = &rebuild.Schedule{
+			Name:      r.Name,
+			Spec:      r.Schedule,
+			TopPulled: r.TopPulled,
+		}
+
+		for j, image := range r.Images {
+			name, reference, err := admin.ParseImage(image)
+			if err != nil {
+				return nil, fmt.Errorf("rebuilds[%d].images[%d]: %w", i, j, err)
+			}
+
+			schedules[i].Images = append(schedules[i].Images, rebuild.Image{Name: name, Reference: reference})
+		}
+	}
+
+	return schedules, nil
+}
+
+// newTLSConfig returns the *tls.Config that t describes and the reloader of its
+// certificate, or nils if TLS is not enabled.
+func newTLSConfig(t *config.TLS) (*tls.Config, *tlsutil.CertificateReloader, error) {
+	if !t.Enabled() {
+		return nil, nil, nil
+	}
+
+	certificateReloader, err := tlsutil.NewCertificateReloader(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificateReloader.GetCertificate,
+	}
+
+	if tlsConfig.ClientAuth, err = tlsutil.ClientAuthType(t.ClientAuth); err != nil {
+		return nil, nil, err
+	}
+
+	if t.ClientCAFile != "" {
+		if tlsConfig.ClientCAs, err = tlsutil.NewCertPool(t.ClientCAFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return tlsConfig, certificateReloader, nil
+}
+
+// listenerChanged reports whether the differences between next and prev require a restart.
+func listenerChanged(next, prev *config.Listener) bool {
+	return next.Addr != prev.Addr ||
+		next.TLS.Enabled() != prev.TLS.Enabled() ||
+		next.TLS.ClientCAFile != prev.TLS.ClientCAFile ||
+		next.TLS.ClientAuth != prev.TLS.ClientAuth
+}
+
+// configModTime returns the modification time of the configuration
+// file, or the zero time.Time if it cannot be determined.
+func configModTime(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
@@ -0,0 +1,43 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/frantjc/sindri/internal/config"
+	"github.com/frantjc/sindri/internal/webhook"
+)
+
+// newWebhookOpts returns the webhook.HandlerOpts that verify events from the forges
+// whose secrets cfg describes.
+func newWebhookOpts(cfg *config.Webhooks) ([]webhook.HandlerOpt, error) {
+	var opts []webhook.HandlerOpt
+
+	for _, forge := range []struct {
+		file string
+		opt  func([]byte) webhook.HandlerOpt
+	}{
+		{cfg.GitHubSecretFile, webhook.WithGitHubSecret},
+		{cfg.GitLabTokenFile, webhook.WithGitLabToken},
+		{cfg.GiteaSecretFile, webhook.WithGiteaSecret},
+	} {
+		if forge.file == "" {
+			continue
+		}
+
+		b, err := os.ReadFile(forge.file)
+		if err != nil {
+			return nil, err
+		}
+
+		secret := strings.TrimSpace(string(b))
+		if secret == "" {
+			return nil, fmt.Errorf("webhook secret file %s is empty", forge.file)
+		}
+
+		opts = append(opts, forge.opt([]byte(secret)))
+	}
+
+	return opts, nil
+}
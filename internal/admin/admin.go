@@ -0,0 +1,319 @@
+// Package admin serves sindri's admin API.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/distribution"
+	"github.com/frantjc/sindri/internal/failure"
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/frantjc/sindri/internal/policy"
+	"github.com/frantjc/sindri/internal/rebuild"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/opencontainers/go-digest"
+)
+
+// HandlerOpts configures Handler.
+type HandlerOpts struct {
+	// Auth, if set, authenticates clients by their Bearer tokens or Basic credentials,
+	// in addition to their verified client certificates.
+	Auth *auth.Service
+	// Subjects restricts the admin API to authenticated clients whose subject matches any
+	// of them, so if it is empty, no client may use it. Unauthenticated clients may never use it.
+	Subjects []*auth.Glob
+	// Scheduler is the build scheduler to report on and cancel builds from.
+	Scheduler *scheduler.Scheduler
+	// Failures is the cache of failed builds to report on and clear.
+	Failures *failure.Cache
+	// Builder, if set, builds images requested through POST /admin/builds.
+	Builder Builder
+	// Policy decides which of the images requested through POST /admin/builds the client may build.
+	Policy *policy.Policy
+	// Rate limits how often each client may request builds through POST /admin/builds,
+	// with each image counting as one request, the same as pulls of tags that need building.
+	Rate *limit.Rate
+	// Rebuilder is the scheduled rebuilds to report on.
+	Rebuilder *rebuild.Rebuilder
+}
+
+// Builder builds images the same way that pulls do.
+type Builder interface {
+	Build(ctx context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error)
+}
+
+// BuildRequest is the body of POST /admin/builds.
+type BuildRequest struct {
+	// Images are the <name>:<reference>s to build.
+	Images []string `json:"images"`
+}
+
+// BuildStatus is the result of building one of a BuildRequest's images.
+type BuildStatus struct {
+	Image  string        `json:"image"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// ParseImage splits image into its <name> and <reference>, which must be a tag.
+func ParseImage(image string) (string, string, error) {
+	name, reference, ok := strings.Cut(image, ":")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not <name>:<reference>", image)
+	}
+
+	if err := distribution.ValidateName(name); err != nil {
+		return "", "", err
+	}
+
+	if err := distribution.ValidateTag(reference); err != nil {
+		return "", "", err
+	}
+
+	return name, reference, nil
+}
+
+// HandlerOpt configures Handler.
+type HandlerOpt func(*HandlerOpts)
+
+// WithAuth sets HandlerOpts.Auth.
+func WithAuth(a *auth.Service) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Auth = a
+	}
+}
+
+// WithSubjects sets HandlerOpts.Subjects.
+func WithSubjects(subjects []*auth.Glob) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Subjects = subjects
+	}
+}
+
+// WithScheduler sets HandlerOpts.Scheduler.
+func WithScheduler(s *scheduler.Scheduler) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Scheduler = s
+	}
+}
+
+// WithFailures sets HandlerOpts.Failures.
+func WithFailures(failures *failure.Cache) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Failures = failures
+	}
+}
+
+// WithBuilder sets HandlerOpts.Builder.
+func WithBuilder(builder Builder) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Builder = builder
+	}
+}
+
+// WithPolicy sets HandlerOpts.Policy.
+func WithPolicy(p *policy.Policy) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Policy = p
+	}
+}
+
+// WithRateLimit sets HandlerOpts.Rate.
+func WithRateLimit(rate *limit.Rate) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Rate = rate
+	}
+}
+
+// WithRebuilder sets HandlerOpts.Rebuilder.
+func WithRebuilder(r *rebuild.Rebuilder) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Rebuilder = r
+	}
+}
+
+// Handler serves sindri's admin API under /admin/
+// to authenticated clients, by Auth or their verified client certificates.
+func Handler(opts ...HandlerOpt) http.Handler {
+	var (
+		o   = &HandlerOpts{}
+		mux = http.NewServeMux()
+	)
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	mux.HandleFunc("GET /admin/builds", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"builds": o.Scheduler.Status(),
+		})
+	})
+
+	// Builds each of the requested images that the Policy and Rate allow the client to
+	// at scheduler.PriorityPrewarm, streaming each one's BuildStatus as a line of JSON as
+	// it finishes. Builds keep running if the client goes away, so that their results are stored.
+	if o.Builder != nil {
+		mux.HandleFunc("POST /admin/builds", func(w http.ResponseWriter, r *http.Request) {
+			req := &BuildRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				httputil.WriteError(w, http.StatusBadRequest, httputil.ErrorCodeUnknown, err.Error())
+				return
+			}
+
+			var errs []error
+			for _, image := range req.Images {
+				if _, _, err := ParseImage(image); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			if err := errors.Join(errs...); err != nil {
+				httputil.WriteError(w, http.StatusBadRequest, httputil.ErrorCodeNameInvalid, err.Error())
+				return
+			}
+
+			var (
+				client      = limit.Client(r)
+				ctx         = limit.ClientInto(context.WithoutCancel(r.Context()), client)
+				identity, _ = auth.IdentityFrom(r.Context())
+				statuses    = make(chan *BuildStatus)
+				wg          sync.WaitGroup
+			)
+			for _, image := range req.Images {
+				name, reference, _ := ParseImage(image)
+
+				wg.Go(func() {
+					status := &BuildStatus{Image: image}
+					if !o.Policy.Allowed(identity, policy.ActionBuild, name, reference) {
+						status.Error = fmt.Sprintf("denied: build %s", image)
+					} else if err := o.Rate.Allow(client); err != nil {
+						status.Error = err.Error()
+					} else if d, err := o.Builder.Build(ctx, name, reference, scheduler.PriorityPrewarm); err != nil {
+						status.Error = err.Error()
+					} else {
+						status.Digest = d
+					}
+
+					select {
+					case statuses <- status:
+					case <-r.Context().Done():
+					}
+				})
+			}
+			go func() {
+				wg.Wait()
+				close(statuses)
+			}()
+
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+
+			var (
+				enc   = json.NewEncoder(w)
+				rc    = http.NewResponseController(w)
+				log   = logutil.SloggerFrom(r.Context())
+				built = 0
+			)
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case status, ok := <-statuses:
+					if !ok {
+						log.Info("prewarmed", "built", built, "failed", len(req.Images)-built)
+						return
+					}
+
+					if status.Error == "" {
+						built++
+					}
+
+					if err := enc.Encode(status); err != nil {
+						log.Debug(err.Error())
+					}
+					_ = rc.Flush()
+				}
+			}
+		})
+	}
+
+	mux.HandleFunc("DELETE /admin/builds/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !o.Scheduler.Cancel(r.PathValue("id")) {
+			httputil.WriteError(w, http.StatusNotFound, httputil.ErrorCodeUnknown, "build not found")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/rebuilds", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"rebuilds": o.Rebuilder.Status(),
+		})
+	})
+
+	mux.HandleFunc("GET /admin/failures", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"failures": o.Failures.Entries(),
+		})
+	})
+
+	// Clears the failures of builds of the "name" and "reference" query
+	// parameters, or of any name or reference if they are not given.
+	mux.HandleFunc("DELETE /admin/failures", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"cleared": o.Failures.Clear(q.Get("name"), q.Get("reference")),
+		})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			ctx         = r.Context()
+			identity, _ = o.Auth.Identify(r)
+		)
+
+		if _, _, ok := r.BasicAuth(); ok && o.Auth != nil {
+			var err error
+			if identity, err = o.Auth.Authenticate(r); err != nil {
+				logutil.SloggerFrom(ctx).Debug(err.Error())
+			}
+		}
+
+		log := logutil.SloggerFrom(ctx).With("identity", identity)
+		log.Info(r.Method + " " + r.URL.Path)
+
+		if identity != nil {
+			ctx = auth.IdentityInto(ctx, identity)
+		}
+
+		if identity == nil {
+			if o.Auth != nil {
+				w.Header().Set("Www-Authenticate", `Basic realm="sindri"`)
+			}
+			httputil.WriteError(w, http.StatusUnauthorized, httputil.ErrorCodeUnauthorized, "authentication required")
+			return
+		}
+
+		if !auth.MatchAny(o.Subjects, identity.Subject) {
+			httputil.WriteError(w, http.StatusForbidden, httputil.ErrorCodeDenied, "admin access denied")
+			return
+		}
+
+		mux.ServeHTTP(w, r.WithContext(logutil.SloggerInto(ctx, log)))
+	})
+}
+
+func writeJSON(w http.ResponseWriter, httpStatusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
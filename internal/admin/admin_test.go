@@ -0,0 +1,271 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/admin"
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/failure"
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/policy"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/frantjc/sindri/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	key, err := auth.GenerateSigningKey()
+	require.NoError(t, err)
+
+	subjects, err := auth.CompileGlobs([]string{"admin"})
+	require.NoError(t, err)
+
+	var (
+		s   = &scheduler.Scheduler{MaxConcurrent: 1, MaxQueued: 1}
+		srv = httptest.NewServer(admin.Handler(
+			admin.WithAuth(&auth.Service{
+				Key:    key,
+				Tokens: map[string]auth.StaticToken{"adm1n": {Username: "token", Subject: "admin"}, "us3r": {Username: "token", Subject: "user"}},
+			}),
+			admin.WithSubjects(subjects),
+			admin.WithScheduler(s),
+		))
+		started = make(chan struct{})
+		errs    = make(chan error)
+	)
+	t.Cleanup(srv.Close)
+
+	go func() {
+		_, err := s.Do(t.Context(), "a", "latest", scheduler.PriorityAnonymous, "ip:1", func(ctx context.Context) (digest.Digest, error) {
+			close(started)
+			<-ctx.Done()
+			return "", ctx.Err()
+		})
+		errs <- err
+	}()
+	<-started
+
+	do := func(method, path, password string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.NoError(t, err)
+
+		if password != "" {
+			req.SetBasicAuth("token", password)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = res.Body.Close() })
+
+		return res
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/builds", "").StatusCode)
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/builds", "us3r").StatusCode)
+
+	// Without subjects, no client may use the admin API.
+	noSubjects := httptest.NewServer(admin.Handler(
+		admin.WithAuth(&auth.Service{
+			Key:    key,
+			Tokens: map[string]auth.StaticToken{"adm1n": {Username: "token", Subject: "admin"}},
+		}),
+		admin.WithScheduler(s),
+	))
+	t.Cleanup(noSubjects.Close)
+
+	req, err := http.NewRequest(http.MethodGet, noSubjects.URL+"/admin/builds", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("token", "adm1n")
+	noSubjectsRes, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer noSubjectsRes.Body.Close()
+	require.Equal(t, http.StatusForbidden, noSubjectsRes.StatusCode)
+
+	res := do(http.MethodGet, "/admin/builds", "adm1n")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	body := struct {
+		Builds []scheduler.Status `json:"builds"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.Len(t, body.Builds, 1)
+	require.Equal(t, "a", body.Builds[0].Name)
+	require.Equal(t, scheduler.StateRunning, body.Builds[0].State)
+
+	// Metrics are not served by the admin API.
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/metrics", "adm1n").StatusCode)
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/builds/"+body.Builds[0].ID, "adm1n").StatusCode)
+	require.ErrorIs(t, <-errs, scheduler.ErrCanceled)
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/builds/"+body.Builds[0].ID, "adm1n").StatusCode)
+
+	require.Eventually(t, func() bool {
+		return len(s.Status()) == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, promtestutil.CollectAndCompare(s, strings.NewReader(`
+# HELP sindri_builds_finished_total Builds that finished, by result: success, failure, canceled or abandoned by every waiting client while queued.
+# TYPE sindri_builds_finished_total counter
+sindri_builds_finished_total{result="canceled"} 1
+`), "sindri_builds_finished_total"))
+}
+
+// withTokenAuth authenticates the token "adm1n" as the subject "admin" and lets it use the admin API.
+func withTokenAuth(t *testing.T) admin.HandlerOpt {
+	t.Helper()
+
+	key, err := auth.GenerateSigningKey()
+	require.NoError(t, err)
+
+	subjects, err := auth.CompileGlobs([]string{"admin"})
+	require.NoError(t, err)
+
+	return func(o *admin.HandlerOpts) {
+		admin.WithAuth(&auth.Service{
+			Key:    key,
+			Tokens: map[string]auth.StaticToken{"adm1n": {Username: "token", Subject: "admin"}},
+		})(o)
+		admin.WithSubjects(subjects)(o)
+	}
+}
+
+// newRequest returns a request authenticated with the token "adm1n".
+func newRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	req.SetBasicAuth("token", "adm1n")
+
+	return req
+}
+
+func TestHandlerFailures(t *testing.T) {
+	var (
+		failures = &failure.Cache{Backoff: time.Minute, MaxBackoff: time.Hour}
+		srv      = httptest.NewServer(admin.Handler(withTokenAuth(t), admin.WithFailures(failures)))
+	)
+	t.Cleanup(srv.Close)
+
+	failures.Put("a", "latest", errors.New("failed"))
+	failures.Put("a", "v1", errors.New("failed"))
+	failures.Put("b", "latest", errors.New("failed"))
+
+	// Unauthenticated clients may not use the admin API.
+	res, err := http.Get(srv.URL + "/admin/failures")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, err = http.DefaultClient.Do(newRequest(t, http.MethodGet, srv.URL+"/admin/failures", nil))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body := struct {
+		Failures []failure.Entry `json:"failures"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	require.Len(t, body.Failures, 3)
+
+	res, err = http.DefaultClient.Do(newRequest(t, http.MethodDelete, srv.URL+"/admin/failures?name=a", nil))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	cleared := struct {
+		Cleared int `json:"cleared"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&cleared))
+	require.Equal(t, 2, cleared.Cleared)
+	require.NoError(t, failures.Get("a", "latest"))
+	require.Error(t, failures.Get("b", "latest"))
+}
+
+func TestHandlerPrewarm(t *testing.T) {
+	denied, err := policy.CompileRegexp("^denied$")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(admin.Handler(
+		withTokenAuth(t),
+		admin.WithBuilder(testutil.BuilderFunc(func(_ context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error) {
+			if priority != scheduler.PriorityPrewarm {
+				return "", errors.New("wrong priority")
+			} else if reference == "broken" {
+				return "", errors.New("build failed")
+			}
+
+			return digest.FromString(name + ":" + reference), nil
+		})),
+		admin.WithPolicy(&policy.Policy{
+			Rules: []policy.Rule{
+				{Effect: policy.EffectDeny, Actions: []string{policy.ActionBuild}, References: []policy.Matcher{denied}},
+			},
+		}),
+		admin.WithRateLimit(&limit.Rate{Limit: 0.001, Burst: 4}),
+	))
+	t.Cleanup(srv.Close)
+
+	post := func(body string) *http.Response {
+		req := newRequest(t, http.MethodPost, srv.URL+"/admin/builds", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = res.Body.Close() })
+
+		return res
+	}
+
+	// Unauthenticated clients may not build.
+	res, err := http.Post(srv.URL+"/admin/builds", "application/json", strings.NewReader(`{"images":["a:latest"]}`))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	require.Equal(t, http.StatusBadRequest, post(`{"images":["a:latest","A:latest"]}`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, post(`{"images":["a"]}`).StatusCode)
+
+	statuses := func(res *http.Response) map[string]*admin.BuildStatus {
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var (
+			dec      = json.NewDecoder(res.Body)
+			statuses = map[string]*admin.BuildStatus{}
+		)
+		for dec.More() {
+			status := &admin.BuildStatus{}
+			require.NoError(t, dec.Decode(status))
+			statuses[status.Image] = status
+		}
+
+		return statuses
+	}
+
+	built := statuses(post(`{"images":["a:latest","b/c:v1","a:broken","a:denied"]}`))
+	require.Len(t, built, 4)
+	require.Equal(t, digest.FromString("a:latest"), built["a:latest"].Digest)
+	require.Equal(t, digest.FromString("b/c:v1"), built["b/c:v1"].Digest)
+	require.Empty(t, built["a:broken"].Digest)
+	require.Equal(t, "build failed", built["a:broken"].Error)
+	// The policy applies to prewarming the same as it does to pulls.
+	require.Empty(t, built["a:denied"].Digest)
+	require.Contains(t, built["a:denied"].Error, "denied")
+
+	// So does the rate limit, with each image counting as a request. Images that the
+	// policy denied did not count, so one more image may be built before the limit.
+	built = statuses(post(`{"images":["a:v1","a:v2"]}`))
+	require.Len(t, built, 2)
+	require.Equal(t, 1, len(slices.DeleteFunc(slices.Collect(maps.Values(built)), func(status *admin.BuildStatus) bool {
+		return status.Error == ""
+	})))
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Glob is a pattern in which "*" matches any sequence of characters except
+// "/" and "**" matches any sequence of characters, e.g. "github.com/frantjc/**".
+type Glob struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// CompileGlob compiles pattern into a *Glob.
+func CompileGlob(pattern string) (*Glob, error) {
+	var (
+		sb    strings.Builder
+		runes = []rune(pattern)
+	)
+
+	sb.WriteString("^")
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Glob{pattern: pattern, re: re}, nil
+}
+
+// CompileGlobs compiles each of patterns into a *Glob.
+func CompileGlobs(patterns []string) ([]*Glob, error) {
+	globs := make([]*Glob, len(patterns))
+	for i, pattern := range patterns {
+		var err error
+		if globs[i], err = CompileGlob(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return globs, nil
+}
+
+// Match reports whether s matches g.
+func (g *Glob) Match(s string) bool {
+	return g.re.MatchString(s)
+}
+
+// String implements fmt.Stringer.
+func (g *Glob) String() string {
+	return g.pattern
+}
+
+// MatchAny reports whether s matches any of globs.
+func MatchAny(globs []*Glob, s string) bool {
+	for _, g := range globs {
+		if g.Match(s) {
+			return true
+		}
+	}
+	return false
+}
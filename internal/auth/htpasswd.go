@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd maps usernames to bcrypt password hashes as read from an htpasswd file.
+type Htpasswd map[string][]byte
+
+// ReadHtpasswd reads the htpasswd file at name. Only bcrypt hashes
+// are supported, i.e. those created by `htpasswd -B`.
+func ReadHtpasswd(name string) (Htpasswd, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		htpasswd = Htpasswd{}
+		scanner  = bufio.NewScanner(f)
+		line     = 0
+	)
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hash, found := strings.Cut(text, ":")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected <username>:<hash>", name, line)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported: %w", name, line, err)
+		}
+
+		htpasswd[username] = []byte(hash)
+	}
+
+	return htpasswd, scanner.Err()
+}
+
+// Authenticate reports whether password is correct for username.
+func (h Htpasswd) Authenticate(username, password string) bool {
+	hash, ok := h[username]
+	if !ok {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
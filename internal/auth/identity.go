@@ -0,0 +1,81 @@
+// Package auth authenticates clients of sindri.
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+)
+
+// Identity is an authenticated client of sindri.
+type Identity struct {
+	// Subject identifies the client, e.g. a username, an ID token's subject prefixed by
+	// OIDCSubjectPrefix and its issuer or, prefixed by CertificateSubjectPrefix, the common
+	// name of the client's TLS certificate.
+	Subject string `json:"sub"`
+	// Method is how the client was authenticated, e.g. "mtls".
+	Method string `json:"method"`
+}
+
+const (
+	MethodMTLS = "mtls"
+)
+
+// CertificateSubjectPrefix prefixes the subjects of clients that are identified by their
+// TLS certificates so that they cannot be mistaken for subjects that tokens authenticate,
+// e.g. a certificate with the common name "admin" is the subject "x509:admin".
+const CertificateSubjectPrefix = "x509:"
+
+// OIDCSubjectPrefix prefixes the subjects of clients that are identified by ID tokens, followed
+// by the issuer of the ID token, so that they cannot be mistaken for other issuers' subjects or
+// subjects that Sindri authenticates itself, e.g. GitHub Actions' ID token with the subject
+// "repo:frantjc/sindri:ref:refs/heads/main" is the subject
+// "oidc:https://token.actions.githubusercontent.com:repo:frantjc/sindri:ref:refs/heads/main".
+const OIDCSubjectPrefix = "oidc:"
+
+// LogValue implements slog.LogValuer.
+func (i *Identity) LogValue() slog.Value {
+	if i == nil {
+		return slog.StringValue("anonymous")
+	}
+
+	return slog.GroupValue(
+		slog.String("sub", i.Subject),
+		slog.String("method", i.Method),
+	)
+}
+
+type contextKey struct{}
+
+// IdentityInto returns a new context with an *Identity stored in it.
+func IdentityInto(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// IdentityFrom returns the *Identity from the context, if any.
+func IdentityFrom(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(*Identity)
+	return identity, ok && identity != nil
+}
+
+// IdentityFromCertificate returns the *Identity of a client that presented
+// the given verified TLS certificate. Its subject is CertificateSubjectPrefix
+// followed by the certificate's common name, falling back to its first URI
+// (e.g. a SPIFFE ID), DNS name, email address or, failing all of those, serial number.
+func IdentityFromCertificate(cert *x509.Certificate) *Identity {
+	subject := cert.Subject.CommonName
+
+	switch {
+	case subject != "":
+	case len(cert.URIs) > 0:
+		subject = cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		subject = cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		subject = cert.EmailAddresses[0]
+	default:
+		subject = cert.SerialNumber.String()
+	}
+
+	return &Identity{Subject: CertificateSubjectPrefix + subject, Method: MethodMTLS}
+}
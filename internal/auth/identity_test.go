@@ -0,0 +1,134 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityFromCertificate(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://example.com/ci")
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name    string
+		cert    *x509.Certificate
+		subject string
+	}{
+		{
+			name: "common name",
+			cert: &x509.Certificate{
+				Subject:        pkix.Name{CommonName: "admin"},
+				URIs:           []*url.URL{spiffeID},
+				DNSNames:       []string{"ci.example.com"},
+				EmailAddresses: []string{"ci@example.com"},
+			},
+			subject: "x509:admin",
+		},
+		{
+			name: "uri",
+			cert: &x509.Certificate{
+				URIs:           []*url.URL{spiffeID},
+				DNSNames:       []string{"ci.example.com"},
+				EmailAddresses: []string{"ci@example.com"},
+			},
+			subject: "x509:spiffe://example.com/ci",
+		},
+		{
+			name: "dns name",
+			cert: &x509.Certificate{
+				DNSNames:       []string{"ci.example.com", "ci2.example.com"},
+				EmailAddresses: []string{"ci@example.com"},
+			},
+			subject: "x509:ci.example.com",
+		},
+		{
+			name: "email address",
+			cert: &x509.Certificate{
+				EmailAddresses: []string{"ci@example.com"},
+			},
+			subject: "x509:ci@example.com",
+		},
+		{
+			name: "serial number",
+			cert: &x509.Certificate{
+				SerialNumber: big.NewInt(1234),
+			},
+			subject: "x509:1234",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			identity := auth.IdentityFromCertificate(c.cert)
+			require.Equal(t, c.subject, identity.Subject)
+			require.Equal(t, auth.MethodMTLS, identity.Method)
+		})
+	}
+}
+
+func TestServiceIdentifyCertificate(t *testing.T) {
+	key, err := auth.GenerateSigningKey()
+	require.NoError(t, err)
+
+	var (
+		cert = &x509.Certificate{Subject: pkix.Name{CommonName: "admin"}}
+		s    = &auth.Service{
+			TTL:    time.Minute,
+			Key:    key,
+			Tokens: map[string]auth.StaticToken{"s3cr3t": {Username: "token", Subject: "admin"}},
+		}
+		request = func(state *tls.ConnectionState) *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			r.TLS = state
+			return r
+		}
+	)
+
+	// Verified certificates identify clients, namespaced apart from token subjects.
+	identity, _ := s.Identify(request(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}))
+	require.NotNil(t, identity)
+	require.Equal(t, "x509:admin", identity.Subject)
+	require.Equal(t, auth.MethodMTLS, identity.Method)
+
+	// Certificates that were presented but not verified, e.g. with clientAuth "request"
+	// and no clientCAFile, do not.
+	identity, _ = s.Identify(request(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}))
+	require.Nil(t, identity)
+
+	identity, _ = s.Identify(request(nil))
+	require.Nil(t, identity)
+
+	// A token's subject takes precedence over a certificate's.
+	rec := httptest.NewRecorder()
+	token := httptest.NewRequest(http.MethodGet, "/v2/token", nil)
+	token.SetBasicAuth("token", "s3cr3t")
+	s.TokenHandler().ServeHTTP(rec, token)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body := map[string]any{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+
+	r := request(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	})
+	r.Header.Set("Authorization", "Bearer "+body["token"].(string))
+	identity, claims := s.Identify(r)
+	require.NotNil(t, claims)
+	require.Equal(t, "admin", identity.Subject)
+	require.Equal(t, auth.MethodToken, identity.Method)
+}
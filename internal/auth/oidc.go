@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcKeysMaxAge        = time.Hour
+	oidcKeysMinRefetchAge = time.Minute
+)
+
+// OIDCProvider verifies ID tokens issued by an OpenID Connect provider,
+// e.g. Kubernetes service account tokens or GitHub Actions' ID tokens,
+// so that their subjects can authenticate to sindri.
+type OIDCProvider struct {
+	// Issuer is the issuer URL of the provider.
+	Issuer string
+	// Audience is the audience that ID tokens must be issued for.
+	Audience string
+	// SubjectClaim is the claim to use as the subject of the Identity. Defaults to "sub".
+	SubjectClaim string
+	// Client is used to fetch the provider's keys. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+// Verify verifies the raw ID token and returns the subject that it identifies.
+func (p *OIDCProvider) Verify(ctx context.Context, raw string) (string, error) {
+	claims := jwt.MapClaims{}
+
+	if _, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512", "EdDSA"}),
+	); err != nil {
+		return "", err
+	}
+
+	subjectClaim := p.SubjectClaim
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+
+	subject, ok := claims[subjectClaim].(string)
+	if !ok || subject == "" {
+		return "", fmt.Errorf("ID token has no %s claim", subjectClaim)
+	}
+
+	return subject, nil
+}
+
+func (p *OIDCProvider) key(ctx context.Context, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys == nil || time.Since(p.fetchedAt) > oidcKeysMaxAge {
+		if err := p.fetchKeys(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	// NB: The provider may have rotated its keys.
+	if time.Since(p.fetchedAt) > oidcKeysMinRefetchAge {
+		if err := p.fetchKeys(ctx); err != nil {
+			return nil, err
+		}
+
+		if key, ok := p.lookup(kid); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no key %q for issuer %s", kid, p.Issuer)
+}
+
+func (p *OIDCProvider) lookup(kid string) (any, bool) {
+	if kid == "" {
+		if len(p.keys.Keys) == 1 {
+			return p.keys.Keys[0].Key, true
+		}
+		return nil, false
+	}
+
+	if keys := p.keys.Key(kid); len(keys) > 0 {
+		return keys[0].Key, true
+	}
+
+	return nil, false
+}
+
+func (p *OIDCProvider) fetchKeys(ctx context.Context) error {
+	discovery := &struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", discovery); err != nil {
+		return err
+	}
+
+	if discovery.Issuer != p.Issuer {
+		return fmt.Errorf("issuer %s does not match discovered issuer %s", p.Issuer, discovery.Issuer)
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err := p.getJSON(ctx, discovery.JWKSURI, keys); err != nil {
+		return err
+	}
+
+	p.keys, p.fetchedAt = keys, time.Now()
+
+	return nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
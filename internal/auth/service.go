@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	MethodBasic = "basic"
+	MethodToken = "token"
+	MethodOIDC  = "oidc"
+)
+
+// Rule grants pull access to repositories.
+type Rule struct {
+	// Anonymous grants access to unauthenticated clients.
+	Anonymous bool
+	// Subjects grants access to authenticated clients whose subject matches any of them.
+	Subjects []*Glob
+	// Repositories are the repository names that access is granted to.
+	Repositories []*Glob
+}
+
+// Service is sindri's implementation of the Docker token authentication
+// specification (https://distribution.github.io/distribution/spec/auth/token/).
+// It authenticates clients and issues them tokens scoped to the repositories
+// that they may pull.
+type Service struct {
+	// Service is the name of the service that tokens are issued for. Defaults to "sindri".
+	Service string
+	// Realm is the URL of the token endpoint. Defaults to /v2/token on the requested host.
+	Realm string
+	// TTL is how long issued tokens are valid for.
+	TTL time.Duration
+	// Key signs issued tokens.
+	Key crypto.Signer
+	// Htpasswd authenticates clients by username and password.
+	Htpasswd Htpasswd
+	// Tokens maps static tokens, given as passwords, to the usernames that they must
+	// be given with and the subjects that they authenticate.
+	Tokens map[string]StaticToken
+	// OIDC authenticates clients by ID tokens, given as passwords, from any of these providers.
+	OIDC []*OIDCProvider
+	// Rules grant access to repositories. If empty, authenticated
+	// clients may pull any repository and unauthenticated clients none.
+	Rules []Rule
+}
+
+// StaticToken is what a static token authenticates.
+type StaticToken struct {
+	// Username is the username that the token must be given with.
+	Username string
+	// Subject is the subject that the token authenticates.
+	Subject string
+}
+
+func (s *Service) service() string {
+	if s.Service != "" {
+		return s.Service
+	}
+
+	return "sindri"
+}
+
+// Authenticate returns the *Identity of the client that made r. Clients authenticate
+// with Basic authentication, with a password that is checked against Htpasswd, Tokens
+// and OIDC in that order, or by a verified client certificate. The subjects of clients
+// authenticated by OIDC are prefixed by OIDCSubjectPrefix, their issuer and ":". A nil
+// *Identity is returned for anonymous clients.
+func (s *Service) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		if identity, ok := IdentityFrom(r.Context()); ok && identity.Method == MethodMTLS {
+			return identity, nil
+		}
+
+		return nil, nil
+	}
+
+	if s.Htpasswd != nil && s.Htpasswd.Authenticate(username, password) {
+		return &Identity{Subject: username, Method: MethodBasic}, nil
+	}
+
+	if token, ok := s.Tokens[password]; ok && token.Username == username {
+		return &Identity{Subject: token.Subject, Method: MethodToken}, nil
+	}
+
+	var errs []error
+	for _, provider := range s.OIDC {
+		subject, err := provider.Verify(r.Context(), password)
+		if err == nil {
+			return &Identity{Subject: OIDCSubjectPrefix + provider.Issuer + ":" + subject, Method: MethodOIDC}, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(append([]error{fmt.Errorf("invalid credentials for %s", username)}, errs...)...)
+}
+
+// Identify returns the *Identity of the client that made r, from its Bearer
+// token if s is not nil and it has a valid one, otherwise its verified client
+// certificate, along with the token's *Claims, if any.
+func (s *Service) Identify(r *http.Request) (*Identity, *Claims) {
+	var identity *Identity
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		identity = IdentityFromCertificate(r.TLS.VerifiedChains[0][0])
+	}
+
+	if s == nil || r.Header.Get("Authorization") == "" {
+		return identity, nil
+	}
+
+	claims, err := s.Verify(r)
+	if err != nil {
+		return identity, nil
+	}
+
+	if claimsIdentity := claims.Identity(); claimsIdentity != nil {
+		identity = claimsIdentity
+	}
+
+	return identity, claims
+}
+
+// Allowed reports whether identity may pull repository.
+func (s *Service) Allowed(identity *Identity, repository string) bool {
+	if len(s.Rules) == 0 {
+		return identity != nil
+	}
+
+	for _, rule := range s.Rules {
+		if !MatchAny(rule.Repositories, repository) {
+			continue
+		}
+
+		if identity == nil {
+			if rule.Anonymous {
+				return true
+			}
+		} else if MatchAny(rule.Subjects, identity.Subject) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Verify verifies the Bearer token on r, if any.
+func (s *Service) Verify(r *http.Request) (*Claims, error) {
+	raw, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return nil, fmt.Errorf("no bearer token")
+	}
+
+	method, err := signingMethod(s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (any, error) {
+		return s.Key.Public(), nil
+	},
+		jwt.WithIssuer(s.service()),
+		jwt.WithAudience(s.service()),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{method.Alg()}),
+	); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Challenge responds to r with a challenge for a token granting scope, if given.
+func (s *Service) Challenge(w http.ResponseWriter, r *http.Request, scope string) {
+	realm := s.Realm
+	if realm == "" {
+		scheme := "http"
+		if xForwardedProto := r.Header.Get("X-Forwarded-Proto"); xForwardedProto != "" {
+			scheme = xForwardedProto
+		} else if r.TLS != nil {
+			scheme = "https"
+		}
+
+		realm = fmt.Sprintf("%s://%s/v2/token", scheme, r.Host)
+	}
+
+	challenge := fmt.Sprintf(`Bearer realm=%q,service=%q`, realm, s.service())
+	if scope != "" {
+		challenge += fmt.Sprintf(`,scope=%q`, scope)
+		if _, ok := ClaimsFrom(r.Context()); ok {
+			challenge += `,error="insufficient_scope"`
+		}
+	}
+
+	w.Header().Set("Www-Authenticate", challenge)
+	httputil.WriteError(w, http.StatusUnauthorized, httputil.ErrorCodeUnauthorized, "authentication required")
+}
+
+// Scope returns the scope for pulling the repository name.
+func Scope(name string) string {
+	return "repository:" + name + ":" + ActionPull
+}
+
+// TokenHandler returns the handler for the token endpoint.
+func (s *Service) TokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := logutil.SloggerFrom(r.Context())
+
+		identity, err := s.Authenticate(r)
+		if err != nil {
+			log.Debug(err.Error())
+			httputil.WriteError(w, http.StatusUnauthorized, httputil.ErrorCodeUnauthorized, "invalid credentials")
+			return
+		}
+
+		access := []Access{}
+		for _, scope := range r.URL.Query()["scope"] {
+			for scope := range strings.FieldsSeq(scope) {
+				typ, rest, _ := strings.Cut(scope, ":")
+				if typ != "repository" {
+					continue
+				}
+
+				i := strings.LastIndex(rest, ":")
+				if i < 0 {
+					continue
+				}
+
+				name, actions := rest[:i], strings.Split(rest[i+1:], ",")
+				if slices.Contains(actions, ActionPull) && s.Allowed(identity, name) {
+					access = append(access, Access{Type: "repository", Name: name, Actions: []string{ActionPull}})
+				} else {
+					log.Debug("denied scope", "scope", scope, "identity", identity)
+				}
+			}
+		}
+
+		method, err := signingMethod(s.Key)
+		if err != nil {
+			log.Error(err.Error())
+			httputil.WriteError(w, http.StatusInternalServerError, httputil.ErrorCodeUnknown, err.Error())
+			return
+		}
+
+		var (
+			now    = time.Now()
+			claims = &Claims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Issuer:    s.service(),
+					Audience:  jwt.ClaimStrings{s.service()},
+					IssuedAt:  jwt.NewNumericDate(now),
+					NotBefore: jwt.NewNumericDate(now),
+					ExpiresAt: jwt.NewNumericDate(now.Add(s.TTL)),
+					ID:        uuid.NewString(),
+				},
+				Access: access,
+			}
+		)
+		if identity != nil {
+			claims.Subject = identity.Subject
+			claims.Method = identity.Method
+		}
+
+		token, err := jwt.NewWithClaims(method, claims).SignedString(s.Key)
+		if err != nil {
+			log.Error(err.Error())
+			httputil.WriteError(w, http.StatusInternalServerError, httputil.ErrorCodeUnknown, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"token":        token,
+			"access_token": token,
+			"expires_in":   int(s.TTL.Seconds()),
+			"issued_at":    now.UTC().Format(time.RFC3339),
+		})
+	})
+}
@@ -0,0 +1,228 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestService(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0600))
+
+	key, err := auth.GenerateSigningKey()
+	require.NoError(t, err)
+
+	h, err := auth.ReadHtpasswd(htpasswd)
+	require.NoError(t, err)
+
+	s := &auth.Service{
+		TTL:      time.Minute,
+		Key:      key,
+		Htpasswd: h,
+		Tokens:   map[string]auth.StaticToken{"s3cr3t": {Username: "ci", Subject: "ci"}},
+		Rules: []auth.Rule{
+			{Anonymous: true, Repositories: mustCompileGlobs(t, "public/**")},
+			{Subjects: mustCompileGlobs(t, "alice"), Repositories: mustCompileGlobs(t, "**")},
+			{Subjects: mustCompileGlobs(t, "ci"), Repositories: mustCompileGlobs(t, "github.com/frantjc/*")},
+		},
+	}
+
+	srv := httptest.NewServer(s.TokenHandler())
+	t.Cleanup(srv.Close)
+
+	token := func(username, password string, scopes ...string) (string, int) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+
+		q := req.URL.Query()
+		for _, scope := range scopes {
+			q.Add("scope", scope)
+		}
+		req.URL.RawQuery = q.Encode()
+
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		body := map[string]any{}
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			return body["token"].(string), res.StatusCode
+		}
+
+		return "", res.StatusCode
+	}
+
+	verify := func(raw string) *auth.Claims {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.Header.Set("Authorization", "Bearer "+raw)
+
+		claims, err := s.Verify(req)
+		require.NoError(t, err)
+
+		return claims
+	}
+
+	t.Run("anonymous", func(t *testing.T) {
+		raw, status := token("", "", auth.Scope("public/hello"), auth.Scope("private/hello"))
+		require.Equal(t, http.StatusOK, status)
+
+		claims := verify(raw)
+		require.Nil(t, claims.Identity())
+		require.True(t, claims.Allows("public/hello", auth.ActionPull))
+		require.False(t, claims.Allows("private/hello", auth.ActionPull))
+	})
+
+	t.Run("htpasswd", func(t *testing.T) {
+		raw, status := token("alice", "hunter2", auth.Scope("private/hello"))
+		require.Equal(t, http.StatusOK, status)
+
+		claims := verify(raw)
+		require.Equal(t, &auth.Identity{Subject: "alice", Method: auth.MethodBasic}, claims.Identity())
+		require.True(t, claims.Allows("private/hello", auth.ActionPull))
+	})
+
+	t.Run("token", func(t *testing.T) {
+		raw, status := token("ci", "s3cr3t", auth.Scope("github.com/frantjc/sindri")+" "+auth.Scope("github.com/other/repo"))
+		require.Equal(t, http.StatusOK, status)
+
+		claims := verify(raw)
+		require.Equal(t, &auth.Identity{Subject: "ci", Method: auth.MethodToken}, claims.Identity())
+		require.True(t, claims.Allows("github.com/frantjc/sindri", auth.ActionPull))
+		require.False(t, claims.Allows("github.com/other/repo", auth.ActionPull))
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		_, status := token("alice", "wrong")
+		require.Equal(t, http.StatusUnauthorized, status)
+
+		// Tokens must be given with the usernames that they are bound to.
+		_, status = token("alice", "s3cr3t")
+		require.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		var (
+			req = httptest.NewRequest(http.MethodGet, "http://sindri.example.com/v2/private/hello/manifests/latest", nil)
+			rec = httptest.NewRecorder()
+		)
+
+		s.Challenge(rec, req, auth.Scope("private/hello"))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		require.Equal(t,
+			`Bearer realm="http://sindri.example.com/v2/token",service="sindri",scope="repository:private/hello:pull"`,
+			rec.Header().Get("Www-Authenticate"),
+		)
+	})
+
+	t.Run("foreign key", func(t *testing.T) {
+		other, err := auth.GenerateSigningKey()
+		require.NoError(t, err)
+
+		var (
+			rec = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, "/v2/token", nil)
+		)
+		(&auth.Service{TTL: time.Minute, Key: other}).TokenHandler().ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		body := map[string]any{}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+
+		req = httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.Header.Set("Authorization", "Bearer "+body["token"].(string))
+
+		_, err = s.Verify(req)
+		require.Error(t, err)
+	})
+}
+
+func TestServiceOIDC(t *testing.T) {
+	providerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// provider is a minimal stand-in for an OpenID Connect provider.
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   provider.URL,
+				"jwks_uri": provider.URL + "/keys",
+			})
+		case "/keys":
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &providerKey.PublicKey, KeyID: "a", Algorithm: "ES256", Use: "sig"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(provider.Close)
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": provider.URL,
+		"aud": "sindri",
+		"sub": "repo:frantjc/sindri:ref:refs/heads/main",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	idToken.Header["kid"] = "a"
+	rawIDToken, err := idToken.SignedString(providerKey)
+	require.NoError(t, err)
+
+	s := &auth.Service{
+		OIDC: []*auth.OIDCProvider{{Issuer: provider.URL, Audience: "sindri"}},
+		// NB: A static token whose subject is the same as the ID token's must not be mistaken for it.
+		Tokens: map[string]auth.StaticToken{"s3cr3t": {Username: "ci", Subject: "repo:frantjc/sindri:ref:refs/heads/main"}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/token", nil)
+	req.SetBasicAuth("github-actions", rawIDToken)
+
+	identity, err := s.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, &auth.Identity{
+		Subject: "oidc:" + provider.URL + ":repo:frantjc/sindri:ref:refs/heads/main",
+		Method:  auth.MethodOIDC,
+	}, identity)
+
+	rule := mustCompileGlobs(t, "oidc:"+provider.URL+":repo:frantjc/**")[0]
+	require.True(t, rule.Match(identity.Subject))
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/token", nil)
+	req.SetBasicAuth("ci", "s3cr3t")
+
+	identity, err = s.Authenticate(req)
+	require.NoError(t, err)
+	require.False(t, rule.Match(identity.Subject))
+}
+
+func mustCompileGlobs(t *testing.T, patterns ...string) []*auth.Glob {
+	t.Helper()
+
+	globs, err := auth.CompileGlobs(patterns)
+	require.NoError(t, err)
+
+	return globs
+}
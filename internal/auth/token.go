@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access is a resource and the actions on it that a token grants,
+// as in https://distribution.github.io/distribution/spec/auth/jwt/.
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+const (
+	ActionPull = "pull"
+)
+
+// Claims are the claims of a token issued by sindri.
+type Claims struct {
+	jwt.RegisteredClaims
+	Access []Access `json:"access"`
+	// Method is how the subject of the token authenticated to get it.
+	Method string `json:"method,omitempty"`
+}
+
+// Allows reports whether c grants action on the repository name.
+func (c *Claims) Allows(name, action string) bool {
+	for _, access := range c.Access {
+		if access.Type == "repository" && access.Name == name {
+			for _, a := range access.Actions {
+				if a == action {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Identity returns the *Identity that c was issued to, or nil if it was issued anonymously.
+func (c *Claims) Identity() *Identity {
+	if c.Subject == "" {
+		return nil
+	}
+
+	return &Identity{Subject: c.Subject, Method: c.Method}
+}
+
+type claimsContextKey struct{}
+
+// ClaimsInto returns a new context with *Claims stored in it.
+func ClaimsInto(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// ClaimsFrom returns the *Claims from the context, if any.
+func ClaimsFrom(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(*Claims)
+	return claims, ok && claims != nil
+}
+
+// ReadSigningKey reads a PEM-encoded RSA, ECDSA or Ed25519 private key from name.
+func ReadSigningKey(name string) (crypto.Signer, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", name)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T in %s", key, name)
+	}
+
+	return signer, nil
+}
+
+// GenerateSigningKey generates an ECDSA P-256 private key.
+func GenerateSigningKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func signingMethod(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+
+	return nil, fmt.Errorf("unsupported signing key type %T", key)
+}
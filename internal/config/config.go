@@ -0,0 +1,792 @@
+// Package config defines the configuration file for the sindri server.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/robfig/cron/v3"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// DefaultFile is where the configuration file is read from if one is not specified.
+	DefaultFile = filepath.Join(xdg.ConfigHome, "sindri", "config.yaml")
+	// DefaultCacheDir is where the default backend stores images.
+	DefaultCacheDir = filepath.Join(xdg.CacheHome, "sindri")
+	// DefaultBackendURL is the backend that is used if one is not specified.
+	DefaultBackendURL = fmt.Sprintf("file://%s", DefaultCacheDir)
+)
+
+// Config is the configuration for the sindri server.
+type Config struct {
+	Listeners Listeners `json:"listeners"`
+	Backend   Backend   `json:"backend"`
+	Module    Module    `json:"module"`
+	Engine    Engine    `json:"engine"`
+	Auth      Auth      `json:"auth"`
+	Policy    Policy    `json:"policy"`
+	Admin     Admin     `json:"admin"`
+	Metrics   Metrics   `json:"metrics"`
+	Failures  Failures  `json:"failures"`
+	Health    Health    `json:"health"`
+	Tags      Tags      `json:"tags"`
+	Rebuilds  []Rebuild `json:"rebuilds,omitempty"`
+	Webhooks  Webhooks  `json:"webhooks"`
+	Limits    Limits    `json:"limits"`
+	Logging   Logging   `json:"logging"`
+	Tracing   Tracing   `json:"tracing"`
+}
+
+// Listeners configures what sindri listens on.
+type Listeners struct {
+	// Registry is the listener that serves the OCI distribution API.
+	Registry Listener `json:"registry"`
+	// Admin, if its address is set, is the listener that serves the admin
+	// API and metrics instead of the registry listener. Requires admin.enabled
+	// or metrics.enabled.
+	Admin Listener `json:"admin"`
+}
+
+// Listener configures a single address for sindri to listen on.
+type Listener struct {
+	Addr string `json:"addr"`
+	TLS  TLS    `json:"tls,omitempty"`
+}
+
+// TLS configures TLS for a Listener.
+type TLS struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ClientCAFile is a bundle of CAs to verify client certificates with.
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	// ClientAuth is one of "none", "request" (verify client certificates
+	// if they are given) or "require" (require verified client certificates).
+	ClientAuth string `json:"clientAuth,omitempty"`
+}
+
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// Enabled reports whether TLS is configured.
+func (t *TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+func (t *TLS) validate(path string) []error {
+	var errs []error
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s: certFile and keyFile must be set together", path))
+	}
+
+	switch t.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequire:
+		if !t.Enabled() {
+			errs = append(errs, fmt.Errorf("%s.clientAuth: requires certFile and keyFile", path))
+		}
+
+		if t.ClientCAFile == "" {
+			errs = append(errs, fmt.Errorf("%s.clientAuth: requires clientCAFile", path))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.clientAuth: must be one of %s, %s, %s", path, ClientAuthNone, ClientAuthRequest, ClientAuthRequire))
+	}
+
+	return errs
+}
+
+// Backend configures the backend that sindri stores images in.
+type Backend struct {
+	// URL is the backend URL, e.g. "s3://<bucket>" or "registry://ghcr.io/<user>".
+	URL string `json:"url"`
+	// Params are added to URL's query, overriding any already in it.
+	Params map[string]string `json:"params,omitempty"`
+	// Username is the username to authenticate to the backend with, if applicable.
+	Username string `json:"username,omitempty"`
+	// PasswordFile is a file containing the password to authenticate to the backend with, if applicable.
+	PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+// Module configures the Dagger module that sindri builds images with.
+type Module struct {
+	// Dir is the directory containing the module. Defaults to the working directory.
+	Dir string `json:"dir,omitempty"`
+}
+
+// Engine configures sindri's sessions with Dagger engines.
+type Engine struct {
+	// Disabled makes sindri serve only what is already in the backend, resolving tags
+	// through its tag index and never connecting to an engine to build. Requires a
+	// backend that indexes tags.
+	Disabled bool `json:"disabled,omitempty"`
+	// Strategy is how builds are distributed across Pool: least-loaded,
+	// or consistent-hash to build each repository on the same engine.
+	Strategy string `json:"strategy,omitempty"`
+	// Pool is the engines to distribute builds across. Defaults to
+	// the single engine that the Dagger CLI would use.
+	Pool []EngineMember `json:"pool,omitempty"`
+	// ProbeInterval is how often the session is checked to be alive.
+	ProbeInterval Duration `json:"probeInterval,omitempty"`
+	// Backoff is how long to wait before reconnecting after the first failed attempt
+	// when the session dies, doubling with each failed attempt up to MaxBackoff.
+	Backoff Duration `json:"backoff,omitempty"`
+	// MaxBackoff is the longest to wait between attempts to reconnect.
+	MaxBackoff Duration `json:"maxBackoff,omitempty"`
+}
+
+const (
+	EngineStrategyLeastLoaded    = "least-loaded"
+	EngineStrategyConsistentHash = "consistent-hash"
+)
+
+// EngineMember is one of the engines in an engine pool.
+type EngineMember struct {
+	// Name identifies the engine in logs and metrics.
+	Name string `json:"name"`
+	// RunnerHost is where to reach the engine, e.g. tcp://dagger-0:1234.
+	RunnerHost string `json:"runnerHost"`
+	// MaxConcurrent is how many builds may run on the engine at once. Zero means no limit.
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+}
+
+// Auth configures how sindri authenticates clients and what they may pull.
+// When enabled, sindri issues tokens itself rather than deferring to the backend.
+type Auth struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Service is the name of the service that tokens are issued for. Defaults to "sindri".
+	Service string `json:"service,omitempty"`
+	// Realm is the URL of the token endpoint. Defaults to /v2/token on the requested host.
+	Realm string `json:"realm,omitempty"`
+	// TokenTTL is how long issued tokens are valid for.
+	TokenTTL Duration `json:"tokenTTL,omitempty"`
+	// SigningKeyFile is a PEM-encoded private key to sign tokens with. If not set, one
+	// is generated, so tokens are invalidated by restarts and not shared between replicas.
+	SigningKeyFile string `json:"signingKeyFile,omitempty"`
+	// HtpasswdFile authenticates clients by username and bcrypt-hashed password.
+	HtpasswdFile string `json:"htpasswdFile,omitempty"`
+	// Tokens authenticate clients that give them as their password.
+	Tokens []StaticToken `json:"tokens,omitempty"`
+	// OIDC authenticates clients that give an ID token from any of these providers as their password.
+	OIDC []OIDC `json:"oidc,omitempty"`
+	// Access grants pull access to repositories. If empty, authenticated
+	// clients may pull any repository and unauthenticated clients none.
+	Access []AccessRule `json:"access,omitempty"`
+}
+
+// StaticToken is a static token that authenticates a subject.
+type StaticToken struct {
+	Subject string `json:"subject"`
+	// Username is the username that the token must be given with. Defaults to Subject.
+	Username  string `json:"username,omitempty"`
+	TokenFile string `json:"tokenFile"`
+}
+
+// OIDC is an OpenID Connect provider whose ID tokens authenticate their subjects.
+type OIDC struct {
+	Issuer       string `json:"issuer"`
+	Audience     string `json:"audience"`
+	SubjectClaim string `json:"subjectClaim,omitempty"`
+}
+
+// AccessRule grants pull access to repositories.
+type AccessRule struct {
+	// Anonymous grants access to unauthenticated clients.
+	Anonymous bool `json:"anonymous,omitempty"`
+	// Subjects are globs matched against authenticated clients' subjects.
+	Subjects []string `json:"subjects,omitempty"`
+	// Repositories are globs matched against repository names, in which "*"
+	// matches within a path segment and "**" matches across path segments.
+	Repositories []string `json:"repositories"`
+}
+
+// Failures configures how long builds that failed are failed fast instead of retried.
+type Failures struct {
+	// Backoff is how long a build's first transient failure is remembered, doubling
+	// with each consecutive failure up to MaxBackoff. Zero disables remembering failures.
+	Backoff Duration `json:"backoff,omitempty"`
+	// MaxBackoff is the longest that a failure is remembered, and how long permanent failures are.
+	MaxBackoff Duration `json:"maxBackoff,omitempty"`
+	// PermanentErrors are regular expressions matched against the messages of errors
+	// that retrying will not fix, in addition to errors with PermanentStatusCodes.
+	PermanentErrors []string `json:"permanentErrors,omitempty"`
+	// PermanentStatusCodes are the status codes of errors that retrying will not fix.
+	PermanentStatusCodes []int `json:"permanentStatusCodes,omitempty"`
+}
+
+// Health configures the readiness checks served at /readyz.
+type Health struct {
+	// TTL is how long the result of each check is reused for.
+	TTL Duration `json:"ttl,omitempty"`
+	// Timeout limits how long each check may take.
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// Admin configures sindri's admin API, served under /admin/.
+type Admin struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Subjects are globs matched against authenticated clients' subjects, authenticated
+	// by auth or their verified client certificates, whose subjects are prefixed by
+	// "x509:", e.g. "x509:admin" for the common name "admin". Required if Enabled.
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+// Metrics configures sindri's Prometheus metrics, served at /metrics without authentication,
+// so they are best served on listeners.admin if the registry listener is public.
+type Metrics struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Repositories are globs matched against repository names. Requests and tag resolutions
+	// of matching repositories are labeled by their repository and others by "other",
+	// so that there are only so many series no matter what repositories clients ask for.
+	Repositories []string `json:"repositories,omitempty"`
+}
+
+// Policy decides which names and references clients may pull and build.
+// The first rule that matches a request decides whether it is allowed.
+type Policy struct {
+	// Default is "allow" or "deny" and applies when no rule matches. Defaults to "allow".
+	Default string       `json:"default,omitempty"`
+	Rules   []PolicyRule `json:"rules,omitempty"`
+}
+
+// PolicyRule allows or denies actions on names and references. Empty fields match anything.
+type PolicyRule struct {
+	// Effect is "allow" or "deny".
+	Effect string `json:"effect"`
+	// Actions are "pull" and/or "build". Building is resolving a tag by calling
+	// the module, as opposed to pulling what has already been built.
+	Actions []string `json:"actions,omitempty"`
+	// Anonymous makes the rule apply to unauthenticated clients.
+	Anonymous bool `json:"anonymous,omitempty"`
+	// Subjects are globs matched against authenticated clients' subjects.
+	Subjects []string `json:"subjects,omitempty"`
+	// Names are globs matched against repository names.
+	Names []string `json:"names,omitempty"`
+	// NameRegexps are regular expressions matched against entire repository names.
+	NameRegexps []string `json:"nameRegexps,omitempty"`
+	// References are globs matched against tags and digests of manifests. Rules with
+	// references or referenceRegexps never match pulls of blobs, which have no reference,
+	// so with a default of deny, blobs must be allowed by a rule without them.
+	References []string `json:"references,omitempty"`
+	// ReferenceRegexps are regular expressions matched against entire tags and digests of manifests.
+	ReferenceRegexps []string `json:"referenceRegexps,omitempty"`
+}
+
+const (
+	PolicyEffectAllow = "allow"
+	PolicyEffectDeny  = "deny"
+	PolicyActionPull  = "pull"
+	PolicyActionBuild = "build"
+)
+
+// Tags configures how long sindri trusts what it last built a tag as.
+type Tags struct {
+	// MaxAge is how long after a tag is built that pulls of it are served
+	// what it was built as instead of rebuilding it. Zero means always rebuild.
+	MaxAge Duration `json:"maxAge,omitempty"`
+	// StaleWhileRevalidate is how long after MaxAge that pulls of a tag are still
+	// served what it was built as, while it is rebuilt in the background. Pulls of
+	// tags older than that wait for the rebuild. Zero means always wait.
+	StaleWhileRevalidate Duration `json:"staleWhileRevalidate,omitempty"`
+}
+
+// Rebuild rebuilds images on a cron schedule, whether or not they are pulled, updating
+// the tags that they are served as. Each run's results are reported by the admin API.
+type Rebuild struct {
+	// Name identifies the rebuild in logs and the admin API.
+	Name string `json:"name"`
+	// Schedule is a cron expression, e.g. "0 3 * * *", or a descriptor, e.g. "@daily"
+	// or "@every 6h", of when to rebuild, optionally prefixed by e.g. "CRON_TZ=UTC ".
+	Schedule string `json:"schedule"`
+	// Images are the <name>:<reference>s to rebuild.
+	Images []string `json:"images,omitempty"`
+	// TopPulled is how many of the tags that have been pulled the most since
+	// sindri started to rebuild in addition to Images.
+	TopPulled int `json:"topPulled,omitempty"`
+}
+
+// Webhooks configures receiving push events, of branches and tags, from Git forges at
+// POST /webhooks/github, /webhooks/gitlab and /webhooks/gitea on the registry listener.
+// Each event affects the tags of the pushed branch or tag, and "latest" if it is the
+// default branch, of the repository's name and the names under it that have been
+// pulled since sindri started, e.g. github.com/org/repo and github.com/org/repo/path.
+type Webhooks struct {
+	// Action is what is done with the tags that an event affects: "rebuild" them in the
+	// background, or "invalidate" them so that their next pulls rebuild them. Either way,
+	// what they were stored as is no longer served. Defaults to rebuild.
+	Action string `json:"action,omitempty"`
+	// GitHubSecretFile is a file containing the secret that GitHub signs events with.
+	// If not set, events from GitHub are not accepted.
+	GitHubSecretFile string `json:"githubSecretFile,omitempty"`
+	// GitLabTokenFile is a file containing the secret token that GitLab sends with events.
+	// If not set, events from GitLab are not accepted.
+	GitLabTokenFile string `json:"gitlabTokenFile,omitempty"`
+	// GiteaSecretFile is a file containing the secret that Gitea signs events with.
+	// If not set, events from Gitea are not accepted.
+	GiteaSecretFile string `json:"giteaSecretFile,omitempty"`
+}
+
+const (
+	WebhookActionRebuild    = "rebuild"
+	WebhookActionInvalidate = "invalidate"
+)
+
+// Limits configures limits on requests to sindri.
+type Limits struct {
+	// ReadHeaderTimeout is how long sindri waits to read a request's headers.
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout,omitempty"`
+	// MaxHeaderBytes is the maximum size of a request's headers.
+	MaxHeaderBytes int `json:"maxHeaderBytes,omitempty"`
+	// BuildTimeout is how long a single build may take. Zero means no limit.
+	BuildTimeout Duration `json:"buildTimeout,omitempty"`
+	// Builds limits how many builds run at once.
+	Builds BuildLimits `json:"builds"`
+	// Rate limits how often each client may pull manifests by tag that build.
+	Rate RateLimit `json:"rate"`
+}
+
+// BuildLimits limits how many builds run at once. Clients are identified
+// by their authenticated subject, or otherwise their IP address. Builds that
+// cannot start yet are queued, authenticated clients' ahead of anonymous clients',
+// taking turns between repositories.
+type BuildLimits struct {
+	// MaxConcurrent is how many builds may run at once. Zero means no limit.
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// MaxConcurrentPerClient is how many builds each client may run at once. Zero means no limit.
+	MaxConcurrentPerClient int `json:"maxConcurrentPerClient,omitempty"`
+	// MaxQueued is how many builds may wait for others to finish before
+	// more are rejected with 429 TOOMANYREQUESTS. Zero means no limit.
+	MaxQueued int `json:"maxQueued,omitempty"`
+	// RetryAfter is how long rejected clients are told to wait before trying again.
+	RetryAfter Duration `json:"retryAfter,omitempty"`
+}
+
+// RateLimit limits how often each client may pull manifests by tag, with a token
+// bucket per client. Pulls by digest and of blobs are exempt.
+type RateLimit struct {
+	// RequestsPerSecond is how many requests each client may make per second on average. Zero means no limit.
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	// Burst is how many requests each client may make at once.
+	Burst int `json:"burst,omitempty"`
+}
+
+// Logging configures sindri's logs.
+type Logging struct {
+	// Level is one of "debug", "info", "warn" or "error".
+	Level string `json:"level,omitempty"`
+	// Format is one of "text" or "json".
+	Format string `json:"format,omitempty"`
+}
+
+// Tracing configures exporting OpenTelemetry traces over OTLP/HTTP. The standard
+// OTEL_EXPORTER_OTLP_* environment variables are honored for anything not set here.
+type Tracing struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g. http://localhost:4318.
+	Endpoint string `json:"endpoint,omitempty"`
+	// SampleRatio is the fraction of traces that are sampled unless a client's trace context
+	// says otherwise, from 0 to 1.
+	SampleRatio float64 `json:"sampleRatio,omitempty"`
+}
+
+// SlogLevel returns the slog.Level of l.Level.
+func (l *Logging) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	return level, level.UnmarshalText([]byte(l.Level))
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Listeners: Listeners{
+			Registry: Listener{
+				Addr: ":5000",
+			},
+		},
+		Backend: Backend{
+			URL: DefaultBackendURL,
+		},
+		Engine: Engine{
+			Strategy:      EngineStrategyLeastLoaded,
+			ProbeInterval: Duration(time.Second * 10),
+			Backoff:       Duration(time.Second),
+			MaxBackoff:    Duration(time.Minute),
+		},
+		Auth: Auth{
+			TokenTTL: Duration(time.Minute * 5),
+		},
+		Failures: Failures{
+			Backoff:              Duration(time.Second * 10),
+			MaxBackoff:           Duration(time.Minute * 10),
+			PermanentErrors:      []string{"invalid name"},
+			PermanentStatusCodes: []int{400, 404, 405, 410, 422},
+		},
+		Health: Health{
+			TTL:     Duration(time.Second * 5),
+			Timeout: Duration(time.Second * 5),
+		},
+		Webhooks: Webhooks{
+			Action: WebhookActionRebuild,
+		},
+		Limits: Limits{
+			ReadHeaderTimeout: Duration(time.Second * 5),
+			MaxHeaderBytes:    1 << 20,
+			Builds: BuildLimits{
+				MaxQueued:  64,
+				RetryAfter: Duration(time.Second * 10),
+			},
+			Rate: RateLimit{
+				Burst: 10,
+			},
+		},
+		Logging: Logging{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load reads the configuration file at name on top of the defaults and
+// then applies overrides from the environment. If name is the DefaultFile
+// and it does not exist, only the defaults and environment are used.
+func Load(name string) (*Config, error) {
+	cfg := Default()
+
+	if err := cfg.ReadFile(name); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || name != DefaultFile {
+			return nil, err
+		}
+	}
+
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ReadFile reads the YAML or JSON configuration file at name into c.
+func (c *Config) ReadFile(name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Unmarshal(b); err != nil {
+		return fmt.Errorf("parse %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Unmarshal reads YAML or JSON configuration into c, erroring on unknown fields.
+func (c *Config) Unmarshal(b []byte) error {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Marshal returns c as YAML.
+func (c *Config) Marshal() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// BackendURL returns c.Backend.URL with c.Backend's other fields applied to it.
+func (c *Config) BackendURL() (string, error) {
+	u, err := url.Parse(c.Backend.URL)
+	if err != nil {
+		return "", err
+	}
+
+	if len(c.Backend.Params) > 0 {
+		q := u.Query()
+		for k, v := range c.Backend.Params {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	if c.Backend.Username != "" || c.Backend.PasswordFile != "" {
+		username := c.Backend.Username
+		if username == "" {
+			username = u.User.Username()
+		}
+
+		if c.Backend.PasswordFile == "" {
+			u.User = url.User(username)
+		} else {
+			password, err := os.ReadFile(c.Backend.PasswordFile)
+			if err != nil {
+				return "", err
+			}
+
+			u.User = url.UserPassword(username, strings.TrimSpace(string(password)))
+		}
+	}
+
+	return u.String(), nil
+}
+
+// Validate returns an error describing everything wrong with c, if anything.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Listeners.Registry.Addr == "" {
+		errs = append(errs, fmt.Errorf("listeners.registry.addr: must be set"))
+	}
+
+	errs = append(errs, c.Listeners.Registry.TLS.validate("listeners.registry.tls")...)
+
+	if c.Admin.Enabled && len(c.Admin.Subjects) == 0 {
+		errs = append(errs, fmt.Errorf("admin.subjects: must not be empty when admin.enabled"))
+	}
+
+	if c.Listeners.Admin.Addr != "" {
+		if !c.Admin.Enabled && !c.Metrics.Enabled {
+			errs = append(errs, fmt.Errorf("listeners.admin.addr: requires admin.enabled or metrics.enabled"))
+		}
+
+		if c.Listeners.Admin.Addr == c.Listeners.Registry.Addr {
+			errs = append(errs, fmt.Errorf("listeners.admin.addr: must differ from listeners.registry.addr"))
+		}
+	}
+
+	errs = append(errs, c.Listeners.Admin.TLS.validate("listeners.admin.tls")...)
+
+	if u, err := url.Parse(c.Backend.URL); err != nil {
+		errs = append(errs, fmt.Errorf("backend.url: %w", err))
+	} else if u.Scheme == "" {
+		errs = append(errs, fmt.Errorf("backend.url: must have a scheme, e.g. %s", DefaultBackendURL))
+	}
+
+	if c.Module.Dir != "" {
+		if fi, err := os.Stat(c.Module.Dir); err != nil {
+			errs = append(errs, fmt.Errorf("module.dir: %w", err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("module.dir: %s is not a directory", c.Module.Dir))
+		}
+	}
+
+	if c.Engine.Strategy != EngineStrategyLeastLoaded && c.Engine.Strategy != EngineStrategyConsistentHash {
+		errs = append(errs, fmt.Errorf("engine.strategy: must be %s or %s", EngineStrategyLeastLoaded, EngineStrategyConsistentHash))
+	}
+
+	engineNames := map[string]bool{}
+	for i, member := range c.Engine.Pool {
+		if member.Name == "" || member.RunnerHost == "" {
+			errs = append(errs, fmt.Errorf("engine.pool[%d]: name and runnerHost must be set", i))
+		} else if engineNames[member.Name] {
+			errs = append(errs, fmt.Errorf("engine.pool[%d].name: duplicate name %q", i, member.Name))
+		}
+		engineNames[member.Name] = true
+
+		if member.MaxConcurrent < 0 {
+			errs = append(errs, fmt.Errorf("engine.pool[%d].maxConcurrent: must not be negative", i))
+		}
+	}
+
+	if c.Engine.ProbeInterval < 0 {
+		errs = append(errs, fmt.Errorf("engine.probeInterval: must not be negative"))
+	}
+
+	if c.Engine.Backoff < 0 {
+		errs = append(errs, fmt.Errorf("engine.backoff: must not be negative"))
+	}
+
+	if c.Engine.MaxBackoff < c.Engine.Backoff {
+		errs = append(errs, fmt.Errorf("engine.maxBackoff: must be at least engine.backoff"))
+	}
+
+	if c.Auth.Enabled {
+		if c.Auth.TokenTTL <= 0 {
+			errs = append(errs, fmt.Errorf("auth.tokenTTL: must be positive"))
+		}
+
+		for i, token := range c.Auth.Tokens {
+			if token.Subject == "" || token.TokenFile == "" {
+				errs = append(errs, fmt.Errorf("auth.tokens[%d]: subject and tokenFile must be set", i))
+			}
+		}
+
+		for i, oidc := range c.Auth.OIDC {
+			if oidc.Issuer == "" || oidc.Audience == "" {
+				errs = append(errs, fmt.Errorf("auth.oidc[%d]: issuer and audience must be set", i))
+			}
+		}
+
+		for i, rule := range c.Auth.Access {
+			if len(rule.Repositories) == 0 {
+				errs = append(errs, fmt.Errorf("auth.access[%d].repositories: must not be empty", i))
+			}
+
+			if !rule.Anonymous && len(rule.Subjects) == 0 {
+				errs = append(errs, fmt.Errorf("auth.access[%d]: must set anonymous or subjects", i))
+			}
+		}
+	}
+
+	if c.Policy.Default != "" && c.Policy.Default != PolicyEffectAllow && c.Policy.Default != PolicyEffectDeny {
+		errs = append(errs, fmt.Errorf("policy.default: must be %s or %s", PolicyEffectAllow, PolicyEffectDeny))
+	}
+
+	for i, rule := range c.Policy.Rules {
+		if rule.Effect != PolicyEffectAllow && rule.Effect != PolicyEffectDeny {
+			errs = append(errs, fmt.Errorf("policy.rules[%d].effect: must be %s or %s", i, PolicyEffectAllow, PolicyEffectDeny))
+		}
+
+		for _, action := range rule.Actions {
+			if !slices.Contains([]string{PolicyActionPull, PolicyActionBuild}, action) {
+				errs = append(errs, fmt.Errorf("policy.rules[%d].actions: unknown action %q", i, action))
+			}
+		}
+
+		for field, exprs := range map[string][]string{"nameRegexps": rule.NameRegexps, "referenceRegexps": rule.ReferenceRegexps} {
+			for _, expr := range exprs {
+				if _, err := regexp.Compile(expr); err != nil {
+					errs = append(errs, fmt.Errorf("policy.rules[%d].%s: %w", i, field, err))
+				}
+			}
+		}
+	}
+
+	if c.Failures.Backoff < 0 {
+		errs = append(errs, fmt.Errorf("failures.backoff: must not be negative"))
+	}
+
+	if c.Failures.MaxBackoff < c.Failures.Backoff {
+		errs = append(errs, fmt.Errorf("failures.maxBackoff: must be at least failures.backoff"))
+	}
+
+	for i, expr := range c.Failures.PermanentErrors {
+		if _, err := regexp.Compile(expr); err != nil {
+			errs = append(errs, fmt.Errorf("failures.permanentErrors[%d]: %w", i, err))
+		}
+	}
+
+	for i, code := range c.Failures.PermanentStatusCodes {
+		if code < 400 || code > 599 {
+			errs = append(errs, fmt.Errorf("failures.permanentStatusCodes[%d]: must be a 4xx or 5xx status code", i))
+		}
+	}
+
+	if c.Health.TTL < 0 {
+		errs = append(errs, fmt.Errorf("health.ttl: must not be negative"))
+	}
+
+	if c.Health.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("health.timeout: must not be negative"))
+	}
+
+	if c.Tags.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("tags.maxAge: must not be negative"))
+	}
+
+	if c.Tags.StaleWhileRevalidate < 0 {
+		errs = append(errs, fmt.Errorf("tags.staleWhileRevalidate: must not be negative"))
+	} else if c.Tags.StaleWhileRevalidate > 0 && c.Tags.MaxAge == 0 {
+		errs = append(errs, fmt.Errorf("tags.staleWhileRevalidate: requires tags.maxAge"))
+	}
+
+	rebuildNames := map[string]bool{}
+	for i, rebuild := range c.Rebuilds {
+		if rebuild.Name == "" {
+			errs = append(errs, fmt.Errorf("rebuilds[%d].name: must be set", i))
+		} else if rebuildNames[rebuild.Name] {
+			errs = append(errs, fmt.Errorf("rebuilds[%d].name: duplicate name %q", i, rebuild.Name))
+		}
+		rebuildNames[rebuild.Name] = true
+
+		if _, err := cron.ParseStandard(rebuild.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("rebuilds[%d].schedule: %w", i, err))
+		}
+
+		if rebuild.TopPulled < 0 {
+			errs = append(errs, fmt.Errorf("rebuilds[%d].topPulled: must not be negative", i))
+		} else if rebuild.TopPulled == 0 && len(rebuild.Images) == 0 {
+			errs = append(errs, fmt.Errorf("rebuilds[%d]: must set images or topPulled", i))
+		}
+
+		for j, image := range rebuild.Images {
+			if name, reference, ok := strings.Cut(image, ":"); !ok || name == "" || reference == "" {
+				errs = append(errs, fmt.Errorf("rebuilds[%d].images[%d]: %q is not <name>:<reference>", i, j, image))
+			}
+		}
+	}
+
+	if c.Webhooks.Action != WebhookActionRebuild && c.Webhooks.Action != WebhookActionInvalidate {
+		errs = append(errs, fmt.Errorf("webhooks.action: must be %s or %s", WebhookActionRebuild, WebhookActionInvalidate))
+	}
+
+	if c.Limits.ReadHeaderTimeout < 0 {
+		errs = append(errs, fmt.Errorf("limits.readHeaderTimeout: must not be negative"))
+	}
+
+	if c.Limits.MaxHeaderBytes < 0 {
+		errs = append(errs, fmt.Errorf("limits.maxHeaderBytes: must not be negative"))
+	}
+
+	if c.Limits.BuildTimeout < 0 {
+		errs = append(errs, fmt.Errorf("limits.buildTimeout: must not be negative"))
+	}
+
+	if c.Limits.Builds.MaxConcurrent < 0 || c.Limits.Builds.MaxConcurrentPerClient < 0 || c.Limits.Builds.MaxQueued < 0 {
+		errs = append(errs, fmt.Errorf("limits.builds: must not be negative"))
+	}
+
+	if c.Limits.Rate.RequestsPerSecond < 0 || c.Limits.Rate.Burst < 0 {
+		errs = append(errs, fmt.Errorf("limits.rate: must not be negative"))
+	}
+
+	if _, err := c.Logging.SlogLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %w", err))
+	}
+
+	switch c.Logging.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("logging.format: must be one of text, json"))
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sampleRatio: must be from 0 to 1"))
+	}
+
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: %w", err))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: must be an http or https URL"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,119 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvName(t *testing.T) {
+	require.Equal(t, "SINDRI_LISTENERS_REGISTRY_ADDR", config.EnvName("listeners.registry.addr"))
+	require.Equal(t, "SINDRI_LIMITS_READ_HEADER_TIMEOUT", config.EnvName("limits.readHeaderTimeout"))
+	require.Equal(t, "SINDRI_LISTENERS_REGISTRY_TLS_CERT_FILE", config.EnvName("listeners.registry.tls.certFile"))
+}
+
+func TestConfigUnmarshal(t *testing.T) {
+	cfg := config.Default()
+
+	require.NoError(t, cfg.Unmarshal([]byte(`
+listeners:
+  registry:
+    addr: :8080
+backend:
+  url: registry://ghcr.io/frantjc
+  params:
+    upstream_auth: "true"
+limits:
+  readHeaderTimeout: 10s
+`)))
+	require.Equal(t, ":8080", cfg.Listeners.Registry.Addr)
+	require.Equal(t, time.Second*10, cfg.Limits.ReadHeaderTimeout.Duration())
+	// Defaults are kept for anything not in the file.
+	require.Equal(t, 1<<20, cfg.Limits.MaxHeaderBytes)
+	require.NoError(t, cfg.Validate())
+
+	backendURL, err := cfg.BackendURL()
+	require.NoError(t, err)
+	require.Equal(t, "registry://ghcr.io/frantjc?upstream_auth=true", backendURL)
+
+	require.Error(t, cfg.Unmarshal([]byte(`listener: {}`)))
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	var (
+		cfg = config.Default()
+		env = map[string]string{
+			"SINDRI_LISTENERS_REGISTRY_ADDR":    ":8080",
+			"SINDRI_LIMITS_READ_HEADER_TIMEOUT": "10s",
+			"SINDRI_LIMITS_MAX_HEADER_BYTES":    "1024",
+			"SINDRI_BACKEND_PARAMS":             `{"use_signed_urls": "true"}`,
+		}
+	)
+
+	require.NoError(t, cfg.ApplyEnv(func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}))
+	require.Equal(t, ":8080", cfg.Listeners.Registry.Addr)
+	require.Equal(t, time.Second*10, cfg.Limits.ReadHeaderTimeout.Duration())
+	require.Equal(t, 1024, cfg.Limits.MaxHeaderBytes)
+	require.Equal(t, map[string]string{"use_signed_urls": "true"}, cfg.Backend.Params)
+
+	require.Error(t, cfg.ApplyEnv(func(key string) (string, bool) {
+		return "notaduration", key == "SINDRI_LIMITS_READ_HEADER_TIMEOUT"
+	}))
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Listeners.Registry.TLS.CertFile = "tls.crt"
+	cfg.Backend.URL = "/no/scheme"
+	cfg.Listeners.Registry.TLS.ClientAuth = "require"
+	cfg.Logging.Format = "xml"
+	cfg.Auth.Enabled = true
+	cfg.Auth.Access = []config.AccessRule{{Repositories: []string{"**"}}}
+	cfg.Policy.Rules = []config.PolicyRule{{Effect: "allow", Actions: []string{"push"}, NameRegexps: []string{"("}}}
+	cfg.Engine.Strategy = "round-robin"
+	cfg.Engine.Pool = []config.EngineMember{
+		{Name: "a", RunnerHost: "tcp://a:1234"},
+		{Name: "a", RunnerHost: "tcp://b:1234", MaxConcurrent: -1},
+	}
+	cfg.Webhooks.Action = "delete"
+	cfg.Admin.Enabled = true
+	cfg.Rebuilds = []config.Rebuild{
+		{Name: "nightly", Schedule: "0 3 * * *", Images: []string{"a"}},
+		{Name: "nightly", Schedule: "every day"},
+	}
+	cfg.Failures.PermanentStatusCodes = []int{404, 200}
+
+	err := cfg.Validate()
+	require.ErrorContains(t, err, "listeners.registry.tls.clientAuth: requires clientCAFile")
+	require.ErrorContains(t, err, "listeners.registry.tls")
+	require.ErrorContains(t, err, "backend.url")
+	require.ErrorContains(t, err, "logging.format")
+	require.ErrorContains(t, err, "auth.access[0]: must set anonymous or subjects")
+	require.ErrorContains(t, err, `policy.rules[0].actions: unknown action "push"`)
+	require.ErrorContains(t, err, "policy.rules[0].nameRegexps")
+	require.ErrorContains(t, err, "engine.strategy")
+	require.ErrorContains(t, err, `engine.pool[1].name: duplicate name "a"`)
+	require.ErrorContains(t, err, "engine.pool[1].maxConcurrent")
+	require.ErrorContains(t, err, `rebuilds[0].images[0]: "a" is not <name>:<reference>`)
+	require.ErrorContains(t, err, `rebuilds[1].name: duplicate name "nightly"`)
+	require.ErrorContains(t, err, "rebuilds[1].schedule")
+	require.ErrorContains(t, err, "rebuilds[1]: must set images or topPulled")
+	require.ErrorContains(t, err, "webhooks.action")
+	require.ErrorContains(t, err, "admin.subjects: must not be empty when admin.enabled")
+	require.ErrorContains(t, err, "failures.permanentStatusCodes[1]")
+}
+
+func TestConfigValidateAdminListener(t *testing.T) {
+	cfg := config.Default()
+	cfg.Listeners.Admin.Addr = "127.0.0.1:9090"
+	require.ErrorContains(t, cfg.Validate(), "listeners.admin.addr: requires admin.enabled or metrics.enabled")
+
+	// Metrics can be served on the admin listener without the admin API.
+	cfg.Metrics.Enabled = true
+	require.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"sigs.k8s.io/yaml"
+)
+
+// EnvPrefix prefixes the environment variables that override configuration.
+const EnvPrefix = "SINDRI_"
+
+// EnvName returns the name of the environment variable that overrides
+// the field at the given JSON path, e.g. "listeners.registry.addr"
+// is overridden by SINDRI_LISTENERS_REGISTRY_ADDR.
+func EnvName(path string) string {
+	var sb strings.Builder
+
+	sb.WriteString(EnvPrefix)
+	for i, r := range path {
+		switch {
+		case r == '.':
+			sb.WriteRune('_')
+		case unicode.IsUpper(r) && i > 0 && path[i-1] != '.':
+			sb.WriteRune('_')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(unicode.ToUpper(r))
+		}
+	}
+
+	return sb.String()
+}
+
+// ApplyEnv overrides each of c's fields that has a corresponding
+// environment variable (see EnvName) that is set according to lookupEnv.
+func (c *Config) ApplyEnv(lookupEnv func(string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), "", lookupEnv)
+}
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+func applyEnv(v reflect.Value, path string, lookupEnv func(string) (string, bool)) error {
+	if path != "" {
+		if s, ok := lookupEnv(EnvName(path)); ok {
+			if err := setFromEnv(v, s); err != nil {
+				return fmt.Errorf("%s: %w", EnvName(path), err)
+			}
+			return nil
+		}
+	}
+
+	if v.Kind() != reflect.Struct || reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		return nil
+	}
+
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		if path != "" {
+			name = path + "." + name
+		}
+
+		if err := applyEnv(v.Field(i), name, lookupEnv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setFromEnv(v reflect.Value, s string) error {
+	if tu, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return tu.UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Map, reflect.Slice, reflect.Struct, reflect.Pointer:
+		// NB: Complex values are given as YAML or JSON.
+		return yaml.Unmarshal([]byte(s), v.Addr().Interface())
+	default:
+		return fmt.Errorf("cannot set %s from the environment", v.Kind())
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+// Package distribution validates names and references as defined by the
+// OCI distribution specification (https://github.com/opencontainers/distribution-spec/blob/main/spec.md).
+package distribution
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// MaxNameLength is the maximum length of a name. Many clients impose a limit of 255
+	// characters on the registry's host plus the name, so this is as lenient as can be.
+	MaxNameLength = 255
+	// MaxTagLength is the maximum length of a tag.
+	MaxTagLength = 128
+)
+
+var (
+	// NameRegexp matches the <name> of a repository.
+	NameRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	// TagRegexp matches a tag.
+	TagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+var (
+	// ErrNameInvalid is returned for names that do not match NameRegexp or are too long.
+	ErrNameInvalid = errors.New("invalid repository name")
+	// ErrTagInvalid is returned for tags that do not match TagRegexp.
+	ErrTagInvalid = errors.New("invalid tag")
+	// ErrDigestInvalid is returned for references that look like digests but are not valid ones.
+	ErrDigestInvalid = errors.New("invalid digest")
+)
+
+// ValidateName returns an error wrapping ErrNameInvalid if name is not a valid repository name.
+func ValidateName(name string) error {
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrNameInvalid, MaxNameLength)
+	}
+
+	if !NameRegexp.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrNameInvalid, name)
+	}
+
+	return nil
+}
+
+// ValidateTag returns an error wrapping ErrTagInvalid if tag is not a valid tag.
+func ValidateTag(tag string) error {
+	if !TagRegexp.MatchString(tag) {
+		return fmt.Errorf("%w: %q", ErrTagInvalid, tag)
+	}
+
+	return nil
+}
+
+// ValidateDigest returns an error wrapping ErrDigestInvalid if d is not a valid digest.
+func ValidateDigest(d string) error {
+	if err := digest.Digest(d).Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrDigestInvalid, err)
+	}
+
+	return nil
+}
+
+// ValidateReference returns an error if reference is neither a valid tag nor a valid digest.
+// References containing ":" are validated as digests, since tags cannot contain it.
+func ValidateReference(reference string) error {
+	if strings.Contains(reference, ":") {
+		return ValidateDigest(reference)
+	}
+
+	return ValidateTag(reference)
+}
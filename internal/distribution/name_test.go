@@ -0,0 +1,122 @@
+package distribution_test
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/frantjc/sindri/internal/distribution"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{
+		"corekeeper",
+		"go-1.25",
+		"github.com/frantjc/sindri/testdata",
+		"a__b/c--d/e.f_g",
+		strings.Repeat("a", distribution.MaxNameLength),
+	} {
+		require.NoError(t, distribution.ValidateName(name), name)
+	}
+
+	for _, name := range []string{
+		"",
+		"Corekeeper",
+		"../etc/passwd",
+		"a/../b",
+		"a//b",
+		"/a",
+		"a/",
+		"a..b",
+		"a___b",
+		"-a",
+		"a b",
+		strings.Repeat("a", distribution.MaxNameLength+1),
+	} {
+		require.ErrorIs(t, distribution.ValidateName(name), distribution.ErrNameInvalid, name)
+	}
+}
+
+func TestValidateReference(t *testing.T) {
+	for _, reference := range []string{
+		"latest",
+		"v1.2.3",
+		"_",
+		strings.Repeat("a", distribution.MaxTagLength),
+		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	} {
+		require.NoError(t, distribution.ValidateReference(reference), reference)
+	}
+
+	for _, reference := range []string{
+		"",
+		".hidden",
+		"-v1",
+		"v1/v2",
+		strings.Repeat("a", distribution.MaxTagLength+1),
+	} {
+		require.ErrorIs(t, distribution.ValidateReference(reference), distribution.ErrTagInvalid, reference)
+	}
+
+	for _, reference := range []string{
+		"sha256:",
+		"sha256:abc",
+		"md5:d41d8cd98f00b204e9800998ecf8427e",
+	} {
+		require.ErrorIs(t, distribution.ValidateReference(reference), distribution.ErrDigestInvalid, reference)
+	}
+}
+
+func FuzzValidateName(f *testing.F) {
+	for _, seed := range []string{
+		"corekeeper",
+		"github.com/frantjc/sindri/testdata",
+		"a__b/c--d",
+		"../a",
+		"A/b",
+		"a//b",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		if distribution.ValidateName(name) != nil {
+			return
+		}
+
+		// Names that are valid must be safe to use as paths and keys in every backend.
+		require.LessOrEqual(t, len(name), distribution.MaxNameLength)
+		require.False(t, strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/"))
+		for _, segment := range strings.Split(name, "/") {
+			require.NotEmpty(t, segment)
+			require.NotEqual(t, ".", segment)
+			require.NotEqual(t, "..", segment)
+		}
+		require.NotContains(t, name, "..")
+		for _, r := range name {
+			require.False(t, unicode.IsUpper(r) || r > unicode.MaxASCII || unicode.IsSpace(r))
+		}
+	})
+}
+
+func FuzzValidateReference(f *testing.F) {
+	for _, seed := range []string{
+		"latest",
+		"v1.2.3",
+		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"../latest",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, reference string) {
+		if distribution.ValidateReference(reference) != nil {
+			return
+		}
+
+		require.NotContains(t, reference, "/")
+		require.NotEqual(t, ".", reference)
+		require.NotEqual(t, "..", reference)
+	})
+}
@@ -0,0 +1,303 @@
+// Package engine manages sindri's sessions with Dagger engines.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/logutil"
+)
+
+// ErrUnavailable is wrapped by errors for builds that could not run or were
+// interrupted because there was no live session with the Dagger engine.
+var ErrUnavailable = errors.New("dagger engine unavailable")
+
+// UnavailableError is returned for builds that could not run or were interrupted
+// because there was no live session with the Dagger engine. They may be retried
+// once the session is reestablished.
+type UnavailableError struct {
+	Err error
+	// RetryAfter is how long until the session may be reestablished.
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e *UnavailableError) Error() string {
+	if e.Err == nil {
+		return ErrUnavailable.Error()
+	}
+
+	return fmt.Sprintf("%s: %s", ErrUnavailable, e.Err)
+}
+
+// Is makes errors.Is(err, ErrUnavailable) report true for *UnavailableErrors.
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// Unwrap returns the error that interrupted the build, if any.
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Lease is a build's hold on a session with a Dagger engine.
+type Lease struct {
+	// Client is the client of the session to build with.
+	Client *dagger.Client
+	// Engine names the engine that the session is with, if it is one of a Pool's.
+	Engine string
+
+	conn    *Conn
+	release func()
+}
+
+// Release releases l and returns the error that a build with it that failed with
+// err should report: an *UnavailableError if its session has died, or err as-is.
+// Leases that did not come from a Conn always report err as-is.
+func (l *Lease) Release(ctx context.Context, err error) error {
+	if l.conn != nil {
+		err = l.conn.Failed(ctx, l.Client, err)
+	}
+	if l.release != nil {
+		l.release()
+	}
+
+	return err
+}
+
+// Probe returns an error if dag's session is dead. It queries the engine's default platform.
+func Probe(ctx context.Context, dag *dagger.Client) error {
+	_, err := dag.DefaultPlatform(ctx)
+	return err
+}
+
+var (
+	probe       = Probe
+	closeClient = (*dagger.Client).Close
+)
+
+// Conn is a supervised session with a Dagger engine. It probes the session
+// periodically and, when it dies, reconnects with exponential backoff and
+// swaps in the new client for subsequent builds.
+type Conn struct {
+	// Connect opens a new session.
+	Connect func(context.Context) (*dagger.Client, error)
+	// ProbeInterval is how often the session is probed. Zero means 10 seconds.
+	ProbeInterval time.Duration
+	// ProbeTimeout limits how long each probe may take. Zero means 5 seconds.
+	ProbeTimeout time.Duration
+	// Backoff is how long to wait before reconnecting after the first failed
+	// attempt, doubling after each one up to MaxBackoff. Zero means 1 second.
+	Backoff time.Duration
+	// MaxBackoff is the longest to wait between attempts to reconnect. Zero means 1 minute.
+	MaxBackoff time.Duration
+
+	client  atomic.Pointer[dagger.Client]
+	backoff atomic.Int64
+	lost    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.lost = make(chan struct{}, 1)
+	})
+}
+
+// Open opens the first session.
+func (c *Conn) Open(ctx context.Context) error {
+	c.init()
+
+	dag, err := c.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.client.Store(dag)
+	return nil
+}
+
+// Client returns the client of the live session, or an *UnavailableError if there is none.
+func (c *Conn) Client() (*dagger.Client, error) {
+	if dag := c.client.Load(); dag != nil {
+		return dag, nil
+	}
+
+	return nil, &UnavailableError{RetryAfter: c.retryAfter()}
+}
+
+// Acquire returns a Lease on the live session, or an *UnavailableError if there is none.
+// Builds of any name share the session.
+func (c *Conn) Acquire(_ context.Context, _ string) (*Lease, error) {
+	dag, err := c.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Lease{Client: dag, conn: c}, nil
+}
+
+// Up reports whether there is a live session.
+func (c *Conn) Up() bool {
+	return c.client.Load() != nil
+}
+
+// Failed returns an *UnavailableError wrapping err, which a build with dag failed with,
+// if dag's session has died since Client returned it, or err as-is otherwise. If dag is
+// still the live session's client, it is probed to find out.
+func (c *Conn) Failed(ctx context.Context, dag *dagger.Client, err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	if c.client.Load() == dag {
+		probeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.probeTimeout())
+		defer cancel()
+
+		perr := probe(probeCtx, dag)
+		if perr == nil {
+			return err
+		}
+
+		logutil.SloggerFrom(ctx).Warn("dagger session lost", "err", perr.Error())
+		c.markLost(dag)
+	}
+
+	return &UnavailableError{Err: err, RetryAfter: c.retryAfter()}
+}
+
+// retryAfter returns how long until a lost session may be reestablished.
+func (c *Conn) retryAfter() time.Duration {
+	return max(time.Duration(c.backoff.Load()), time.Second)
+}
+
+// markLost stops handing out dag and wakes Supervise to reconnect.
+func (c *Conn) markLost(dag *dagger.Client) {
+	c.init()
+
+	if c.client.CompareAndSwap(dag, nil) {
+		select {
+		case c.lost <- struct{}{}:
+		default:
+		}
+
+		// NB: Builds in flight with dag are already failing, so don't wait on them.
+		go func() {
+			_ = closeClient(dag)
+		}()
+	}
+}
+
+// Supervise probes the session every c.ProbeInterval and reconnects
+// whenever it dies, until ctx is done.
+func (c *Conn) Supervise(ctx context.Context) error {
+	c.init()
+
+	var (
+		log          = logutil.SloggerFrom(ctx)
+		probeTicker  = time.NewTicker(c.probeInterval())
+		probeTimeout = c.probeTimeout()
+	)
+	defer probeTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-probeTicker.C:
+			if dag := c.client.Load(); dag != nil {
+				probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+				err := probe(probeCtx, dag)
+				cancel()
+
+				if err == nil || ctx.Err() != nil {
+					continue
+				}
+
+				log.Warn("dagger session lost", "err", err.Error())
+				c.markLost(dag)
+			}
+		case <-c.lost:
+		}
+
+		if err := c.reconnect(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// reconnect opens new sessions with exponential backoff until one succeeds or ctx is done.
+func (c *Conn) reconnect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client.Load() != nil {
+		return nil
+	}
+
+	var (
+		log        = logutil.SloggerFrom(ctx)
+		backoff    = c.Backoff
+		maxBackoff = c.MaxBackoff
+	)
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+	defer c.backoff.Store(0)
+
+	for attempt := 1; ; attempt++ {
+		dag, err := c.Connect(ctx)
+		if err == nil {
+			c.client.Store(dag)
+			log.Info("dagger session reestablished", "attempt", attempt)
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Warn("reconnecting to dagger", "attempt", attempt, "backoff", backoff, "err", err.Error())
+		c.backoff.Store(int64(backoff))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// Close closes the live session, if any.
+func (c *Conn) Close() error {
+	if dag := c.client.Swap(nil); dag != nil {
+		return closeClient(dag)
+	}
+
+	return nil
+}
+
+func (c *Conn) probeInterval() time.Duration {
+	if c.ProbeInterval <= 0 {
+		return time.Second * 10
+	}
+
+	return c.ProbeInterval
+}
+
+func (c *Conn) probeTimeout() time.Duration {
+	if c.ProbeTimeout <= 0 {
+		return time.Second * 5
+	}
+
+	return c.ProbeTimeout
+}
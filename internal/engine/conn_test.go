@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSessions stands in for Dagger sessions, each of which is alive until it is killed.
+type fakeSessions struct {
+	mu       sync.Mutex
+	dead     map[*dagger.Client]bool
+	closed   map[*dagger.Client]bool
+	failures atomic.Int32
+}
+
+func newFakeSessions(t *testing.T) *fakeSessions {
+	s := &fakeSessions{
+		dead:   map[*dagger.Client]bool{},
+		closed: map[*dagger.Client]bool{},
+	}
+
+	prevProbe, prevCloseClient := probe, closeClient
+	probe = func(_ context.Context, dag *dagger.Client) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.dead[dag] {
+			return errors.New("session dead")
+		}
+		return nil
+	}
+	closeClient = func(dag *dagger.Client) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.closed[dag] = true
+		return nil
+	}
+	t.Cleanup(func() {
+		probe, closeClient = prevProbe, prevCloseClient
+	})
+
+	return s
+}
+
+func (s *fakeSessions) connect(context.Context) (*dagger.Client, error) {
+	if s.failures.Add(-1) >= 0 {
+		return nil, errors.New("engine unreachable")
+	}
+
+	return new(dagger.Client), nil
+}
+
+func (s *fakeSessions) kill(dag *dagger.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dead[dag] = true
+}
+
+func (s *fakeSessions) isClosed(dag *dagger.Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed[dag]
+}
+
+func TestConnFailed(t *testing.T) {
+	var (
+		sessions = newFakeSessions(t)
+		c        = &Conn{Connect: sessions.connect, ProbeInterval: time.Hour, Backoff: time.Millisecond}
+		buildErr = errors.New("build failed")
+	)
+	require.NoError(t, c.Open(t.Context()))
+
+	first, err := c.Client()
+	require.NoError(t, err)
+
+	// Builds that fail while the session is alive failed on their own.
+	require.Equal(t, buildErr, c.Failed(t.Context(), first, buildErr))
+	require.ErrorIs(t, c.Failed(t.Context(), first, context.Canceled), context.Canceled)
+
+	// Builds that fail because the session died are retryable.
+	sessions.kill(first)
+	sessions.failures.Store(2)
+
+	err = c.Failed(t.Context(), first, buildErr)
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.ErrorIs(t, err, buildErr)
+
+	_, err = c.Client()
+	uerr := &UnavailableError{}
+	require.ErrorAs(t, err, &uerr)
+	require.Eventually(t, func() bool {
+		return sessions.isClosed(first)
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	supervised := make(chan error, 1)
+	go func() {
+		supervised <- c.Supervise(ctx)
+	}()
+
+	var second *dagger.Client
+	require.Eventually(t, func() bool {
+		second, err = c.Client()
+		return err == nil
+	}, time.Second, time.Millisecond)
+	require.NotSame(t, first, second)
+	require.Less(t, sessions.failures.Load(), int32(0))
+
+	// Builds with a lost session's client are retryable, too.
+	require.ErrorIs(t, c.Failed(t.Context(), first, buildErr), ErrUnavailable)
+
+	cancel()
+	require.ErrorIs(t, <-supervised, context.Canceled)
+}
+
+func TestConnSupervise(t *testing.T) {
+	var (
+		sessions = newFakeSessions(t)
+		c        = &Conn{Connect: sessions.connect, ProbeInterval: time.Millisecond, Backoff: time.Millisecond}
+	)
+	require.NoError(t, c.Open(t.Context()))
+
+	first, err := c.Client()
+	require.NoError(t, err)
+
+	supervised := make(chan error, 1)
+	go func() {
+		supervised <- c.Supervise(t.Context())
+	}()
+	t.Cleanup(func() {
+		<-supervised
+	})
+
+	sessions.kill(first)
+
+	require.Eventually(t, func() bool {
+		dag, err := c.Client()
+		return err == nil && dag != first
+	}, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		return sessions.isClosed(first)
+	}, time.Second, time.Millisecond)
+}
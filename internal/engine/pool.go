@@ -0,0 +1,376 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Strategy is how a Pool chooses the engine that each build runs on.
+type Strategy string
+
+const (
+	// StrategyLeastLoaded runs each build on the engine that is running the
+	// smallest fraction of the builds that it may run at once.
+	StrategyLeastLoaded Strategy = "least-loaded"
+	// StrategyConsistentHash runs each build on an engine chosen by hashing its
+	// name, so that builds of the same name reuse the same engine's layer cache,
+	// falling back to the next engine on the hash ring if it is busy or unhealthy.
+	StrategyConsistentHash Strategy = "consistent-hash"
+)
+
+// virtualNodes is how many points on the hash ring each engine has,
+// so that names are spread evenly across engines.
+const virtualNodes = 64
+
+// Member is one of a Pool's engines.
+type Member struct {
+	// Name identifies the engine, e.g. in logs and metrics.
+	Name string
+	// Conn is the supervised session with the engine.
+	Conn *Conn
+	// MaxConcurrent is how many builds may run on the engine at once. Zero means no limit.
+	MaxConcurrent int
+}
+
+type point struct {
+	hash   uint64
+	member *Member
+}
+
+// Pool distributes builds across several Dagger engines, limiting how many run on
+// each one at once. Engines without a live session are drained: no builds are
+// started on them until they reconnect. Builds wait for an engine if every healthy
+// one is busy.
+type Pool struct {
+	Members  []*Member
+	Strategy Strategy
+
+	mu       sync.Mutex
+	running  map[*Member]int
+	ring     []point
+	released chan struct{}
+	once     sync.Once
+	up       *prometheus.Desc
+	builds   *prometheus.Desc
+}
+
+func (p *Pool) init() {
+	p.once.Do(func() {
+		p.running = map[*Member]int{}
+		p.released = make(chan struct{})
+
+		for _, m := range p.Members {
+			for i := range virtualNodes {
+				p.ring = append(p.ring, point{hash: hash(fmt.Sprintf("%s#%d", m.Name, i)), member: m})
+			}
+		}
+		slices.SortFunc(p.ring, func(a, b point) int {
+			if a.hash < b.hash {
+				return -1
+			} else if a.hash > b.hash {
+				return 1
+			}
+			return 0
+		})
+
+		p.up = prometheus.NewDesc(
+			"sindri_dagger_up",
+			"Whether sindri has a live session with each Dagger engine.",
+			[]string{"engine"}, nil,
+		)
+		p.builds = prometheus.NewDesc(
+			"sindri_dagger_builds_running",
+			"Builds running on each Dagger engine.",
+			[]string{"engine"}, nil,
+		)
+	})
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// Open opens a session with each engine. Engines that cannot be reached are
+// left to Supervise to reconnect to; it only fails if none can be reached.
+func (p *Pool) Open(ctx context.Context) error {
+	p.init()
+
+	var (
+		log  = logutil.SloggerFrom(ctx)
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, m := range p.Members {
+		wg.Go(func() {
+			if err := m.Conn.Open(ctx); err != nil {
+				log.Warn("connecting to dagger", "engine", m.Name, "err", err.Error())
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				errs = append(errs, fmt.Errorf("engine %s: %w", m.Name, err))
+			}
+		})
+	}
+	wg.Wait()
+
+	if len(errs) == len(p.Members) {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// Supervise supervises each engine's session until ctx is done.
+func (p *Pool) Supervise(ctx context.Context) error {
+	var (
+		log = logutil.SloggerFrom(ctx)
+		wg  sync.WaitGroup
+	)
+	for _, m := range p.Members {
+		wg.Go(func() {
+			_ = m.Conn.Supervise(logutil.SloggerInto(ctx, log.With("engine", m.Name)))
+		})
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// Acquire returns a Lease on the session of the engine chosen by p.Strategy to build
+// name with, waiting until one is not busy. It returns an *UnavailableError if no
+// engine has a live session.
+func (p *Pool) Acquire(ctx context.Context, name string) (*Lease, error) {
+	p.init()
+
+	waiting := false
+	for {
+		p.mu.Lock()
+
+		var (
+			candidates = p.candidates(name)
+			healthy    = false
+		)
+		for _, m := range candidates {
+			dag, err := m.Conn.Client()
+			if err != nil {
+				continue
+			}
+			healthy = true
+
+			if m.MaxConcurrent > 0 && p.running[m] >= m.MaxConcurrent {
+				continue
+			}
+
+			p.running[m]++
+			p.mu.Unlock()
+
+			return &Lease{
+				Client: dag,
+				Engine: m.Name,
+				conn:   m.Conn,
+				release: sync.OnceFunc(func() {
+					p.release(m)
+				}),
+			}, nil
+		}
+
+		released := p.released
+		p.mu.Unlock()
+
+		if !healthy {
+			return nil, &UnavailableError{RetryAfter: p.retryAfter()}
+		}
+
+		if !waiting {
+			logutil.SloggerFrom(ctx).Info("waiting for a dagger engine")
+			waiting = true
+		}
+
+		// NB: Also check periodically in case an engine reconnects.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// candidates returns p's members in the order that they should be tried in to build name.
+func (p *Pool) candidates(name string) []*Member {
+	switch p.Strategy {
+	case StrategyConsistentHash:
+		var (
+			h    = hash(name)
+			i, _ = slices.BinarySearchFunc(p.ring, h, func(pt point, h uint64) int {
+				if pt.hash < h {
+					return -1
+				} else if pt.hash > h {
+					return 1
+				}
+				return 0
+			})
+			candidates = make([]*Member, 0, len(p.Members))
+		)
+		for j := range p.ring {
+			m := p.ring[(i+j)%len(p.ring)].member
+			if !slices.Contains(candidates, m) {
+				candidates = append(candidates, m)
+			}
+		}
+
+		return candidates
+	default:
+		candidates := slices.Clone(p.Members)
+		slices.SortStableFunc(candidates, func(a, b *Member) int {
+			if la, lb := p.load(a), p.load(b); la < lb {
+				return -1
+			} else if la > lb {
+				return 1
+			}
+			return p.running[a] - p.running[b]
+		})
+
+		return candidates
+	}
+}
+
+// load returns the fraction of the builds that m may run at once that it is running.
+func (p *Pool) load(m *Member) float64 {
+	if m.MaxConcurrent <= 0 {
+		return 0
+	}
+
+	return float64(p.running[m]) / float64(m.MaxConcurrent)
+}
+
+func (p *Pool) release(m *Member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running[m]--
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// retryAfter returns how long until the first engine may reconnect.
+func (p *Pool) retryAfter() time.Duration {
+	var retryAfter time.Duration
+	for i, m := range p.Members {
+		if r := m.Conn.retryAfter(); i == 0 || r < retryAfter {
+			retryAfter = r
+		}
+	}
+
+	return retryAfter
+}
+
+// Check returns an error if no engine's session responds.
+func (p *Pool) Check(ctx context.Context) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, m := range p.Members {
+		wg.Go(func() {
+			err := ErrUnavailable
+			if dag, cerr := m.Conn.Client(); cerr == nil {
+				err = probe(ctx, dag)
+			}
+
+			if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+
+				errs = append(errs, fmt.Errorf("engine %s: %w", m.Name, err))
+			}
+		})
+	}
+	wg.Wait()
+
+	if len(errs) == len(p.Members) {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// MemberStatus describes one of a Pool's engines.
+type MemberStatus struct {
+	Name          string `json:"name"`
+	Up            bool   `json:"up"`
+	Running       int    `json:"running"`
+	MaxConcurrent int    `json:"maxConcurrent,omitempty"`
+}
+
+// Status describes each of p's engines.
+func (p *Pool) Status() []MemberStatus {
+	statuses := []MemberStatus{}
+	if p == nil {
+		return statuses
+	}
+
+	p.init()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range p.Members {
+		statuses = append(statuses, MemberStatus{
+			Name:          m.Name,
+			Up:            m.Conn.Up(),
+			Running:       p.running[m],
+			MaxConcurrent: m.MaxConcurrent,
+		})
+	}
+
+	return statuses
+}
+
+// Close closes each engine's session.
+func (p *Pool) Close() error {
+	var errs []error
+	for _, m := range p.Members {
+		if err := m.Conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Describe implements prometheus.Collector.
+func (p *Pool) Describe(ch chan<- *prometheus.Desc) {
+	p.init()
+
+	ch <- p.up
+	ch <- p.builds
+}
+
+// Collect implements prometheus.Collector.
+func (p *Pool) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range p.Status() {
+		up := 0.0
+		if status.Up {
+			up = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(p.up, prometheus.GaugeValue, up, status.Name)
+		ch <- prometheus.MustNewConstMetric(p.builds, prometheus.GaugeValue, float64(status.Running), status.Name)
+	}
+}
+
+var _ prometheus.Collector = new(Pool)
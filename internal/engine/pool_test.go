@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPool(t *testing.T, strategy Strategy, maxConcurrent ...int) (*Pool, *fakeSessions) {
+	var (
+		sessions = newFakeSessions(t)
+		pool     = &Pool{Strategy: strategy}
+	)
+	for i, n := range maxConcurrent {
+		pool.Members = append(pool.Members, &Member{
+			Name:          fmt.Sprintf("engine-%d", i),
+			Conn:          &Conn{Connect: sessions.connect, ProbeInterval: time.Hour, Backoff: time.Millisecond},
+			MaxConcurrent: n,
+		})
+	}
+	require.NoError(t, pool.Open(t.Context()))
+
+	return pool, sessions
+}
+
+func TestPoolLeastLoaded(t *testing.T) {
+	pool, _ := newTestPool(t, StrategyLeastLoaded, 2, 2)
+
+	first, err := pool.Acquire(t.Context(), "a")
+	require.NoError(t, err)
+	second, err := pool.Acquire(t.Context(), "a")
+	require.NoError(t, err)
+	require.NotEqual(t, first.Engine, second.Engine)
+
+	third, err := pool.Acquire(t.Context(), "a")
+	require.NoError(t, err)
+	_, err = pool.Acquire(t.Context(), "a")
+	require.NoError(t, err)
+
+	// Every engine is busy, so builds wait for one to be released.
+	acquired := make(chan *Lease)
+	go func() {
+		lease, err := pool.Acquire(t.Context(), "a")
+		if err == nil {
+			acquired <- lease
+		}
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired a lease on a busy engine")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	require.NoError(t, third.Release(t.Context(), nil))
+	require.Equal(t, third.Engine, (<-acquired).Engine)
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond*10)
+	defer cancel()
+
+	_, err = pool.Acquire(ctx, "a")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	pool, sessions := newTestPool(t, StrategyConsistentHash, 1, 1, 1)
+
+	engines := map[string]string{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		lease, err := pool.Acquire(t.Context(), name)
+		require.NoError(t, err)
+		engines[name] = lease.Engine
+		require.NoError(t, lease.Release(t.Context(), nil))
+
+		// The same name is built on the same engine.
+		lease, err = pool.Acquire(t.Context(), name)
+		require.NoError(t, err)
+		require.Equal(t, engines[name], lease.Engine)
+		require.NoError(t, lease.Release(t.Context(), nil))
+	}
+
+	// Builds fall back to the next engine when theirs is busy.
+	busy, err := pool.Acquire(t.Context(), "a")
+	require.NoError(t, err)
+
+	lease, err := pool.Acquire(t.Context(), "a")
+	require.NoError(t, err)
+	require.NotEqual(t, busy.Engine, lease.Engine)
+	require.NoError(t, lease.Release(t.Context(), nil))
+	require.NoError(t, busy.Release(t.Context(), nil))
+
+	// Builds on an engine whose session dies fail retryably and the engine is drained.
+	lease, err = pool.Acquire(t.Context(), "a")
+	require.NoError(t, err)
+	sessions.kill(lease.Client)
+	sessions.failures.Store(1 << 10)
+	require.ErrorIs(t, lease.Release(t.Context(), errors.New("build failed")), ErrUnavailable)
+	require.Eventually(t, func() bool {
+		return sessions.isClosed(lease.Client)
+	}, time.Second, time.Millisecond)
+
+	for range 10 {
+		next, err := pool.Acquire(t.Context(), "a")
+		require.NoError(t, err)
+		require.NotEqual(t, lease.Engine, next.Engine)
+		require.NoError(t, next.Release(t.Context(), nil))
+	}
+
+	for _, status := range pool.Status() {
+		require.Equal(t, status.Name != lease.Engine, status.Up)
+		require.Zero(t, status.Running)
+	}
+}
+
+func TestPoolUnavailable(t *testing.T) {
+	pool, sessions := newTestPool(t, StrategyLeastLoaded, 0, 0)
+
+	sessions.failures.Store(1 << 10)
+	for _, m := range pool.Members {
+		dag, err := m.Conn.Client()
+		require.NoError(t, err)
+		sessions.kill(dag)
+		require.ErrorIs(t, m.Conn.Failed(t.Context(), dag, errors.New("build failed")), ErrUnavailable)
+		require.Eventually(t, func() bool {
+			return sessions.isClosed(dag)
+		}, time.Second, time.Millisecond)
+	}
+
+	_, err := pool.Acquire(t.Context(), "a")
+	uerr := &UnavailableError{}
+	require.ErrorAs(t, err, &uerr)
+	require.Error(t, pool.Check(t.Context()))
+}
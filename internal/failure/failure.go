@@ -0,0 +1,258 @@
+// Package failure remembers builds that failed so that retries of them fail fast.
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frantjc/sindri/internal/httputil"
+)
+
+// Error is a remembered failure.
+type Error struct {
+	// Err is the error that the build failed with.
+	Err error
+	// Permanent is whether retrying the build is expected to fail the same way.
+	Permanent bool
+	// Until is when the build may be retried.
+	Until time.Time
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("build failed recently, not retrying until %s: %s", e.Until.Format(time.RFC3339), e.Err)
+}
+
+// Unwrap returns the error that the build failed with.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as one that retrying will not fix.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err}
+}
+
+// DefaultPermanentStatusCodes are the status codes of errors that retrying a build
+// is not expected to fix when a Cache's PermanentStatusCodes are nil. Other 4xx
+// status codes, like 401, 403, 408, 409 and 429, may not recur.
+var DefaultPermanentStatusCodes = []int{
+	http.StatusBadRequest,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusUnprocessableEntity,
+}
+
+type key struct {
+	name, reference string
+}
+
+type entry struct {
+	err       error
+	permanent bool
+	failures  int
+	failedAt  time.Time
+	until     time.Time
+}
+
+// Entry describes a remembered failure.
+type Entry struct {
+	Name      string    `json:"name"`
+	Reference string    `json:"reference"`
+	Error     string    `json:"error"`
+	Permanent bool      `json:"permanent"`
+	Failures  int       `json:"failures"`
+	FailedAt  time.Time `json:"failedAt"`
+	Until     time.Time `json:"until"`
+}
+
+// Cache remembers builds that failed. Transient failures are remembered for
+// Backoff, doubling with each consecutive failure up to MaxBackoff. Permanent
+// failures are remembered for MaxBackoff.
+type Cache struct {
+	// Backoff is how long a build's first transient failure is remembered.
+	Backoff time.Duration
+	// MaxBackoff is the longest that a failure is remembered.
+	MaxBackoff time.Duration
+	// PermanentErrors match the messages of errors that retrying will not fix,
+	// in addition to those marked by Permanent and those with PermanentStatusCodes.
+	PermanentErrors []*regexp.Regexp
+	// PermanentStatusCodes are the status codes of errors that retrying will not fix.
+	// Nil means DefaultPermanentStatusCodes.
+	PermanentStatusCodes []int
+
+	mu      sync.Mutex
+	entries map[key]*entry
+	hits    uint64
+}
+
+// IsPermanent reports whether retrying a build that failed with err is expected to fail the same way.
+func (c *Cache) IsPermanent(err error) bool {
+	if perr := (&permanentError{}); errors.As(err, &perr) {
+		return true
+	}
+
+	permanentStatusCodes := c.PermanentStatusCodes
+	if permanentStatusCodes == nil {
+		permanentStatusCodes = DefaultPermanentStatusCodes
+	}
+
+	if slices.Contains(permanentStatusCodes, httputil.HTTPStatusCode(err)) {
+		return true
+	}
+
+	msg := err.Error()
+	return slices.ContainsFunc(c.PermanentErrors, func(re *regexp.Regexp) bool {
+		return re.MatchString(msg)
+	})
+}
+
+// Get returns an *Error if the build of name and reference failed recently.
+// A nil *Cache remembers nothing.
+func (c *Cache) Get(name, reference string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key{name, reference}]
+	if !ok || time.Now().After(e.until) {
+		return nil
+	}
+	c.hits++
+
+	return &Error{Err: e.err, Permanent: e.permanent, Until: e.until}
+}
+
+// Put remembers that the build of name and reference failed with err, or forgets
+// that it failed if err is nil.
+func (c *Cache) Put(name, reference string, err error) {
+	if c == nil || c.Backoff <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[key]*entry{}
+	}
+
+	k := key{name, reference}
+
+	if err == nil {
+		delete(c.entries, k)
+		return
+	}
+
+	// Forget failures long enough ago that they no longer count as consecutive.
+	for k, e := range c.entries {
+		if now.Sub(e.until) > c.MaxBackoff {
+			delete(c.entries, k)
+		}
+	}
+
+	e, ok := c.entries[k]
+	if !ok {
+		e = &entry{}
+		c.entries[k] = e
+	}
+
+	e.err = err
+	e.permanent = c.IsPermanent(err)
+	e.failures++
+	e.failedAt = now
+
+	backoff := c.MaxBackoff
+	if !e.permanent {
+		backoff = c.Backoff
+		for i := 1; i < e.failures && backoff < c.MaxBackoff; i++ {
+			backoff *= 2
+		}
+		backoff = min(backoff, c.MaxBackoff)
+	}
+	e.until = now.Add(backoff)
+}
+
+// Clear forgets the failures of builds of name and reference, returning how many
+// it forgot. An empty name or reference matches any.
+func (c *Cache) Clear(name, reference string) int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleared := 0
+	for k := range c.entries {
+		if (name == "" || k.name == name) && (reference == "" || k.reference == reference) {
+			delete(c.entries, k)
+			cleared++
+		}
+	}
+
+	return cleared
+}
+
+// Entries returns the failures that are being remembered, most recent first.
+func (c *Cache) Entries() []Entry {
+	entries := []Entry{}
+	if c == nil {
+		return entries
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.entries {
+		if now.After(e.until) {
+			continue
+		}
+
+		entries = append(entries, Entry{
+			Name:      k.name,
+			Reference: k.reference,
+			Error:     strings.TrimSpace(e.err.Error()),
+			Permanent: e.permanent,
+			Failures:  e.failures,
+			FailedAt:  e.failedAt,
+			Until:     e.until,
+		})
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return b.FailedAt.Compare(a.FailedAt)
+	})
+
+	return entries
+}
@@ -0,0 +1,79 @@
+package failure_test
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/failure"
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	c := &failure.Cache{
+		Backoff:         time.Minute,
+		MaxBackoff:      time.Minute * 3,
+		PermanentErrors: []*regexp.Regexp{regexp.MustCompile(`invalid name`)},
+	}
+
+	require.NoError(t, c.Get("a", "latest"))
+
+	until := func() time.Duration {
+		ferr := &failure.Error{}
+		require.True(t, errors.As(c.Get("a", "latest"), &ferr))
+		return time.Until(ferr.Until).Round(time.Minute)
+	}
+
+	// Transient failures are remembered for exponentially longer, up to MaxBackoff.
+	transient := errors.New("connection reset by peer")
+	for _, expected := range []time.Duration{time.Minute, time.Minute * 2, time.Minute * 3, time.Minute * 3} {
+		c.Put("a", "latest", transient)
+		require.Equal(t, expected, until())
+		require.ErrorIs(t, c.Get("a", "latest"), transient)
+	}
+	require.NoError(t, c.Get("a", "other"))
+
+	// Success forgets failures.
+	c.Put("a", "latest", nil)
+	require.NoError(t, c.Get("a", "latest"))
+
+	// Permanent failures are remembered for MaxBackoff right away.
+	for _, err := range []error{
+		errors.New("invalid name b, try one of: a"),
+		failure.Permanent(errors.New("no such thing")),
+		httputil.NewError(errors.New("bad request"), http.StatusBadRequest),
+	} {
+		c.Put("b", "latest", err)
+
+		ferr := &failure.Error{}
+		require.True(t, errors.As(c.Get("b", "latest"), &ferr))
+		require.True(t, ferr.Permanent, err.Error())
+		require.Equal(t, time.Minute*3, time.Until(ferr.Until).Round(time.Minute))
+
+		require.Equal(t, 1, c.Clear("b", ""))
+	}
+
+	// Errors with other 4xx status codes, e.g. from credentials that have expired, may not recur.
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests} {
+		require.False(t, c.IsPermanent(httputil.NewError(errors.New("try again"), code)), code)
+	}
+
+	// Unless they are configured to be permanent.
+	c.PermanentStatusCodes = []int{http.StatusForbidden}
+	require.True(t, c.IsPermanent(httputil.NewError(errors.New("forbidden"), http.StatusForbidden)))
+	require.False(t, c.IsPermanent(httputil.NewError(errors.New("bad request"), http.StatusBadRequest)))
+	c.PermanentStatusCodes = nil
+
+	c.Put("a", "latest", transient)
+	c.Put("a", "v1", transient)
+	require.Len(t, c.Entries(), 2)
+	require.Equal(t, 2, c.Clear("a", ""))
+	require.Empty(t, c.Entries())
+
+	var nilCache *failure.Cache
+	nilCache.Put("a", "latest", transient)
+	require.NoError(t, nilCache.Get("a", "latest"))
+}
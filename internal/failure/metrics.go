@@ -0,0 +1,51 @@
+package failure
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rememberedDesc = prometheus.NewDesc(
+		"sindri_build_failures_remembered",
+		"Failed builds that are being failed fast instead of retried, by whether they failed permanently.",
+		[]string{"permanent"}, nil,
+	)
+	hitsDesc = prometheus.NewDesc(
+		"sindri_build_failure_hits_total",
+		"Requests that were failed fast because their build failed recently.",
+		nil, nil,
+	)
+)
+
+// Describe implements prometheus.Collector.
+func (c *Cache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rememberedDesc
+	ch <- hitsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Cache) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	c.mu.Lock()
+	var (
+		remembered = map[bool]int{}
+		hits       = c.hits
+	)
+	for _, e := range c.entries {
+		if !now.After(e.until) {
+			remembered[e.permanent]++
+		}
+	}
+	c.mu.Unlock()
+
+	for _, permanent := range []bool{false, true} {
+		ch <- prometheus.MustNewConstMetric(rememberedDesc, prometheus.GaugeValue, float64(remembered[permanent]), strconv.FormatBool(permanent))
+	}
+	ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(hits))
+}
+
+var _ prometheus.Collector = new(Cache)
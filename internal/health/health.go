@@ -0,0 +1,154 @@
+// Package health reports whether sindri and the components it depends on are healthy.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Check returns an error if a component is unhealthy.
+type Check func(ctx context.Context) error
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Component is the result of a component's last check.
+type Component struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// Duration is how long the check took, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// Report is the result of checking every component.
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+type check struct {
+	name   string
+	fn     Check
+	mu     sync.Mutex
+	result Component
+}
+
+// Checker checks named components, caching each one's result so that
+// frequent probes do not put load on what they check.
+type Checker struct {
+	// TTL is how long each component's result is reused for. Zero means 5 seconds.
+	TTL time.Duration
+	// Timeout limits how long each check may take. Zero means 5 seconds.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	checks []*check
+}
+
+// Add adds a component named name that is checked by fn.
+func (c *Checker) Add(name string, fn Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, &check{name: name, fn: fn})
+}
+
+// Check checks each component whose cached result is older than c.TTL,
+// concurrently, and reports on all of them.
+func (c *Checker) Check(ctx context.Context) *Report {
+	c.mu.Lock()
+	checks := slices.Clone(c.checks)
+	c.mu.Unlock()
+
+	var (
+		report = &Report{Status: StatusOK, Components: make(map[string]Component, len(checks))}
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for _, chk := range checks {
+		wg.Go(func() {
+			result := c.run(ctx, chk)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			report.Components[chk.name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusError
+			}
+		})
+	}
+	wg.Wait()
+
+	return report
+}
+
+// run returns chk's cached result, checking it again first if it is stale.
+// Concurrent callers share a single check.
+func (c *Checker) run(ctx context.Context, chk *check) Component {
+	chk.mu.Lock()
+	defer chk.mu.Unlock()
+
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = time.Second * 5
+	}
+
+	if !chk.result.CheckedAt.IsZero() && time.Since(chk.result.CheckedAt) < ttl {
+		return chk.result
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	start := time.Now()
+	chk.result = Component{Status: StatusOK, CheckedAt: start}
+	if err := chk.fn(ctx); err != nil {
+		chk.result.Status = StatusError
+		chk.result.Error = err.Error()
+	}
+	chk.result.Duration = time.Since(start).Seconds()
+
+	return chk.result
+}
+
+// ReadyHandler serves c's report as JSON, with 503 Service Unavailable if any component is unhealthy.
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			report = c.Check(r.Context())
+			status = http.StatusOK
+		)
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, report)
+	})
+}
+
+// LiveHandler serves a report with no components, since sindri serving it at all means it is alive.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, &Report{Status: StatusOK, Components: map[string]Component{}})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, httpStatusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(httpStatusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
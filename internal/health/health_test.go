@@ -0,0 +1,79 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/health"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecker(t *testing.T) {
+	var (
+		calls   atomic.Int32
+		healthy atomic.Bool
+		checker = &health.Checker{TTL: time.Hour}
+	)
+	healthy.Store(true)
+
+	checker.Add("dagger", func(context.Context) error {
+		return nil
+	})
+	checker.Add("backend", func(context.Context) error {
+		calls.Add(1)
+		if !healthy.Load() {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+
+	srv := httptest.NewServer(checker.ReadyHandler())
+	t.Cleanup(srv.Close)
+
+	get := func() (int, *health.Report) {
+		res, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		report := &health.Report{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(report))
+		return res.StatusCode, report
+	}
+
+	status, report := get()
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, health.StatusOK, report.Status)
+	require.Equal(t, health.StatusOK, report.Components["dagger"].Status)
+	require.Equal(t, health.StatusOK, report.Components["backend"].Status)
+
+	// Cached results are served until they expire.
+	healthy.Store(false)
+	status, _ = get()
+	require.Equal(t, http.StatusOK, status)
+	require.EqualValues(t, 1, calls.Load())
+
+	checker.TTL = time.Nanosecond
+	status, report = get()
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, health.StatusError, report.Status)
+	require.Equal(t, health.StatusOK, report.Components["dagger"].Status)
+	require.Equal(t, "unreachable", report.Components["backend"].Error)
+}
+
+func TestCheckerTimeout(t *testing.T) {
+	checker := &health.Checker{Timeout: time.Millisecond}
+	checker.Add("dagger", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	report := checker.Check(t.Context())
+	require.Equal(t, health.StatusError, report.Status)
+	require.Equal(t, context.DeadlineExceeded.Error(), report.Components["dagger"].Error)
+}
@@ -0,0 +1,61 @@
+package httputil
+
+import (
+	"net/http"
+)
+
+// ResponseRecorder is an http.ResponseWriter that records the status code
+// and how many bytes of body are written through it.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// NewResponseRecorder returns a new ResponseRecorder that writes to w.
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	if rec, ok := w.(*ResponseRecorder); ok {
+		return rec
+	}
+
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (r *ResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status returns the status code that was written, or 200 if none was.
+func (r *ResponseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+
+	return r.status
+}
+
+// Written returns how many bytes of body have been written.
+func (r *ResponseRecorder) Written() int64 {
+	return r.written
+}
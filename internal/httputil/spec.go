@@ -0,0 +1,34 @@
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+
+	specs "github.com/opencontainers/distribution-spec/specs-go/v1"
+)
+
+// Error codes from https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes.
+const (
+	ErrorCodeBlobUnknown     = "BLOB_UNKNOWN"
+	ErrorCodeManifestUnknown = "MANIFEST_UNKNOWN"
+	ErrorCodeNameInvalid     = "NAME_INVALID"
+	ErrorCodeNameUnknown     = "NAME_UNKNOWN"
+	ErrorCodeUnauthorized    = "UNAUTHORIZED"
+	ErrorCodeDenied          = "DENIED"
+	ErrorCodeUnsupported     = "UNSUPPORTED"
+	ErrorCodeTooManyRequests = "TOOMANYREQUESTS"
+	ErrorCodeTagInvalid      = "TAG_INVALID"
+	ErrorCodeManifestInvalid = "MANIFEST_INVALID"
+	ErrorCodeDigestInvalid   = "DIGEST_INVALID"
+	ErrorCodeUnknown         = "UNKNOWN"
+	ErrorCodeUnavailable     = "UNAVAILABLE"
+)
+
+// WriteError writes an OCI distribution-spec error response.
+func WriteError(w http.ResponseWriter, httpStatusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusCode)
+	_ = json.NewEncoder(w).Encode(&specs.ErrorResponse{
+		Errors: []specs.ErrorInfo{{Code: code, Message: message}},
+	})
+}
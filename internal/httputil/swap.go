@@ -0,0 +1,54 @@
+package httputil
+
+import (
+	"net/http"
+	"sync"
+)
+
+// SwapHandler is an http.Handler that serves requests with whichever
+// http.Handler it was most recently given, such that it can be replaced
+// without dropping requests that are already being served by the previous one.
+type SwapHandler struct {
+	mu      sync.RWMutex
+	current *swapGeneration
+}
+
+type swapGeneration struct {
+	handler  http.Handler
+	inFlight sync.WaitGroup
+}
+
+// NewSwapHandler returns a *SwapHandler that serves requests with handler.
+func NewSwapHandler(handler http.Handler) *SwapHandler {
+	return &SwapHandler{current: &swapGeneration{handler: handler}}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *SwapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	gen := s.current
+	gen.inFlight.Add(1)
+	s.mu.RUnlock()
+	defer gen.inFlight.Done()
+
+	gen.handler.ServeHTTP(w, r)
+}
+
+// Swap replaces the http.Handler that serves new requests with handler.
+// The returned channel is closed once every request that was being served
+// by the previous http.Handler has finished, after which it is safe to
+// release anything that it depends on.
+func (s *SwapHandler) Swap(handler http.Handler) <-chan struct{} {
+	s.mu.Lock()
+	prev := s.current
+	s.current = &swapGeneration{handler: handler}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		prev.inFlight.Wait()
+		close(drained)
+	}()
+
+	return drained
+}
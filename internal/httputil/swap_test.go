@@ -0,0 +1,65 @@
+package httputil_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwapHandler(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		swap    = httputil.NewSwapHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(started)
+			<-release
+			_, _ = io.WriteString(w, "prev")
+		}))
+		srv = httptest.NewServer(swap)
+	)
+	t.Cleanup(srv.Close)
+
+	prev := make(chan string)
+	go func() {
+		res, err := http.Get(srv.URL)
+		if err != nil {
+			prev <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		prev <- string(b)
+	}()
+	<-started
+
+	drained := swap.Swap(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "next")
+	}))
+
+	res, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "next", string(b))
+
+	select {
+	case <-drained:
+		t.Fatal("drained before in-flight request finished")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(release)
+	require.Equal(t, "prev", <-prev)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("not drained after in-flight request finished")
+	}
+}
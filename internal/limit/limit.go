@@ -0,0 +1,60 @@
+// Package limit limits how many builds clients of sindri may cause and how often.
+package limit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frantjc/sindri/internal/auth"
+)
+
+// Error is returned when a client exceeds a limit.
+type Error struct {
+	// Reason describes the limit that was exceeded.
+	Reason string
+	// RetryAfter is how long the client should wait before trying again.
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Reason, e.RetryAfter)
+}
+
+// RetryAfterSeconds returns e.RetryAfter rounded up to whole seconds, as for a Retry-After header.
+func (e *Error) RetryAfterSeconds() string {
+	return strconv.Itoa(int(math.Ceil(max(e.RetryAfter, time.Second).Seconds())))
+}
+
+// Client returns the key that limits are applied to for the client that made
+// r: its subject if it is authenticated, otherwise its IP address.
+func Client(r *http.Request) string {
+	if identity, ok := auth.IdentityFrom(r.Context()); ok {
+		return "sub:" + identity.Subject
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+type contextKey struct{}
+
+// ClientInto returns a new context with a client key (see Client) stored in it.
+func ClientInto(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, contextKey{}, client)
+}
+
+// ClientFrom returns the client key from the context, if any.
+func ClientFrom(ctx context.Context) string {
+	client, _ := ctx.Value(contextKey{}).(string)
+	return client
+}
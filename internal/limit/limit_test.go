@@ -0,0 +1,29 @@
+package limit_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRate(t *testing.T) {
+	r := &limit.Rate{Limit: 1, Burst: 2}
+
+	require.NoError(t, r.Allow("a"))
+	require.NoError(t, r.Allow("a"))
+
+	err := r.Allow("a")
+	lerr := &limit.Error{}
+	require.True(t, errors.As(err, &lerr))
+	require.Greater(t, lerr.RetryAfter, time.Duration(0))
+	require.LessOrEqual(t, lerr.RetryAfter, time.Second)
+	require.Equal(t, "1", lerr.RetryAfterSeconds())
+
+	require.NoError(t, r.Allow("b"))
+
+	var nilRate *limit.Rate
+	require.NoError(t, nilRate.Allow("a"))
+}
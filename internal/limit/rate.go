@@ -0,0 +1,70 @@
+package limit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Rate limits how often each client may make requests with a token bucket per client.
+type Rate struct {
+	// Limit is how many requests per second each client may make on average.
+	Limit rate.Limit
+	// Burst is how many requests each client may make at once.
+	Burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*limiter
+	lastSweep time.Time
+}
+
+type limiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+// Allow returns an *Error if client has made too many requests recently.
+// A nil *Rate, or one with no positive Limit, allows every request.
+func (r *Rate) Allow(client string) error {
+	if r == nil || r.Limit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.limiters == nil {
+		r.limiters = map[string]*limiter{}
+	}
+
+	// A limiter that has been idle long enough to refill
+	// is no different than a new one, so forget it.
+	idle := time.Duration(float64(max(r.Burst, 1)) / float64(r.Limit) * float64(time.Second))
+	if now.Sub(r.lastSweep) > idle {
+		for key, l := range r.limiters {
+			if now.Sub(l.lastSeen) > idle {
+				delete(r.limiters, key)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	l, ok := r.limiters[client]
+	if !ok {
+		l = &limiter{Limiter: rate.NewLimiter(r.Limit, max(r.Burst, 1))}
+		r.limiters[client] = l
+	}
+	l.lastSeen = now
+
+	if reservation := l.ReserveN(now, 1); !reservation.OK() {
+		return &Error{Reason: "too many requests", RetryAfter: time.Second}
+	} else if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return &Error{Reason: "too many requests", RetryAfter: delay}
+	}
+
+	return nil
+}
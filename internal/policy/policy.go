@@ -0,0 +1,131 @@
+// Package policy decides which names and references clients of sindri may pull and build.
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/frantjc/sindri/internal/auth"
+)
+
+const (
+	// ActionPull is pulling a manifest or blob.
+	ActionPull = "pull"
+	// ActionBuild is building a reference that is not a digest, i.e. calling
+	// backend.Backend.Store, as opposed to pulling what has already been built.
+	ActionBuild = "build"
+)
+
+// Effect is what a matching Rule does.
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// Matcher matches strings, e.g. an *auth.Glob or a *Regexp.
+type Matcher interface {
+	Match(string) bool
+}
+
+// Regexp is a Matcher that must match the entire string.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// CompileRegexp compiles expr, anchored at both ends, into a *Regexp.
+func CompileRegexp(expr string) (*Regexp, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("compile regexp %q: %w", expr, err)
+	}
+
+	return &Regexp{re}, nil
+}
+
+// Match implements Matcher.
+func (r *Regexp) Match(s string) bool {
+	return r.MatchString(s)
+}
+
+func matchAny(matchers []Matcher, s string) bool {
+	for _, m := range matchers {
+		if m.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule allows or denies actions on names and references. Empty fields match anything.
+type Rule struct {
+	Effect Effect
+	// Actions are the actions that the Rule applies to.
+	Actions []string
+	// Anonymous makes the Rule apply to unauthenticated clients.
+	Anonymous bool
+	// Subjects make the Rule apply to authenticated clients whose subject matches
+	// any of them. If neither Anonymous nor Subjects are set, the Rule applies to
+	// every client.
+	Subjects []Matcher
+	// Names are matched against repository names.
+	Names []Matcher
+	// References are matched against tags and digests of manifests. A Rule with
+	// References never matches requests without a reference, i.e. pulls of blobs.
+	References []Matcher
+}
+
+// Matches reports whether r applies to identity taking action on name and reference.
+// An empty reference matches no References, so Rules with References
+// do not apply to requests without one.
+func (r *Rule) Matches(identity *auth.Identity, action, name, reference string) bool {
+	if len(r.Actions) > 0 && !slices.Contains(r.Actions, action) {
+		return false
+	}
+
+	if r.Anonymous || len(r.Subjects) > 0 {
+		if identity == nil {
+			if !r.Anonymous {
+				return false
+			}
+		} else if !matchAny(r.Subjects, identity.Subject) {
+			return false
+		}
+	}
+
+	if len(r.Names) > 0 && !matchAny(r.Names, name) {
+		return false
+	}
+
+	if len(r.References) > 0 && (reference == "" || !matchAny(r.References, reference)) {
+		return false
+	}
+
+	return true
+}
+
+// Policy is an ordered list of Rules. The first Rule that matches a request
+// decides whether it is allowed. If none match, Default decides.
+type Policy struct {
+	Rules []Rule
+	// Default is the Effect when no Rule matches. Defaults to EffectAllow.
+	Default Effect
+}
+
+// Allowed reports whether identity may take action on name and reference.
+// A nil *Policy allows everything.
+func (p *Policy) Allowed(identity *auth.Identity, action, name, reference string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.Rules {
+		if rule.Matches(identity, action, name, reference) {
+			return rule.Effect != EffectDeny
+		}
+	}
+
+	return p.Default != EffectDeny
+}
@@ -0,0 +1,78 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/policy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	var (
+		glob = func(pattern string) policy.Matcher {
+			g, err := auth.CompileGlob(pattern)
+			require.NoError(t, err)
+			return g
+		}
+		re = func(expr string) policy.Matcher {
+			r, err := policy.CompileRegexp(expr)
+			require.NoError(t, err)
+			return r
+		}
+		alice = &auth.Identity{Subject: "alice", Method: auth.MethodBasic}
+		bob   = &auth.Identity{Subject: "bob", Method: auth.MethodBasic}
+		p     = &policy.Policy{
+			Default: policy.EffectDeny,
+			Rules: []policy.Rule{
+				{
+					Effect:  policy.EffectDeny,
+					Actions: []string{policy.ActionBuild},
+					Names:   []policy.Matcher{glob("git/**")},
+				},
+				{
+					Effect:     policy.EffectAllow,
+					Actions:    []string{policy.ActionBuild},
+					Subjects:   []policy.Matcher{glob("alice")},
+					References: []policy.Matcher{re(`v\d+(\.\d+)*`)},
+				},
+				{
+					Effect:   policy.EffectAllow,
+					Actions:  []string{policy.ActionPull},
+					Subjects: []policy.Matcher{glob("*")},
+				},
+				{
+					Effect:    policy.EffectAllow,
+					Actions:   []string{policy.ActionPull},
+					Anonymous: true,
+					Names:     []policy.Matcher{glob("public/**")},
+				},
+			},
+		}
+	)
+
+	for _, c := range []struct {
+		name      string
+		identity  *auth.Identity
+		action    string
+		repo      string
+		reference string
+		allowed   bool
+	}{
+		{"alice builds semver", alice, policy.ActionBuild, "wolfi/curl", "v1.2.3", true},
+		{"alice builds latest", alice, policy.ActionBuild, "wolfi/curl", "latest", false},
+		{"alice builds git", alice, policy.ActionBuild, "git/github.com/frantjc/sindri", "v1", false},
+		{"bob builds", bob, policy.ActionBuild, "wolfi/curl", "v1", false},
+		{"bob pulls", bob, policy.ActionPull, "wolfi/curl", "latest", true},
+		{"anonymous pulls public", nil, policy.ActionPull, "public/curl", "latest", true},
+		{"anonymous pulls private", nil, policy.ActionPull, "wolfi/curl", "latest", false},
+		{"anonymous builds public", nil, policy.ActionBuild, "public/curl", "latest", false},
+		{"alice builds without reference", alice, policy.ActionBuild, "wolfi/curl", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.allowed, p.Allowed(c.identity, c.action, c.repo, c.reference))
+		})
+	}
+
+	require.True(t, (*policy.Policy)(nil).Allowed(nil, policy.ActionBuild, "anything", "latest"))
+}
@@ -0,0 +1,368 @@
+// Package rebuild rebuilds images on cron schedules so that tags that move,
+// e.g. edge and nightly images, are refreshed without waiting for pulls, and
+// keeps track of which tags have been pulled and which have been invalidated.
+package rebuild
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/opencontainers/go-digest"
+	"github.com/robfig/cron/v3"
+)
+
+// Builder builds images the same way that pulls do.
+type Builder interface {
+	Build(ctx context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error)
+}
+
+// Image is a name and reference to rebuild.
+type Image struct {
+	Name      string
+	Reference string
+}
+
+// String returns <name>:<reference>.
+func (i Image) String() string {
+	return i.Name + ":" + i.Reference
+}
+
+// Schedule is a set of images to rebuild on a cron schedule.
+type Schedule struct {
+	// Name identifies the Schedule in logs and the admin API.
+	Name string
+	// Spec is a cron expression, e.g. "0 3 * * *", or a descriptor, e.g. "@daily",
+	// of when to rebuild, optionally prefixed by a time zone, e.g. "CRON_TZ=UTC ".
+	Spec string
+	// Images are rebuilt on each run.
+	Images []Image
+	// TopPulled is how many of the most pulled tags to rebuild on each run in addition to Images.
+	TopPulled int
+}
+
+// Result is the result of rebuilding one image.
+type Result struct {
+	Image  string        `json:"image"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Run describes a run of a Schedule.
+type Run struct {
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Results    []Result   `json:"results"`
+}
+
+// Status describes a Schedule.
+type Status struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Next     time.Time `json:"next"`
+	// Last is the most recent run of the Schedule, which is still going if it is not finished.
+	Last *Run `json:"last,omitempty"`
+}
+
+// Pulls counts pulls of tags so that the most pulled can be rebuilt.
+// A nil *Pulls counts nothing.
+type Pulls struct {
+	mu     sync.Mutex
+	counts map[Image]int
+}
+
+// Add counts a pull of name and reference.
+func (p *Pulls) Add(name, reference string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.counts == nil {
+		p.counts = map[Image]int{}
+	}
+	p.counts[Image{Name: name, Reference: reference}]++
+}
+
+// Top returns the n most pulled images, most pulled first.
+func (p *Pulls) Top(n int) []Image {
+	if p == nil || n <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	images := make([]Image, 0, len(p.counts))
+	for image := range p.counts {
+		images = append(images, image)
+	}
+	slices.SortFunc(images, func(a, b Image) int {
+		return cmp.Or(
+			cmp.Compare(p.counts[b], p.counts[a]),
+			cmp.Compare(a.String(), b.String()),
+		)
+	})
+
+	return images[:min(n, len(images))]
+}
+
+// Images returns every image that has been pulled.
+func (p *Pulls) Images() []Image {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	images := make([]Image, 0, len(p.counts))
+	for image := range p.counts {
+		images = append(images, image)
+	}
+	slices.SortFunc(images, func(a, b Image) int {
+		return cmp.Compare(a.String(), b.String())
+	})
+
+	return images
+}
+
+// Invalidations are tags that were invalidated, e.g. because what they are built
+// from changed, so that what they were stored as before then is not served.
+// A nil *Invalidations invalidates nothing.
+type Invalidations struct {
+	mu sync.Mutex
+	at map[Image]time.Time
+}
+
+// Invalidate invalidates name and reference as of now.
+func (i *Invalidations) Invalidate(name, reference string) {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.at == nil {
+		i.at = map[Image]time.Time{}
+	}
+	i.at[Image{Name: name, Reference: reference}] = time.Now()
+}
+
+// Invalidated reports whether name and reference were invalidated after they were stored
+// at storedAt, forgetting the invalidation if they have been stored again since.
+func (i *Invalidations) Invalidated(name, reference string, storedAt time.Time) bool {
+	if i == nil {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	image := Image{Name: name, Reference: reference}
+	at, ok := i.at[image]
+	if !ok {
+		return false
+	}
+
+	if storedAt.After(at) {
+		delete(i.at, image)
+		return false
+	}
+
+	return true
+}
+
+type entry struct {
+	*Schedule
+	spec cron.Schedule
+	id   cron.EntryID
+}
+
+// Rebuilder runs Schedules. A nil *Rebuilder has no Schedules.
+type Rebuilder struct {
+	// Pulls, if set, is what the most pulled tags are decided from.
+	Pulls *Pulls
+
+	once    sync.Once
+	cron    *cron.Cron
+	mu      sync.Mutex
+	ctx     context.Context
+	builder Builder
+	entries []*entry
+	// runs are the most recent runs of Schedules by name, kept across Updates.
+	runs map[string]*Run
+}
+
+func (r *Rebuilder) init() {
+	r.once.Do(func() {
+		r.cron = cron.New()
+		r.runs = map[string]*Run{}
+	})
+}
+
+// Update replaces the Schedules that r runs and the Builder that they rebuild with.
+// The runs of Schedules whose names have not changed are kept.
+func (r *Rebuilder) Update(builder Builder, schedules []*Schedule) error {
+	r.init()
+
+	entries := make([]*entry, len(schedules))
+	for i, s := range schedules {
+		spec, err := cron.ParseStandard(s.Spec)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %w", s.Name, err)
+		}
+
+		entries[i] = &entry{Schedule: s, spec: spec}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.entries {
+		r.cron.Remove(e.id)
+	}
+
+	for _, e := range entries {
+		e.id = r.cron.Schedule(e.spec, cron.FuncJob(func() {
+			r.rebuild(e.Schedule)
+		}))
+	}
+
+	for name := range r.runs {
+		if !slices.ContainsFunc(entries, func(e *entry) bool { return e.Name == name }) {
+			delete(r.runs, name)
+		}
+	}
+
+	r.builder = builder
+	r.entries = entries
+
+	return nil
+}
+
+// Run runs r's Schedules until ctx is done, then waits for the runs
+// that are in progress, whose builds are canceled along with ctx.
+func (r *Rebuilder) Run(ctx context.Context) error {
+	r.init()
+
+	r.mu.Lock()
+	r.ctx = ctx
+	r.mu.Unlock()
+
+	r.cron.Start()
+	<-ctx.Done()
+	<-r.cron.Stop().Done()
+
+	return ctx.Err()
+}
+
+// Status returns the Schedules in the order that they were given to Update.
+func (r *Rebuilder) Status() []Status {
+	statuses := []Status{}
+	if r == nil {
+		return statuses
+	}
+
+	r.init()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range r.entries {
+		status := Status{
+			Name:     e.Name,
+			Schedule: e.Spec,
+			Next:     e.spec.Next(now),
+		}
+
+		if run, ok := r.runs[e.Name]; ok {
+			status.Last = &Run{
+				StartedAt:  run.StartedAt,
+				FinishedAt: run.FinishedAt,
+				Results:    slices.Clone(run.Results),
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// rebuild rebuilds s's Images and most pulled tags at scheduler.PriorityPrewarm,
+// recording the results, unless the previous run of s is still going.
+func (r *Rebuilder) rebuild(s *Schedule) {
+	r.mu.Lock()
+	var (
+		ctx     = r.ctx
+		builder = r.builder
+		log     = logutil.SloggerFrom(ctx).With("schedule", s.Name)
+	)
+	if run, ok := r.runs[s.Name]; ok && run.FinishedAt == nil {
+		r.mu.Unlock()
+		log.Warn("skipping rebuild, previous run is still going", "startedAt", run.StartedAt)
+		return
+	}
+
+	images := slices.Clone(s.Images)
+	for _, image := range r.Pulls.Top(s.TopPulled) {
+		if !slices.Contains(images, image) {
+			images = append(images, image)
+		}
+	}
+
+	run := &Run{StartedAt: time.Now(), Results: make([]Result, len(images))}
+	for i, image := range images {
+		run.Results[i].Image = image.String()
+	}
+	r.runs[s.Name] = run
+	r.mu.Unlock()
+
+	log.Info("rebuilding", "images", len(images))
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]Result, len(images))
+	)
+	ctx = limit.ClientInto(ctx, "schedule:"+s.Name)
+	for i, image := range images {
+		wg.Go(func() {
+			results[i].Image = image.String()
+			if d, err := builder.Build(ctx, image.Name, image.Reference, scheduler.PriorityPrewarm); err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Digest = d
+			}
+		})
+	}
+	wg.Wait()
+
+	var (
+		finishedAt = time.Now()
+		failed     = 0
+	)
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+			log.Warn("rebuilding", "image", result.Image, "err", result.Error)
+		}
+	}
+
+	r.mu.Lock()
+	run.FinishedAt = &finishedAt
+	run.Results = results
+	r.mu.Unlock()
+
+	log.Info("rebuilt", "built", len(images)-failed, "failed", failed, "duration", finishedAt.Sub(run.StartedAt))
+}
@@ -0,0 +1,109 @@
+package rebuild_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/rebuild"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/frantjc/sindri/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPulls(t *testing.T) {
+	var (
+		p     = &rebuild.Pulls{}
+		image = func(name, reference string) rebuild.Image {
+			return rebuild.Image{Name: name, Reference: reference}
+		}
+	)
+	require.Empty(t, p.Top(3))
+
+	for range 3 {
+		p.Add("a", "latest")
+	}
+	p.Add("b", "v1")
+	p.Add("c", "edge")
+	p.Add("c", "edge")
+
+	require.Equal(t, []rebuild.Image{image("a", "latest"), image("c", "edge")}, p.Top(2))
+	require.Equal(t, []rebuild.Image{image("a", "latest"), image("c", "edge"), image("b", "v1")}, p.Top(10))
+
+	var nilPulls *rebuild.Pulls
+	nilPulls.Add("a", "latest")
+	require.Empty(t, nilPulls.Top(1))
+}
+
+func TestRebuilder(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		built = map[string]int{}
+		r     = &rebuild.Rebuilder{Pulls: &rebuild.Pulls{}}
+	)
+	r.Pulls.Add("b", "edge")
+	r.Pulls.Add("a", "nightly")
+
+	require.NoError(t, r.Update(testutil.BuilderFunc(func(_ context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error) {
+		require.Equal(t, scheduler.PriorityPrewarm, priority)
+
+		mu.Lock()
+		defer mu.Unlock()
+		built[name+":"+reference]++
+
+		if name == "b" {
+			return "", errors.New("build failed")
+		}
+
+		return digest.FromString(name + ":" + reference), nil
+	}), []*rebuild.Schedule{
+		{
+			Name:      "nightly",
+			Spec:      "@every 1s",
+			Images:    []rebuild.Image{{Name: "a", Reference: "nightly"}},
+			TopPulled: 2,
+		},
+	}))
+
+	statuses := r.Status()
+	require.Len(t, statuses, 1)
+	require.Equal(t, "nightly", statuses[0].Name)
+	require.Equal(t, "@every 1s", statuses[0].Schedule)
+	require.WithinDuration(t, time.Now().Add(time.Second), statuses[0].Next, time.Second)
+	require.Nil(t, statuses[0].Last)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errs := make(chan error)
+	go func() {
+		errs <- r.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		last := r.Status()[0].Last
+		return last != nil && last.FinishedAt != nil
+	}, time.Second*5, time.Millisecond*50)
+
+	cancel()
+	require.ErrorIs(t, <-errs, context.Canceled)
+
+	// Configured images are rebuilt along with the most pulled tags, but not twice.
+	last := r.Status()[0].Last
+	require.Equal(t, []rebuild.Result{
+		{Image: "a:nightly", Digest: digest.FromString("a:nightly")},
+		{Image: "b:edge", Error: "build failed"},
+	}, last.Results)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, built, 2)
+	require.Equal(t, built["a:nightly"], built["b:edge"])
+
+	// Runs are forgotten along with their schedules.
+	require.NoError(t, r.Update(nil, nil))
+	require.Empty(t, r.Status())
+
+	require.Error(t, r.Update(nil, []*rebuild.Schedule{{Name: "bad", Spec: "every day"}}))
+}
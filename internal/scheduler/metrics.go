@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"maps"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	resultSuccess   = "success"
+	resultFailure   = "failure"
+	resultCanceled  = "canceled"
+	resultAbandoned = "abandoned"
+)
+
+// metrics are the Scheduler's. Only the gauges, which are collected from the builds
+// that are queued and running, are by repository, since there are only so many of
+// those at once; the counters and histograms would otherwise have a series for
+// every repository that any client has ever asked for.
+type metrics struct {
+	queued       *prometheus.Desc
+	running      *prometheus.Desc
+	finished     *prometheus.CounterVec
+	deduplicated prometheus.Counter
+	rejected     prometheus.Counter
+	queueWait    prometheus.Histogram
+	duration     *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		queued: prometheus.NewDesc(
+			"sindri_builds_queued",
+			"Builds waiting to start, by repository and priority.",
+			[]string{"repository", "priority"}, nil,
+		),
+		running: prometheus.NewDesc(
+			"sindri_builds_running",
+			"Builds running, by repository.",
+			[]string{"repository"}, nil,
+		),
+		finished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sindri_builds_finished_total",
+			Help: "Builds that finished, by result: success, failure, canceled or abandoned by every waiting client while queued.",
+		}, []string{"result"}),
+		deduplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sindri_builds_deduplicated_total",
+			Help: "Requests that waited for a build of the same name and reference that was already queued or running.",
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sindri_builds_rejected_total",
+			Help: "Builds rejected because the queue was full.",
+		}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "sindri_build_queue_wait_seconds",
+			Help:    "How long builds waited in the queue before starting.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+		}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sindri_build_duration_seconds",
+			Help:    "How long builds ran for, by result.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}, []string{"result"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *Scheduler) Describe(ch chan<- *prometheus.Desc) {
+	s.init()
+
+	ch <- s.metrics.queued
+	ch <- s.metrics.running
+	s.metrics.finished.Describe(ch)
+	s.metrics.deduplicated.Describe(ch)
+	s.metrics.rejected.Describe(ch)
+	s.metrics.queueWait.Describe(ch)
+	s.metrics.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *Scheduler) Collect(ch chan<- prometheus.Metric) {
+	s.init()
+
+	type queuedKey struct {
+		repository string
+		priority   Priority
+	}
+
+	s.mu.Lock()
+	var (
+		running = maps.Clone(s.perRepo)
+		queued  = map[queuedKey]int{}
+	)
+	for _, j := range s.queue {
+		queued[queuedKey{j.key.name, j.priority}]++
+	}
+	s.mu.Unlock()
+
+	for k, n := range queued {
+		ch <- prometheus.MustNewConstMetric(s.metrics.queued, prometheus.GaugeValue, float64(n), k.repository, k.priority.String())
+	}
+	for repository, n := range running {
+		ch <- prometheus.MustNewConstMetric(s.metrics.running, prometheus.GaugeValue, float64(n), repository)
+	}
+	s.metrics.finished.Collect(ch)
+	s.metrics.deduplicated.Collect(ch)
+	s.metrics.rejected.Collect(ch)
+	s.metrics.queueWait.Collect(ch)
+	s.metrics.duration.Collect(ch)
+}
+
+var _ prometheus.Collector = new(Scheduler)
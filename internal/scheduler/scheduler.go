@@ -0,0 +1,455 @@
+// Package scheduler schedules sindri's builds, deduplicating concurrent
+// builds of the same name and reference and ordering the rest by priority
+// and fairly across repositories.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+// Priority orders queued builds. Builds with higher priorities start first.
+type Priority int
+
+const (
+	// PriorityAnonymous is the priority of builds for unauthenticated clients.
+	PriorityAnonymous Priority = iota
+	// PriorityAuthenticated is the priority of builds for authenticated clients.
+	PriorityAuthenticated
+	// PriorityPrewarm is the priority of builds that are requested ahead of pulls.
+	PriorityPrewarm
+)
+
+// String implements fmt.Stringer.
+func (p Priority) String() string {
+	switch p {
+	case PriorityAnonymous:
+		return "anonymous"
+	case PriorityAuthenticated:
+		return "authenticated"
+	case PriorityPrewarm:
+		return "prewarm"
+	}
+
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *Priority) UnmarshalText(text []byte) error {
+	for _, priority := range []Priority{PriorityAnonymous, PriorityAuthenticated, PriorityPrewarm} {
+		if priority.String() == string(text) {
+			*p = priority
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown priority %q", text)
+}
+
+// State is the state of a build.
+type State string
+
+const (
+	StateQueued  State = "queued"
+	StateRunning State = "running"
+)
+
+// ErrCanceled is returned to the waiters of a build that was canceled through Cancel.
+var ErrCanceled = errors.New("build canceled")
+
+// Func builds name and reference, returning its digest.
+type Func func(ctx context.Context) (digest.Digest, error)
+
+type key struct {
+	name, reference string
+}
+
+type job struct {
+	id         string
+	key        key
+	priority   Priority
+	client     string
+	seq        uint64
+	state      State
+	waiters    int
+	enqueuedAt time.Time
+	startedAt  time.Time
+	fn         Func
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	digest     digest.Digest
+	err        error
+}
+
+// Scheduler runs builds, limiting how many run at once in total and per client.
+// Concurrent builds of the same name and reference share a single run. Builds
+// that cannot start yet are queued; the next to start is the oldest of those with
+// the highest priority in the repository with the fewest running builds, taking
+// turns between repositories that are otherwise tied.
+type Scheduler struct {
+	// MaxConcurrent is how many builds may run at once. Zero means no limit.
+	MaxConcurrent int
+	// MaxConcurrentPerClient is how many builds each client may run at once. Zero means no limit.
+	MaxConcurrentPerClient int
+	// MaxQueued is how many builds may wait to start. Builds beyond it are rejected. Zero means no limit.
+	MaxQueued int
+	// RetryAfter is suggested to clients whose builds are rejected.
+	RetryAfter time.Duration
+
+	mu        sync.Mutex
+	seq       uint64
+	jobs      map[key]*job
+	queue     []*job
+	running   int
+	perClient map[string]int
+	perRepo   map[string]int
+	// turns records when each repository with queued or running builds last started one.
+	turns    map[string]uint64
+	turn     uint64
+	metrics  *metrics
+	initOnce sync.Once
+}
+
+func (s *Scheduler) init() {
+	s.initOnce.Do(func() {
+		s.jobs = map[key]*job{}
+		s.perClient = map[string]int{}
+		s.perRepo = map[string]int{}
+		s.turns = map[string]uint64{}
+		s.metrics = newMetrics()
+	})
+}
+
+// Do runs fn to build name and reference on behalf of client, or waits for a
+// build of the same name and reference that is already queued or running. If ctx
+// is done while the build is queued and no other clients are waiting for it, it is
+// removed from the queue. Once started, builds run until they finish, even if every
+// client waiting for them goes away, so that their results are stored. It returns a
+// *limit.Error if the queue is full. A nil *Scheduler runs fn immediately.
+func (s *Scheduler) Do(ctx context.Context, name, reference string, priority Priority, client string, fn Func) (digest.Digest, error) {
+	if s == nil {
+		return fn(ctx)
+	}
+
+	s.init()
+
+	k := key{name, reference}
+
+	s.mu.Lock()
+
+	j, ok := s.jobs[k]
+	if ok {
+		j.waiters++
+		if j.state == StateQueued && priority > j.priority {
+			j.priority = priority
+		}
+		s.metrics.deduplicated.Inc()
+	} else {
+		s.seq++
+		jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		j = &job{
+			id:         uuid.NewString(),
+			key:        k,
+			priority:   priority,
+			client:     client,
+			seq:        s.seq,
+			state:      StateQueued,
+			waiters:    1,
+			enqueuedAt: time.Now(),
+			fn:         fn,
+			ctx:        jobCtx,
+			cancel:     cancel,
+			done:       make(chan struct{}),
+		}
+		s.jobs[k] = j
+		s.queue = append(s.queue, j)
+		s.dispatch()
+
+		if j.state == StateQueued && s.MaxQueued > 0 && len(s.queue) > s.MaxQueued {
+			s.remove(j)
+			cancel()
+			s.metrics.rejected.Inc()
+			s.mu.Unlock()
+			return "", &limit.Error{Reason: "too many builds queued", RetryAfter: s.RetryAfter}
+		}
+	}
+
+	if j.state == StateQueued {
+		logutil.SloggerFrom(ctx).Info("build queued", "position", slices.Index(s.ordered(), j)+1, "running", s.running)
+	} else if ok {
+		logutil.SloggerFrom(ctx).Debug("waiting for running build")
+	}
+
+	s.mu.Unlock()
+
+	select {
+	case <-j.done:
+		return j.digest, j.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if j.waiters--; j.waiters == 0 && j.state == StateQueued {
+			s.remove(j)
+			s.finish(j, "", ctx.Err())
+			s.metrics.finished.WithLabelValues(resultAbandoned).Inc()
+		}
+
+		return "", ctx.Err()
+	}
+}
+
+// Position returns the 1-based position in the queue of the build of name and reference,
+// or 0 if it is not queued. Positions are a snapshot; builds with higher priorities may
+// later be queued ahead of it.
+func (s *Scheduler) Position(name, reference string) int {
+	if s == nil {
+		return 0
+	}
+
+	s.init()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, j := range s.ordered() {
+		if j.key == (key{name, reference}) {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// Cancel cancels the build with the given ID, whether it is queued or running,
+// reporting whether it was found. Its waiters get ErrCanceled.
+func (s *Scheduler) Cancel(id string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.init()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.id != id {
+			continue
+		}
+
+		switch j.state {
+		case StateQueued:
+			s.remove(j)
+			s.finish(j, "", ErrCanceled)
+			s.metrics.finished.WithLabelValues(resultCanceled).Inc()
+		case StateRunning:
+			j.err = ErrCanceled
+			j.cancel()
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Status describes a build that is queued or running.
+type Status struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Reference string   `json:"reference"`
+	State     State    `json:"state"`
+	Priority  Priority `json:"priority"`
+	Client    string   `json:"client"`
+	// Waiters is how many requests are waiting for the build.
+	Waiters int `json:"waiters"`
+	// Position is the 1-based position of a queued build in the queue.
+	Position   int        `json:"position,omitempty"`
+	EnqueuedAt time.Time  `json:"enqueuedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+}
+
+// Status returns the running builds followed by the queued builds in the order that they would start.
+func (s *Scheduler) Status() []Status {
+	statuses := []Status{}
+	if s == nil {
+		return statuses
+	}
+
+	s.init()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := []*job{}
+	for _, j := range s.jobs {
+		if j.state == StateRunning {
+			running = append(running, j)
+		}
+	}
+	slices.SortFunc(running, func(a, b *job) int {
+		return a.startedAt.Compare(b.startedAt)
+	})
+
+	for _, j := range running {
+		startedAt := j.startedAt
+		statuses = append(statuses, j.status(0, &startedAt))
+	}
+
+	for i, j := range s.ordered() {
+		statuses = append(statuses, j.status(i+1, nil))
+	}
+
+	return statuses
+}
+
+func (j *job) status(position int, startedAt *time.Time) Status {
+	return Status{
+		ID:         j.id,
+		Name:       j.key.name,
+		Reference:  j.key.reference,
+		State:      j.state,
+		Priority:   j.priority,
+		Client:     j.client,
+		Waiters:    j.waiters,
+		Position:   position,
+		EnqueuedAt: j.enqueuedAt,
+		StartedAt:  startedAt,
+	}
+}
+
+// ordered returns the queue in the order that it would start in if every build were startable.
+func (s *Scheduler) ordered() []*job {
+	ordered := slices.Clone(s.queue)
+	slices.SortStableFunc(ordered, s.compare)
+	return ordered
+}
+
+// compare orders a before b if it has a higher priority, then if its repository
+// has fewer running builds, then if its repository started a build less recently,
+// then if it was queued first.
+func (s *Scheduler) compare(a, b *job) int {
+	if a.priority != b.priority {
+		return int(b.priority) - int(a.priority)
+	}
+
+	if ra, rb := s.perRepo[a.key.name], s.perRepo[b.key.name]; ra != rb {
+		return ra - rb
+	}
+
+	if ta, tb := s.turns[a.key.name], s.turns[b.key.name]; ta < tb {
+		return -1
+	} else if ta > tb {
+		return 1
+	}
+
+	if a.seq < b.seq {
+		return -1
+	} else if a.seq > b.seq {
+		return 1
+	}
+
+	return 0
+}
+
+func (s *Scheduler) startable(j *job) bool {
+	return (s.MaxConcurrent <= 0 || s.running < s.MaxConcurrent) &&
+		(s.MaxConcurrentPerClient <= 0 || s.perClient[j.client] < s.MaxConcurrentPerClient)
+}
+
+// dispatch starts queued builds until no more can start.
+func (s *Scheduler) dispatch() {
+	for {
+		var next *job
+		for _, j := range s.queue {
+			if s.startable(j) && (next == nil || s.compare(j, next) < 0) {
+				next = j
+			}
+		}
+
+		if next == nil {
+			return
+		}
+
+		s.remove(next)
+		s.start(next)
+	}
+}
+
+func (s *Scheduler) remove(j *job) {
+	if i := slices.Index(s.queue, j); i >= 0 {
+		s.queue = slices.Delete(s.queue, i, i+1)
+	}
+}
+
+func (s *Scheduler) start(j *job) {
+	j.state = StateRunning
+	j.startedAt = time.Now()
+	s.running++
+	s.perClient[j.client]++
+	s.perRepo[j.key.name]++
+	s.turn++
+	s.turns[j.key.name] = s.turn
+	s.metrics.queueWait.Observe(j.startedAt.Sub(j.enqueuedAt).Seconds())
+
+	go func() {
+		d, err := j.fn(j.ctx)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.running--
+		if s.perClient[j.client]--; s.perClient[j.client] <= 0 {
+			delete(s.perClient, j.client)
+		}
+		if s.perRepo[j.key.name]--; s.perRepo[j.key.name] <= 0 {
+			delete(s.perRepo, j.key.name)
+		}
+
+		result := resultSuccess
+		if j.err != nil {
+			err = j.err
+			result = resultCanceled
+		} else if err != nil {
+			result = resultFailure
+		}
+		s.metrics.finished.WithLabelValues(result).Inc()
+		s.metrics.duration.WithLabelValues(result).Observe(time.Since(j.startedAt).Seconds())
+
+		s.finish(j, d, err)
+		s.dispatch()
+	}()
+}
+
+// finish records the result of j and releases its waiters.
+func (s *Scheduler) finish(j *job, d digest.Digest, err error) {
+	if s.jobs[j.key] == j {
+		delete(s.jobs, j.key)
+	}
+
+	if s.perRepo[j.key.name] == 0 && !slices.ContainsFunc(s.queue, func(q *job) bool {
+		return q.key.name == j.key.name
+	}) {
+		delete(s.turns, j.key.name)
+	}
+
+	j.digest, j.err = d, err
+	j.cancel()
+	close(j.done)
+}
@@ -0,0 +1,205 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// build returns a scheduler.Func that blocks until release is closed, returning a digest of name.
+func build(name string, started chan<- string, release <-chan struct{}) scheduler.Func {
+	return func(ctx context.Context) (digest.Digest, error) {
+		if started != nil {
+			started <- name
+		}
+
+		select {
+		case <-release:
+			return digest.FromString(name), nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+type result struct {
+	digest digest.Digest
+	err    error
+}
+
+// do calls s.Do in the background for ref, formatted "<name>[:<reference>]".
+func do(ctx context.Context, s *scheduler.Scheduler, ref string, priority scheduler.Priority, client string, fn scheduler.Func) <-chan result {
+	name, reference, ok := strings.Cut(ref, ":")
+	if !ok {
+		reference = "latest"
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		d, err := s.Do(ctx, name, reference, priority, client, fn)
+		ch <- result{d, err}
+	}()
+	return ch
+}
+
+func queued(s *scheduler.Scheduler, n int) func() bool {
+	return func() bool {
+		count := 0
+		for _, status := range s.Status() {
+			if status.State == scheduler.StateQueued {
+				count++
+			}
+		}
+		return count == n
+	}
+}
+
+func TestSchedulerDeduplicates(t *testing.T) {
+	var (
+		ctx     = t.Context()
+		s       = &scheduler.Scheduler{MaxQueued: 1}
+		started = make(chan string, 2)
+		release = make(chan struct{})
+	)
+
+	first := do(ctx, s, "a", scheduler.PriorityAnonymous, "ip:1", build("a", started, release))
+	require.Equal(t, "a", <-started)
+
+	second := do(ctx, s, "a", scheduler.PriorityAnonymous, "ip:2", build("a", started, release))
+	require.Eventually(t, func() bool {
+		status := s.Status()
+		return len(status) == 1 && status[0].Waiters == 2
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	require.Equal(t, result{digest.FromString("a"), nil}, <-first)
+	require.Equal(t, result{digest.FromString("a"), nil}, <-second)
+	require.Empty(t, started)
+	require.NoError(t, testutil.CollectAndCompare(s, strings.NewReader(`
+# HELP sindri_builds_deduplicated_total Requests that waited for a build of the same name and reference that was already queued or running.
+# TYPE sindri_builds_deduplicated_total counter
+sindri_builds_deduplicated_total 1
+`), "sindri_builds_deduplicated_total"))
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	var (
+		ctx      = t.Context()
+		s        = &scheduler.Scheduler{MaxConcurrent: 1, MaxQueued: 4}
+		started  = make(chan string, 5)
+		releases = map[string]chan struct{}{}
+		results  = map[string]<-chan result{}
+	)
+
+	for i, ref := range []string{"a:1", "a:2", "a:3", "b:1", "c:1"} {
+		priority := scheduler.PriorityAnonymous
+		if ref == "c:1" {
+			priority = scheduler.PriorityAuthenticated
+		}
+
+		releases[ref] = make(chan struct{})
+		results[ref] = do(ctx, s, ref, priority, "ip:1", build(ref, started, releases[ref]))
+
+		if i == 0 {
+			require.Equal(t, ref, <-started)
+		} else {
+			require.Eventually(t, queued(s, i), time.Second, time.Millisecond)
+		}
+	}
+
+	// The authenticated build goes first, then b's even though it was
+	// queued after a's, because a already has a build running.
+	require.Equal(t, 1, s.Position("c", "1"))
+	require.Equal(t, 2, s.Position("b", "1"))
+	require.Equal(t, 0, s.Position("a", "1"))
+
+	_, err := s.Do(ctx, "d", "1", scheduler.PriorityAnonymous, "ip:1", build("d:1", started, nil))
+	lerr := &limit.Error{}
+	require.True(t, errors.As(err, &lerr))
+
+	for i, ref := range []string{"a:1", "c:1", "b:1", "a:2", "a:3"} {
+		if i > 0 {
+			require.Equal(t, ref, <-started)
+		}
+		close(releases[ref])
+		require.Equal(t, result{digest.FromString(ref), nil}, <-results[ref])
+	}
+}
+
+func TestSchedulerUnlimitedQueue(t *testing.T) {
+	var (
+		ctx     = t.Context()
+		s       = &scheduler.Scheduler{MaxConcurrent: 1}
+		started = make(chan string, 3)
+		release = make(chan struct{})
+		results []<-chan result
+	)
+
+	// Zero MaxQueued, like the other limits, means no limit.
+	for i, ref := range []string{"a", "b", "c"} {
+		results = append(results, do(ctx, s, ref, scheduler.PriorityAnonymous, "ip:1", build(ref, started, release)))
+		if i == 0 {
+			require.Equal(t, ref, <-started)
+		} else {
+			require.Eventually(t, queued(s, i), time.Second, time.Millisecond)
+		}
+	}
+
+	close(release)
+	for _, res := range results {
+		require.NoError(t, (<-res).err)
+	}
+	require.NoError(t, testutil.CollectAndCompare(s, strings.NewReader(`
+# HELP sindri_builds_finished_total Builds that finished, by result: success, failure, canceled or abandoned by every waiting client while queued.
+# TYPE sindri_builds_finished_total counter
+sindri_builds_finished_total{result="success"} 3
+`), "sindri_builds_finished_total"))
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	var (
+		ctx     = t.Context()
+		s       = &scheduler.Scheduler{MaxConcurrent: 1, MaxQueued: 1}
+		started = make(chan string, 2)
+		release = make(chan struct{})
+	)
+	defer close(release)
+
+	running := do(ctx, s, "a", scheduler.PriorityAnonymous, "ip:1", build("a", started, release))
+	require.Equal(t, "a", <-started)
+
+	// A queued build is removed when every client waiting for it goes away.
+	waitCtx, cancel := context.WithCancel(ctx)
+	abandoned := do(waitCtx, s, "b", scheduler.PriorityAnonymous, "ip:1", build("b", started, release))
+	require.Eventually(t, queued(s, 1), time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, (<-abandoned).err, context.Canceled)
+	require.Eventually(t, queued(s, 0), time.Second, time.Millisecond)
+
+	// Builds can be canceled by ID, whether queued or running.
+	status := s.Status()
+	require.Len(t, status, 1)
+	require.True(t, s.Cancel(status[0].ID))
+	require.ErrorIs(t, (<-running).err, scheduler.ErrCanceled)
+	require.False(t, s.Cancel(status[0].ID))
+	require.Empty(t, started)
+}
+
+func TestSchedulerNil(t *testing.T) {
+	var s *scheduler.Scheduler
+
+	d, err := s.Do(t.Context(), "a", "latest", scheduler.PriorityAnonymous, "", func(context.Context) (digest.Digest, error) {
+		return digest.FromString("a"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, digest.FromString("a"), d)
+	require.Empty(t, s.Status())
+}
@@ -0,0 +1,18 @@
+// Package testutil has test doubles that are shared by sindri's tests.
+package testutil
+
+import (
+	"context"
+
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/opencontainers/go-digest"
+)
+
+// BuilderFunc adapts a function to the Builder interfaces
+// of the admin, rebuild and webhook packages.
+type BuilderFunc func(ctx context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error)
+
+// Build calls f.
+func (f BuilderFunc) Build(ctx context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error) {
+	return f(ctx, name, reference, priority)
+}
@@ -0,0 +1,84 @@
+// Package tlsutil contains utilities for serving TLS.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateReloader loads a TLS certificate from files, reloading
+// it whenever they change, e.g. when cert-manager rotates it.
+type CertificateReloader struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// NewCertificateReloader returns a *CertificateReloader for the given files,
+// erroring if they cannot be loaded.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{}
+	if err := r.SetFiles(certFile, keyFile); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// SetFiles changes the files that the certificate is loaded from,
+// erroring and keeping the previous ones if they cannot be loaded.
+func (r *CertificateReloader) SetFiles(certFile, keyFile string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.certFile, r.keyFile, r.modTime, r.cert = certFile, keyFile, modTime, &cert
+
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// NB: If the files are mid-rotation and cannot be loaded,
+	// keep serving the previous certificate until they can be.
+	if modTime, err := latestModTime(r.certFile, r.keyFile); err == nil && !modTime.Equal(r.modTime) {
+		if cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile); err == nil {
+			r.modTime, r.cert = modTime, &cert
+		}
+	}
+
+	return r.cert, nil
+}
+
+func latestModTime(names ...string) (time.Time, error) {
+	var latest time.Time
+
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if modTime := fi.ModTime(); modTime.After(latest) {
+			latest = modTime
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,331 @@
+// Package webhook receives push events from Git forges and rebuilds or
+// invalidates the tags of the images that are built from what was pushed.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/frantjc/sindri/internal/rebuild"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxPayloadBytes is the largest payload that is read, the same as GitHub's limit.
+const maxPayloadBytes = 25 << 20
+
+// HandlerOpts configures Handler.
+type HandlerOpts struct {
+	// GitHubSecret, if set, verifies the signatures of events from GitHub, which are otherwise not accepted.
+	GitHubSecret []byte
+	// GitLabToken, if set, verifies the secret tokens of events from GitLab, which are otherwise not accepted.
+	GitLabToken []byte
+	// GiteaSecret, if set, verifies the signatures of events from Gitea, which are otherwise not accepted.
+	GiteaSecret []byte
+	// Pulls are what the names under each pushed repository are found from.
+	Pulls *rebuild.Pulls
+	// Invalidations is where the tags that events affect are invalidated.
+	Invalidations *rebuild.Invalidations
+	// Builder, if set, rebuilds the tags that events affect in the background.
+	Builder Builder
+}
+
+// Builder builds images the same way that pulls do.
+type Builder interface {
+	Build(ctx context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error)
+}
+
+// HandlerOpt configures Handler.
+type HandlerOpt func(*HandlerOpts)
+
+// WithGitHubSecret sets HandlerOpts.GitHubSecret.
+func WithGitHubSecret(secret []byte) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.GitHubSecret = secret
+	}
+}
+
+// WithGitLabToken sets HandlerOpts.GitLabToken.
+func WithGitLabToken(token []byte) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.GitLabToken = token
+	}
+}
+
+// WithGiteaSecret sets HandlerOpts.GiteaSecret.
+func WithGiteaSecret(secret []byte) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.GiteaSecret = secret
+	}
+}
+
+// WithPulls sets HandlerOpts.Pulls.
+func WithPulls(pulls *rebuild.Pulls) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Pulls = pulls
+	}
+}
+
+// WithInvalidations sets HandlerOpts.Invalidations.
+func WithInvalidations(invalidations *rebuild.Invalidations) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Invalidations = invalidations
+	}
+}
+
+// WithBuilder sets HandlerOpts.Builder.
+func WithBuilder(builder Builder) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Builder = builder
+	}
+}
+
+// Event is a push of a branch or tag.
+type Event struct {
+	// Repository is the name of the repository as it is pulled, <host>/<owner>/<repo>.
+	Repository string
+	// Ref is the pushed branch or tag, e.g. main or v1.0.0.
+	Ref string
+	// DefaultBranch is whether Ref is the repository's default branch, which "latest" builds.
+	DefaultBranch bool
+	// Deleted is whether Ref was deleted.
+	Deleted bool
+}
+
+// References returns the references of the tags that e affects.
+func (e *Event) References() []string {
+	if e.DefaultBranch {
+		return []string{e.Ref, "latest"}
+	}
+
+	return []string{e.Ref}
+}
+
+// Affects reports whether e affects image.
+func (e *Event) Affects(image rebuild.Image) bool {
+	name := strings.ToLower(image.Name)
+	return (name == e.Repository || strings.HasPrefix(name, e.Repository+"/")) &&
+		slices.Contains(e.References(), image.Reference)
+}
+
+// Response is the body of responses to events.
+type Response struct {
+	// Images are the <name>:<reference>s that the event affected.
+	Images []string `json:"images"`
+}
+
+var (
+	errUnauthorized = errors.New("invalid signature")
+	// errIgnored is returned for events that are not pushes.
+	errIgnored = errors.New("ignored")
+)
+
+// parseFunc verifies and parses an event from a forge.
+type parseFunc func(r *http.Request, body []byte) (*Event, error)
+
+// Handler serves POST /webhooks/github, /webhooks/gitlab and /webhooks/gitea,
+// receiving push events of branches and tags from each forge that has a secret.
+func Handler(opts ...HandlerOpt) http.Handler {
+	var (
+		o   = &HandlerOpts{}
+		mux = http.NewServeMux()
+	)
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	handle := func(forge string, parse parseFunc) {
+		mux.HandleFunc("POST /webhooks/"+forge, func(w http.ResponseWriter, r *http.Request) {
+			var (
+				ctx = r.Context()
+				log = logutil.SloggerFrom(ctx).With("forge", forge)
+			)
+			log.Info(r.Method + " " + r.URL.Path)
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadBytes))
+			if err != nil {
+				httputil.WriteError(w, http.StatusRequestEntityTooLarge, httputil.ErrorCodeUnknown, err.Error())
+				return
+			}
+
+			event, err := parse(r, body)
+			switch {
+			case errors.Is(err, errUnauthorized):
+				httputil.WriteError(w, http.StatusUnauthorized, httputil.ErrorCodeUnauthorized, err.Error())
+				return
+			case errors.Is(err, errIgnored):
+				log.Debug(err.Error())
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case err != nil:
+				httputil.WriteError(w, http.StatusBadRequest, httputil.ErrorCodeUnknown, err.Error())
+				return
+			}
+
+			log = log.With("repository", event.Repository, "ref", event.Ref)
+
+			res := &Response{Images: []string{}}
+			for _, image := range o.Pulls.Images() {
+				if !event.Affects(image) {
+					continue
+				}
+
+				res.Images = append(res.Images, image.String())
+				o.Invalidations.Invalidate(image.Name, image.Reference)
+
+				if o.Builder != nil && !event.Deleted {
+					ctx := limit.ClientInto(logutil.SloggerInto(context.WithoutCancel(ctx), log), "webhook:"+forge)
+					go func() {
+						if d, err := o.Builder.Build(ctx, image.Name, image.Reference, scheduler.PriorityPrewarm); err != nil {
+							log.Warn("rebuilding", "image", image.String(), "err", err.Error())
+						} else {
+							log.Debug("rebuilt", "image", image.String(), "digest", d)
+						}
+					}()
+				}
+			}
+
+			log.Info("received push", "images", len(res.Images), "deleted", event.Deleted)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(res)
+		})
+	}
+
+	if len(o.GitHubSecret) > 0 {
+		handle("github", func(r *http.Request, body []byte) (*Event, error) {
+			if !validHMAC(o.GitHubSecret, body, strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")) {
+				return nil, errUnauthorized
+			}
+
+			if event := r.Header.Get("X-GitHub-Event"); event != "push" {
+				return nil, fmt.Errorf("%w: %s event", errIgnored, event)
+			}
+
+			return parsePush(body)
+		})
+	}
+
+	if len(o.GitLabToken) > 0 {
+		handle("gitlab", func(r *http.Request, body []byte) (*Event, error) {
+			if subtle.ConstantTimeCompare(o.GitLabToken, []byte(r.Header.Get("X-Gitlab-Token"))) != 1 {
+				return nil, errUnauthorized
+			}
+
+			if event := r.Header.Get("X-Gitlab-Event"); event != "Push Hook" && event != "Tag Push Hook" {
+				return nil, fmt.Errorf("%w: %s event", errIgnored, event)
+			}
+
+			return parsePush(body)
+		})
+	}
+
+	if len(o.GiteaSecret) > 0 {
+		handle("gitea", func(r *http.Request, body []byte) (*Event, error) {
+			if !validHMAC(o.GiteaSecret, body, r.Header.Get("X-Gitea-Signature")) {
+				return nil, errUnauthorized
+			}
+
+			if event := r.Header.Get("X-Gitea-Event"); event != "push" {
+				return nil, fmt.Errorf("%w: %s event", errIgnored, event)
+			}
+
+			return parsePush(body)
+		})
+	}
+
+	return mux
+}
+
+// validHMAC reports whether signature is the hex-encoded HMAC-SHA256 of body with secret.
+func validHMAC(secret, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// zeroSHA is the commit that deleted refs are pushed as.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// repository is the repository of a push event. GitHub and Gitea send it as
+// "repository", with its URL as "html_url", and GitLab as "project", with its
+// URL as "web_url".
+type repository struct {
+	HTMLURL       string `json:"html_url"`
+	WebURL        string `json:"web_url"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+// pushEvent is what sindri uses of GitHub's, GitLab's and Gitea's push events, which have these fields in common.
+type pushEvent struct {
+	Ref        string      `json:"ref"`
+	After      string      `json:"after"`
+	Deleted    bool        `json:"deleted"`
+	Repository *repository `json:"repository"`
+	Project    *repository `json:"project"`
+}
+
+func parsePush(body []byte) (*Event, error) {
+	push := &pushEvent{}
+	if err := json.Unmarshal(body, push); err != nil {
+		return nil, err
+	}
+
+	repo := push.Project
+	if repo == nil || repo.WebURL == "" {
+		repo = push.Repository
+	}
+	if repo == nil {
+		return nil, fmt.Errorf("push event has no repository")
+	}
+
+	rawURL := repo.HTMLURL
+	if rawURL == "" {
+		rawURL = repo.WebURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	} else if u.Host == "" {
+		return nil, fmt.Errorf("repository URL %q has no host", rawURL)
+	}
+
+	event := &Event{
+		Repository: strings.ToLower(u.Host + strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")),
+		Deleted:    push.Deleted || push.After == zeroSHA,
+	}
+
+	if branch, ok := strings.CutPrefix(push.Ref, "refs/heads/"); ok {
+		event.Ref = branch
+		event.DefaultBranch = branch == repo.DefaultBranch
+	} else if tag, ok := strings.CutPrefix(push.Ref, "refs/tags/"); ok {
+		event.Ref = tag
+	} else {
+		return nil, fmt.Errorf("%w: push of %q", errIgnored, push.Ref)
+	}
+
+	return event, nil
+}
@@ -0,0 +1,181 @@
+package webhook_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frantjc/sindri/internal/rebuild"
+	"github.com/frantjc/sindri/internal/scheduler"
+	"github.com/frantjc/sindri/internal/testutil"
+	"github.com/frantjc/sindri/internal/webhook"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandler(t *testing.T) {
+	var (
+		githubSecret  = []byte("github-secret")
+		gitlabToken   = []byte("gitlab-token")
+		giteaSecret   = []byte("gitea-secret")
+		pulls         = &rebuild.Pulls{}
+		invalidations = &rebuild.Invalidations{}
+		built         = make(chan string, 8)
+		srv           = httptest.NewServer(webhook.Handler(
+			webhook.WithGitHubSecret(githubSecret),
+			webhook.WithGitLabToken(gitlabToken),
+			webhook.WithGiteaSecret(giteaSecret),
+			webhook.WithPulls(pulls),
+			webhook.WithInvalidations(invalidations),
+			webhook.WithBuilder(testutil.BuilderFunc(func(_ context.Context, name, reference string, priority scheduler.Priority) (digest.Digest, error) {
+				require.Equal(t, scheduler.PriorityPrewarm, priority)
+				built <- name + ":" + reference
+				return digest.FromString(name + ":" + reference), nil
+			})),
+		))
+		storedAt = time.Now()
+	)
+	t.Cleanup(srv.Close)
+
+	for _, image := range []string{
+		"github.com/frantjc/sindri:latest",
+		"github.com/frantjc/sindri:v1",
+		"github.com/frantjc/sindri/testdata:main",
+		"github.com/frantjc/sindri-other:main",
+		"gitlab.com/jsmith/example:v1.0.0",
+		"gitlab.com/jsmith/example:main",
+		"gitea.example.com/gitea/webhooks/sub:edge",
+	} {
+		name, reference, _ := strings.Cut(image, ":")
+		pulls.Add(name, reference)
+	}
+
+	post := func(forge, payload string, header http.Header) *http.Response {
+		body, err := os.ReadFile(filepath.Join("testdata", payload))
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/webhooks/"+forge, bytes.NewReader(body))
+		require.NoError(t, err)
+
+		req.Header.Set("Content-Type", "application/json")
+		for key, values := range header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+
+		switch forge {
+		case "github":
+			if req.Header.Get("X-Hub-Signature-256") == "" {
+				req.Header.Set("X-Hub-Signature-256", "sha256="+sign(githubSecret, body))
+			}
+		case "gitlab":
+			if req.Header.Get("X-Gitlab-Token") == "" {
+				req.Header.Set("X-Gitlab-Token", string(gitlabToken))
+			}
+		case "gitea":
+			if req.Header.Get("X-Gitea-Signature") == "" {
+				req.Header.Set("X-Gitea-Signature", sign(giteaSecret, body))
+			}
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = res.Body.Close() })
+
+		return res
+	}
+
+	accepted := func(res *http.Response) []string {
+		t.Helper()
+		require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+		body := &webhook.Response{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(body))
+
+		return body.Images
+	}
+
+	receive := func(n int) []string {
+		t.Helper()
+
+		images := make([]string, n)
+		for i := range images {
+			select {
+			case images[i] = <-built:
+			case <-time.After(time.Second * 5):
+				t.Fatal("timed out waiting for builds")
+			}
+		}
+		sort.Strings(images)
+
+		return images
+	}
+
+	// Events with invalid signatures are rejected.
+	require.Equal(t, http.StatusUnauthorized, post("github", "github-push.json", http.Header{
+		"X-Github-Event":      {"push"},
+		"X-Hub-Signature-256": {"sha256=" + sign([]byte("wrong"), []byte("{}"))},
+	}).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, post("gitlab", "gitlab-tag-push.json", http.Header{
+		"X-Gitlab-Event": {"Tag Push Hook"},
+		"X-Gitlab-Token": {"wrong"},
+	}).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, post("gitea", "gitea-push-delete.json", http.Header{
+		"X-Gitea-Event":     {"push"},
+		"X-Gitea-Signature": {"not hex"},
+	}).StatusCode)
+	require.Empty(t, built)
+
+	// Events other than pushes are ignored.
+	require.Equal(t, http.StatusNoContent, post("github", "github-ping.json", http.Header{
+		"X-Github-Event": {"ping"},
+	}).StatusCode)
+
+	// A push to the default branch affects it and "latest" of the repository and the names under it.
+	expected := []string{
+		"github.com/frantjc/sindri/testdata:main",
+		"github.com/frantjc/sindri:latest",
+	}
+	require.ElementsMatch(t, expected, accepted(post("github", "github-push.json", http.Header{
+		"X-Github-Event": {"push"},
+	})))
+	sort.Strings(expected)
+	require.Equal(t, expected, receive(2))
+	require.True(t, invalidations.Invalidated("github.com/frantjc/sindri", "latest", storedAt))
+	require.False(t, invalidations.Invalidated("github.com/frantjc/sindri", "v1", storedAt))
+	require.False(t, invalidations.Invalidated("github.com/frantjc/sindri-other", "main", storedAt))
+
+	// A push of a tag affects only it.
+	require.Equal(t, []string{"gitlab.com/jsmith/example:v1.0.0"}, accepted(post("gitlab", "gitlab-tag-push.json", http.Header{
+		"X-Gitlab-Event": {"Tag Push Hook"},
+	})))
+	require.Equal(t, []string{"gitlab.com/jsmith/example:v1.0.0"}, receive(1))
+
+	// A deleted branch is invalidated but not rebuilt. Names are matched case-insensitively.
+	require.Equal(t, []string{"gitea.example.com/gitea/webhooks/sub:edge"}, accepted(post("gitea", "gitea-push-delete.json", http.Header{
+		"X-Gitea-Event": {"push"},
+	})))
+	require.True(t, invalidations.Invalidated("gitea.example.com/gitea/webhooks/sub", "edge", storedAt))
+	require.Empty(t, built)
+
+	// Tags that have been stored since they were invalidated are no longer.
+	require.False(t, invalidations.Invalidated("github.com/frantjc/sindri", "latest", time.Now()))
+}
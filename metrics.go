@@ -0,0 +1,174 @@
+package sindri
+
+import (
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherRepository labels metrics of repositories that Metrics were not given.
+const otherRepository = "other"
+
+const (
+	tagResultHit     = "hit"
+	tagResultStale   = "stale"
+	tagResultRebuild = "rebuild"
+	tagResultError   = "error"
+)
+
+// Metrics are the Prometheus metrics of Handler. A single Metrics may be
+// shared by successive Handlers so that its counters survive reloads.
+type Metrics struct {
+	repositories  []*auth.Glob
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	tags          *prometheus.HistogramVec
+	servedBytes   *prometheus.CounterVec
+	backendErrors *prometheus.CounterVec
+}
+
+// NewMetrics returns new Metrics. Requests and tag resolutions are labeled by their
+// repository if it matches any of repositories and "other" if not, so that there are
+// only so many series no matter what repositories clients ask for.
+func NewMetrics(repositories []*auth.Glob) *Metrics {
+	return &Metrics{
+		repositories: repositories,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sindri_http_requests_total",
+			Help: "Requests served, by API, status code and repository.",
+		}, []string{"api", "code", "repository"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sindri_http_request_duration_seconds",
+			Help:    "How long requests took to serve, by API, status code and repository.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+		}, []string{"api", "code", "repository"}),
+		tags: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sindri_tag_resolution_duration_seconds",
+			Help:    "How long resolving a tag to a digest took, by repository and result: hit, when the stored tag was fresh, stale, when it was served while being rebuilt, rebuild or error.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 12),
+		}, []string{"result", "repository"}),
+		servedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sindri_backend_served_bytes_total",
+			Help: "Bytes of manifests and blobs served, by backend and API.",
+		}, []string{"backend", "api"}),
+		backendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sindri_backend_errors_total",
+			Help: "Backend operations that failed with server errors, by backend and operation.",
+		}, []string{"backend", "operation"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+	m.tags.Describe(ch)
+	m.servedBytes.Describe(ch)
+	m.backendErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+	m.tags.Collect(ch)
+	m.servedBytes.Collect(ch)
+	m.backendErrors.Collect(ch)
+}
+
+var _ prometheus.Collector = new(Metrics)
+
+// repository returns the label for name, which is empty for requests that are not for a repository.
+func (m *Metrics) repository(name string) string {
+	if name == "" || auth.MatchAny(m.repositories, name) {
+		return name
+	}
+
+	return otherRepository
+}
+
+func (m *Metrics) observeRequest(api, name string, rec *httputil.ResponseRecorder, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	var (
+		code       = strconv.Itoa(rec.Status())
+		repository = m.repository(name)
+	)
+	m.requests.WithLabelValues(api, code, repository).Inc()
+	m.duration.WithLabelValues(api, code, repository).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeTag(result, name string, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.tags.WithLabelValues(result, m.repository(name)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) addServedBytes(backend, api string, n int64) {
+	if m == nil {
+		return
+	}
+
+	m.servedBytes.WithLabelValues(backend, api).Add(float64(n))
+}
+
+// backendError counts err against backend and operation if it is a server error.
+func (m *Metrics) backendError(backend, operation string, err error) {
+	if m == nil || err == nil || httputil.HTTPStatusCode(err) < http.StatusInternalServerError {
+		return
+	}
+
+	m.backendErrors.WithLabelValues(backend, operation).Inc()
+}
+
+// backendName names b for metrics after the package that implements it, e.g. "bucket".
+func backendName(b any) string {
+	t := reflect.TypeOf(b)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t.PkgPath() == "" {
+		return "unknown"
+	}
+
+	return path.Base(t.PkgPath())
+}
+
+// repositoryName returns the name of the repository that a request to urlPath
+// is for, or an empty string if it is not for a repository.
+func repositoryName(urlPath string) string {
+	switch apiName(urlPath) {
+	case "manifests", "blobs":
+		return strings.TrimPrefix(path.Dir(path.Dir(urlPath)), "/v2/")
+	}
+
+	return ""
+}
+
+// apiName names the API that a request to urlPath is for.
+func apiName(urlPath string) string {
+	switch {
+	case urlPath == "/v2" || urlPath == "/v2/":
+		return "base"
+	case urlPath == "/v2/token":
+		return "token"
+	case path.Base(path.Dir(urlPath)) == "manifests":
+		return "manifests"
+	case path.Base(path.Dir(urlPath)) == "blobs":
+		return "blobs"
+	}
+
+	return "other"
+}
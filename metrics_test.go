@@ -0,0 +1,86 @@
+package sindri_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/frantjc/sindri"
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type blobBackend struct {
+	blobs map[digest.Digest]string
+}
+
+func (b *blobBackend) Store(context.Context, *dagger.Container, *dagger.Client, string, string) (digest.Digest, error) {
+	return "", errors.New("not implemented")
+}
+
+func (b *blobBackend) Manifest(context.Context, string, digest.Digest) (http.Handler, error) {
+	return nil, httputil.NewError(errors.New("manifests unavailable"), http.StatusServiceUnavailable)
+}
+
+func (b *blobBackend) Blob(_ context.Context, _ string, d digest.Digest) (http.Handler, error) {
+	blob, ok := b.blobs[d]
+	if !ok {
+		return nil, httputil.NewError(errors.New("blob unknown"), http.StatusNotFound)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, blob)
+	}), nil
+}
+
+func (b *blobBackend) Close() error {
+	return nil
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	repositories, err := auth.CompileGlobs([]string{"a/**"})
+	require.NoError(t, err)
+
+	var (
+		blob    = "hello"
+		d       = digest.FromString(blob)
+		metrics = sindri.NewMetrics(repositories)
+		srv     = httptest.NewServer(sindri.Handler(nil, &blobBackend{blobs: map[digest.Digest]string{d: blob}}, sindri.WithMetrics(metrics)))
+	)
+	t.Cleanup(srv.Close)
+
+	for _, path := range []string{
+		"/v2/",
+		"/v2/a/b/blobs/" + d.String(),
+		"/v2/a/b/blobs/" + digest.FromString("missing").String(),
+		"/v2/c/manifests/" + d.String(),
+	} {
+		res, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, res.Body)
+		require.NoError(t, res.Body.Close())
+	}
+
+	require.NoError(t, testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP sindri_backend_errors_total Backend operations that failed with server errors, by backend and operation.
+# TYPE sindri_backend_errors_total counter
+sindri_backend_errors_total{backend="sindri_test",operation="manifest"} 1
+# HELP sindri_backend_served_bytes_total Bytes of manifests and blobs served, by backend and API.
+# TYPE sindri_backend_served_bytes_total counter
+sindri_backend_served_bytes_total{api="blobs",backend="sindri_test"} 5
+# HELP sindri_http_requests_total Requests served, by API, status code and repository.
+# TYPE sindri_http_requests_total counter
+sindri_http_requests_total{api="base",code="200",repository=""} 1
+sindri_http_requests_total{api="blobs",code="200",repository="a/b"} 1
+sindri_http_requests_total{api="blobs",code="404",repository="a/b"} 1
+sindri_http_requests_total{api="manifests",code="503",repository="other"} 1
+`), "sindri_backend_errors_total", "sindri_backend_served_bytes_total", "sindri_http_requests_total"))
+}
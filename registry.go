@@ -1,24 +1,337 @@
 package sindri
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/frantjc/sindri/backend"
-	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/distribution"
+	"github.com/frantjc/sindri/internal/engine"
+	"github.com/frantjc/sindri/internal/failure"
 	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/frantjc/sindri/internal/limit"
 	"github.com/frantjc/sindri/internal/logutil"
+	"github.com/frantjc/sindri/internal/policy"
+	"github.com/frantjc/sindri/internal/rebuild"
+	"github.com/frantjc/sindri/internal/scheduler"
 	"github.com/google/uuid"
 	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const tracerName = "github.com/frantjc/sindri"
+
 func dig(reference string) (digest.Digest, bool) {
 	d := digest.Digest(reference)
 	return d, d.Validate() == nil
 }
 
-func Handler(dag *dagger.Client, b backend.Backend) http.Handler {
-	mux := http.NewServeMux()
+// HandlerOpts configures Handler.
+type HandlerOpts struct {
+	// TagMaxAge is how long after a tag is stored that it is served as-is instead of
+	// being rebuilt. Requires a backend.TagBackend. Zero means always rebuild.
+	TagMaxAge time.Duration
+	// TagStaleWhileRevalidate is how long after TagMaxAge that a tag is still served
+	// as-is while it is rebuilt in the background. Older tags are rebuilt before
+	// they are served. Zero means never serve stale tags.
+	TagStaleWhileRevalidate time.Duration
+	// BuildTimeout limits how long a build may take. Zero means no limit.
+	BuildTimeout time.Duration
+	// Auth, if set, makes Sindri authenticate clients and issue them tokens itself
+	// instead of deferring to the backend if it is a backend.AuthBackend.
+	Auth *auth.Service
+	// Policy, if set, decides which names and references clients may pull and build.
+	Policy *policy.Policy
+	// Scheduler, if set, schedules builds, deduplicating concurrent builds
+	// of the same name and reference and limiting how many run at once.
+	Scheduler *scheduler.Scheduler
+	// Failures, if set, remembers builds that failed so that retries of them fail fast.
+	Failures *failure.Cache
+	// Rate, if set, limits how often each client may pull manifests by tag that
+	// are built, whether before they are served or in the background while they
+	// are served stale. Other pulls, which never cause builds, are exempt.
+	Rate *limit.Rate
+	// Metrics, if set, are updated as requests are served.
+	Metrics *Metrics
+	// NoBuild makes Sindri serve only what is already in the backend, resolving tags
+	// through its index regardless of their age and never building. Requires a
+	// backend.TagBackend. Handler's Dagger is not used and may be nil.
+	NoBuild bool
+	// Pulls, if set, counts pulls of tags that were served so that the most pulled can be rebuilt.
+	Pulls *rebuild.Pulls
+	// Invalidations, if set, are tags that are rebuilt instead of served as they were
+	// stored if they were invalidated since, regardless of TagMaxAge.
+	Invalidations *rebuild.Invalidations
+	// Builder, if set, builds tags instead of a Builder that builds with Handler's Dagger
+	// and stores in its backend, e.g. so that builds can outlive Handler when it is
+	// replaced. Its own HandlerOpts apply to the builds instead of these.
+	Builder *Builder
+}
+
+// HandlerOpt configures Handler.
+type HandlerOpt func(*HandlerOpts)
+
+// WithTagMaxAge sets HandlerOpts.TagMaxAge.
+func WithTagMaxAge(tagMaxAge time.Duration) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.TagMaxAge = tagMaxAge
+	}
+}
+
+// WithTagStaleWhileRevalidate sets HandlerOpts.TagStaleWhileRevalidate.
+func WithTagStaleWhileRevalidate(tagStaleWhileRevalidate time.Duration) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.TagStaleWhileRevalidate = tagStaleWhileRevalidate
+	}
+}
+
+// WithAuth sets HandlerOpts.Auth.
+func WithAuth(a *auth.Service) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Auth = a
+	}
+}
+
+// WithPolicy sets HandlerOpts.Policy.
+func WithPolicy(p *policy.Policy) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Policy = p
+	}
+}
+
+// WithScheduler sets HandlerOpts.Scheduler.
+func WithScheduler(s *scheduler.Scheduler) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Scheduler = s
+	}
+}
+
+// WithFailures sets HandlerOpts.Failures.
+func WithFailures(failures *failure.Cache) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Failures = failures
+	}
+}
+
+// WithRateLimit sets HandlerOpts.Rate.
+func WithRateLimit(rate *limit.Rate) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Rate = rate
+	}
+}
+
+// WithMetrics sets HandlerOpts.Metrics.
+func WithMetrics(m *Metrics) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Metrics = m
+	}
+}
+
+// WithNoBuild sets HandlerOpts.NoBuild.
+func WithNoBuild(noBuild bool) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.NoBuild = noBuild
+	}
+}
+
+// WithPulls sets HandlerOpts.Pulls.
+func WithPulls(pulls *rebuild.Pulls) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Pulls = pulls
+	}
+}
+
+// WithInvalidations sets HandlerOpts.Invalidations.
+func WithInvalidations(invalidations *rebuild.Invalidations) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Invalidations = invalidations
+	}
+}
+
+// WithBuilder sets HandlerOpts.Builder.
+func WithBuilder(builder *Builder) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.Builder = builder
+	}
+}
+
+// WithBuildTimeout sets HandlerOpts.BuildTimeout.
+func WithBuildTimeout(buildTimeout time.Duration) HandlerOpt {
+	return func(o *HandlerOpts) {
+		o.BuildTimeout = buildTimeout
+	}
+}
+
+var (
+	errDenied   = errors.New("denied")
+	errNotBuilt = errors.New("not built")
+)
+
+// Dagger provides the sessions with Dagger engines that builds run in,
+// e.g. an *engine.Conn or an *engine.Pool.
+type Dagger interface {
+	// Acquire returns a Lease on the session to build name in, or an error,
+	// e.g. an *engine.UnavailableError, if there is none.
+	Acquire(ctx context.Context, name string) (*engine.Lease, error)
+}
+
+func Handler(dag Dagger, b backend.Backend, opts ...HandlerOpt) http.Handler {
+	var (
+		o   = &HandlerOpts{}
+		mux = http.NewServeMux()
+	)
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var (
+		tb, isTagBackend = b.(backend.TagBackend)
+		backendName      = backendName(b)
+	)
+
+	builder := o.Builder
+	if builder == nil {
+		builder = newBuilder(dag, b, o)
+	}
+
+	// authorizeBuild returns the priority to build name and reference at for the client
+	// in ctx, or an error if the policy denies it the build or it is being rate limited.
+	authorizeBuild := func(ctx context.Context, name, reference string) (scheduler.Priority, error) {
+		identity, _ := auth.IdentityFrom(ctx)
+		if !o.Policy.Allowed(identity, policy.ActionBuild, name, reference) {
+			return 0, fmt.Errorf("%w: build %s:%s", errDenied, name, reference)
+		}
+
+		if err := o.Rate.Allow(limit.ClientFrom(ctx)); err != nil {
+			return 0, err
+		}
+
+		if identity != nil {
+			return scheduler.PriorityAuthenticated, nil
+		}
+
+		return scheduler.PriorityAnonymous, nil
+	}
+
+	// revalidating is the name:references that are being rebuilt in the background.
+	var revalidating sync.Map
+
+	// revalidate rebuilds name and reference in the background to refresh the stale
+	// tag that is being served, unless it is already being rebuilt or the client
+	// that is being served it may not build it.
+	revalidate := func(ctx context.Context, name, reference string) {
+		key := name + ":" + reference
+		if _, ok := revalidating.LoadOrStore(key, struct{}{}); ok {
+			return
+		}
+
+		log := logutil.SloggerFrom(ctx)
+
+		priority, err := authorizeBuild(ctx, name, reference)
+		if err != nil {
+			revalidating.Delete(key)
+			log.Debug("not revalidating stale tag", "err", err.Error())
+			return
+		}
+
+		go func() {
+			defer revalidating.Delete(key)
+
+			ctx := context.WithoutCancel(ctx)
+			if d, err := builder.Build(ctx, name, reference, priority); err != nil {
+				log.Warn("revalidating stale tag", "err", err.Error())
+			} else {
+				log.Debug("revalidated stale tag", "digest", d)
+			}
+		}()
+	}
+
+	// tagError records err from looking up a stored tag, which is expected to
+	// be not found for tags that were never stored but is otherwise worth a warning.
+	tagError := func(log *slog.Logger, err error) {
+		o.Metrics.backendError(backendName, "tag", err)
+		if httputil.HTTPStatusCode(err) == http.StatusNotFound {
+			log.Debug("stored tag not found", "err", err.Error())
+		} else {
+			log.Warn("looking up stored tag", "err", err.Error())
+		}
+	}
+
+	store := func(ctx context.Context, name, reference string) (d digest.Digest, err error) {
+		var (
+			log    = logutil.SloggerFrom(ctx)
+			start  = time.Now()
+			result = tagResultRebuild
+		)
+		defer func() {
+			if err != nil {
+				result = tagResultError
+			} else {
+				o.Pulls.Add(name, reference)
+			}
+			o.Metrics.observeTag(result, name, start)
+		}()
+
+		if o.NoBuild {
+			if !isTagBackend {
+				return "", fmt.Errorf("%w: %s:%s: backend does not index tags", errNotBuilt, name, reference)
+			}
+
+			d, _, err := tb.Tag(ctx, name, reference)
+			if err != nil {
+				tagError(log, err)
+				if httputil.HTTPStatusCode(err) < http.StatusInternalServerError {
+					return "", fmt.Errorf("%w: %s:%s: %w", errNotBuilt, name, reference, err)
+				}
+
+				return "", err
+			}
+
+			log.Debug("serving stored tag", "digest", d)
+			result = tagResultHit
+			return d, nil
+		}
+
+		if isTagBackend && o.TagMaxAge > 0 {
+			d, storedAt, err := tb.Tag(ctx, name, reference)
+			switch age := time.Since(storedAt); {
+			case err != nil:
+				tagError(log, err)
+			case o.Invalidations.Invalidated(name, reference, storedAt):
+				log.Debug("stored tag was invalidated", "digest", d, "age", age)
+			case age < o.TagMaxAge:
+				log.Debug("serving stored tag", "digest", d, "age", age)
+				result = tagResultHit
+				return d, nil
+			case age < o.TagMaxAge+o.TagStaleWhileRevalidate:
+				// NB: The stale tag is served regardless of whether the client may build it;
+				// the policy and limits only apply to revalidating it in the background.
+				revalidate(ctx, name, reference)
+				log.Debug("serving stale tag", "digest", d, "age", age)
+				result = tagResultStale
+				return d, nil
+			}
+		}
+
+		priority, err := authorizeBuild(ctx, name, reference)
+		if err != nil {
+			return "", err
+		}
+
+		return builder.Build(ctx, name, reference, priority)
+	}
 
 	mux.HandleFunc("GET /v2", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/v2/", http.StatusMovedPermanently)
@@ -26,13 +339,25 @@ func Handler(dag *dagger.Client, b backend.Backend) http.Handler {
 
 	// TODO(frantjc): Use github.com/opencontainers/distribution-spec/specs-go/v1.ErrorResponse with correct error codes
 	// instead of http.Error(). See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes.
-	if ab, ok := b.(backend.AuthBackend); ok {
+	if o.Auth != nil {
+		mux.HandleFunc("GET /v2/{$}", func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := auth.ClaimsFrom(r.Context()); !ok {
+				o.Auth.Challenge(w, r, "")
+				return
+			}
+
+			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		})
+
+		mux.Handle("GET /v2/token", o.Auth.TokenHandler())
+	} else if ab, ok := b.(backend.AuthBackend); ok {
 		mux.HandleFunc("GET /v2/{$}", func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			log := logutil.SloggerFrom(ctx)
 
 			handler, err := ab.Root(ctx)
 			if err != nil {
+				o.Metrics.backendError(backendName, "root", err)
 				log.Error(err.Error())
 				http.Error(w, err.Error(), httputil.HTTPStatusCode(err))
 				return
@@ -47,6 +372,7 @@ func Handler(dag *dagger.Client, b backend.Backend) http.Handler {
 
 			handler, err := ab.Token(ctx)
 			if err != nil {
+				o.Metrics.backendError(backendName, "token", err)
 				log.Error(err.Error())
 				http.Error(w, err.Error(), httputil.HTTPStatusCode(err))
 				return
@@ -77,19 +403,94 @@ func Handler(dag *dagger.Client, b backend.Backend) http.Handler {
 		log := logutil.SloggerFrom(ctx).With("name", name, "reference", reference)
 		ctx = logutil.SloggerInto(ctx, log)
 
+		if api != "manifests" && api != "blobs" {
+			http.NotFound(w, r)
+			return
+		}
+
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("sindri.name", name),
+			attribute.String("sindri.reference", reference),
+		)
+
+		if err := distribution.ValidateName(name); err != nil {
+			httputil.WriteError(w, http.StatusBadRequest, httputil.ErrorCodeNameInvalid, err.Error())
+			return
+		}
+
+		validateReference := distribution.ValidateReference
+		if api == "blobs" {
+			validateReference = distribution.ValidateDigest
+		}
+
+		if err := validateReference(reference); errors.Is(err, distribution.ErrDigestInvalid) {
+			httputil.WriteError(w, http.StatusBadRequest, httputil.ErrorCodeDigestInvalid, err.Error())
+			return
+		} else if err != nil {
+			httputil.WriteError(w, http.StatusBadRequest, httputil.ErrorCodeTagInvalid, err.Error())
+			return
+		}
+
+		if o.Auth != nil {
+			if claims, ok := auth.ClaimsFrom(ctx); !ok || !claims.Allows(name, auth.ActionPull) {
+				o.Auth.Challenge(w, r, auth.Scope(name))
+				return
+			}
+		}
+
+		// Blobs have no reference, so rules that are scoped to references do not apply to them.
+		policyReference := reference
+		if api == "blobs" {
+			policyReference = ""
+		}
+
+		if identity, _ := auth.IdentityFrom(ctx); !o.Policy.Allowed(identity, policy.ActionPull, name, policyReference) {
+			log.Debug("denied by policy", "action", policy.ActionPull)
+			httputil.WriteError(w, http.StatusForbidden, httputil.ErrorCodeDenied, "pull "+name+" denied")
+			return
+		}
+
 		switch api {
 		case "manifests":
 			d, ok := dig(reference)
 			if !ok {
-				var err error
-				if d, err = b.Store(
-					ctx,
-					// FIXME(frantjc): Hopefuly a temporary workaround for dag.Sindri() not being generated.
-					new(dagger.Sindri{}).WithGraphQLQuery(dag.QueryBuilder().Select("sindri")).Image(name, reference),
-					dag,
-					name,
-					reference,
-				); err != nil {
+				var (
+					err  error
+					lerr = &limit.Error{}
+					ferr = &failure.Error{}
+					uerr = &engine.UnavailableError{}
+				)
+				if d, err = store(ctx, name, reference); errors.Is(err, errDenied) {
+					log.Debug("denied by policy", "action", policy.ActionBuild)
+					httputil.WriteError(w, http.StatusForbidden, httputil.ErrorCodeDenied, err.Error())
+					return
+				} else if errors.Is(err, errNotBuilt) {
+					log.Debug(err.Error())
+					httputil.WriteError(w, http.StatusNotFound, httputil.ErrorCodeManifestUnknown, err.Error())
+					return
+				} else if errors.As(err, &lerr) {
+					log.Debug(err.Error())
+					tooManyRequests(w, lerr)
+					return
+				} else if errors.As(err, &uerr) {
+					log.Warn(err.Error())
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(uerr.RetryAfter.Seconds()))))
+					httputil.WriteError(w, http.StatusServiceUnavailable, httputil.ErrorCodeUnavailable, err.Error())
+					return
+				} else if errors.As(err, &ferr) {
+					log.Debug(err.Error())
+					if ferr.Permanent {
+						code := httputil.ErrorCodeUnknown
+						if httputil.HTTPStatusCode(err) == http.StatusNotFound {
+							code = httputil.ErrorCodeManifestUnknown
+						}
+						httputil.WriteError(w, httputil.HTTPStatusCode(err), code, err.Error())
+						return
+					}
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(ferr.Until).Seconds()))))
+					httputil.WriteError(w, http.StatusServiceUnavailable, httputil.ErrorCodeUnavailable, err.Error())
+					return
+				} else if err != nil {
 					log.Error(err.Error())
 					http.Error(w, err.Error(), httputil.HTTPStatusCode(err))
 					return
@@ -101,6 +502,7 @@ func Handler(dag *dagger.Client, b backend.Backend) http.Handler {
 				name, d,
 			)
 			if err != nil {
+				o.Metrics.backendError(backendName, "manifest", err)
 				log.Error(err.Error())
 				http.Error(w, err.Error(), httputil.HTTPStatusCode(err))
 				return
@@ -113,6 +515,7 @@ func Handler(dag *dagger.Client, b backend.Backend) http.Handler {
 				name, digest.Digest(reference),
 			)
 			if err != nil {
+				o.Metrics.backendError(backendName, "blob", err)
 				log.Error(err.Error())
 				http.Error(w, err.Error(), httputil.HTTPStatusCode(err))
 				return
@@ -124,10 +527,54 @@ func Handler(dag *dagger.Client, b backend.Backend) http.Handler {
 		}
 	})
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		log := logutil.SloggerFrom(ctx).With("request", uuid.NewString())
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			ctx   = r.Context()
+			log   = logutil.SloggerFrom(ctx).With("request", uuid.NewString())
+			rec   = httputil.NewResponseRecorder(w)
+			api   = apiName(r.URL.Path)
+			start = time.Now()
+		)
+		defer func() {
+			o.Metrics.observeRequest(api, repositoryName(r.URL.Path), rec, start)
+			if (api == "manifests" || api == "blobs") && rec.Status() < http.StatusMultipleChoices {
+				o.Metrics.addServedBytes(backendName, api, rec.Written())
+			}
+		}()
+
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			log = log.With("trace", sc.TraceID().String())
+		}
+
+		identity, claims := o.Auth.Identify(r)
+		if claims != nil {
+			ctx = auth.ClaimsInto(ctx, claims)
+		}
+
+		if identity != nil {
+			ctx = auth.IdentityInto(ctx, identity)
+			log = log.With("identity", identity)
+		}
+
+		ctx = limit.ClientInto(ctx, limit.Client(r.WithContext(ctx)))
+
 		log.Info(r.Method + " " + r.URL.Path)
-		mux.ServeHTTP(w, r.WithContext(logutil.SloggerInto(ctx, log)))
+		mux.ServeHTTP(rec, r.WithContext(logutil.SloggerInto(ctx, log)))
 	})
+
+	// Spans are started from the client's W3C trace context, if any, by way of the global propagator.
+	return otelhttp.NewHandler(handler, "sindri",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + apiName(r.URL.Path)
+		}),
+	)
+}
+
+func tooManyRequests(w http.ResponseWriter, err error) {
+	lerr := &limit.Error{}
+	if errors.As(err, &lerr) {
+		w.Header().Set("Retry-After", lerr.RetryAfterSeconds())
+	}
+
+	httputil.WriteError(w, http.StatusTooManyRequests, httputil.ErrorCodeTooManyRequests, err.Error())
 }
@@ -0,0 +1,358 @@
+package sindri_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dagger/querybuilder"
+	"github.com/frantjc/sindri"
+	"github.com/frantjc/sindri/internal/auth"
+	"github.com/frantjc/sindri/internal/dagger"
+	"github.com/frantjc/sindri/internal/engine"
+	"github.com/frantjc/sindri/internal/failure"
+	"github.com/frantjc/sindri/internal/httputil"
+	"github.com/frantjc/sindri/internal/limit"
+	"github.com/frantjc/sindri/internal/policy"
+	"github.com/frantjc/sindri/internal/rebuild"
+	specs "github.com/opencontainers/distribution-spec/specs-go/v1"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDagger leases clients without sessions for fake backends, which never use them.
+type fakeDagger struct{}
+
+func (fakeDagger) Acquire(context.Context, string) (*engine.Lease, error) {
+	return &engine.Lease{
+		Client: &dagger.Client{Query: new(dagger.Query).WithGraphQLQuery(querybuilder.Query())},
+	}, nil
+}
+
+// tagBackend is a backend.TagBackend that indexes each tag that it stores.
+type tagBackend struct {
+	mu        sync.Mutex
+	tags      map[string]digest.Digest
+	storedAt  time.Time
+	manifests map[digest.Digest]string
+	blobs     map[digest.Digest]string
+	// built receives the reference of each build. If nil, builds fail.
+	built chan string
+}
+
+func (b *tagBackend) Store(_ context.Context, _ *dagger.Container, _ *dagger.Client, _, reference string) (digest.Digest, error) {
+	if b.built == nil {
+		return "", errors.New("not implemented")
+	}
+
+	var (
+		manifest = fmt.Sprintf(`{"schemaVersion":2,"annotations":{"built":%q}}`, time.Now())
+		d        = digest.FromString(manifest)
+	)
+
+	b.mu.Lock()
+	b.tags[reference] = d
+	b.manifests[d] = manifest
+	b.storedAt = time.Now()
+	b.mu.Unlock()
+
+	b.built <- reference
+	return d, nil
+}
+
+func (b *tagBackend) Tag(_ context.Context, _, reference string) (digest.Digest, time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, ok := b.tags[reference]
+	if !ok {
+		return "", time.Time{}, httputil.NewError(errors.New("tag unknown"), http.StatusNotFound)
+	}
+
+	return d, b.storedAt, nil
+}
+
+func (b *tagBackend) Manifest(_ context.Context, _ string, d digest.Digest) (http.Handler, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	manifest, ok := b.manifests[d]
+	if !ok {
+		return nil, httputil.NewError(errors.New("manifest unknown"), http.StatusNotFound)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, manifest)
+	}), nil
+}
+
+func (b *tagBackend) Blob(_ context.Context, _ string, d digest.Digest) (http.Handler, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	blob, ok := b.blobs[d]
+	if !ok {
+		return nil, httputil.NewError(errors.New("blob unknown"), http.StatusNotFound)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, blob)
+	}), nil
+}
+
+func (b *tagBackend) Close() error {
+	return nil
+}
+
+func TestHandlerNoBuild(t *testing.T) {
+	var (
+		manifest = `{"schemaVersion":2}`
+		d        = digest.FromString(manifest)
+		b        = &tagBackend{
+			tags: map[string]digest.Digest{"latest": d},
+			// NB: Long enough ago to be rebuilt if builds were enabled.
+			storedAt:  time.Now().Add(-time.Hour * 24 * 365),
+			manifests: map[digest.Digest]string{d: manifest},
+		}
+		// NB: There is no Dagger to build with, so any build would panic.
+		srv = httptest.NewServer(sindri.Handler(nil, b, sindri.WithNoBuild(true), sindri.WithTagMaxAge(time.Minute)))
+	)
+	t.Cleanup(srv.Close)
+
+	for _, reference := range []string{"latest", d.String()} {
+		require.Equal(t, manifest, getManifest(t, srv.URL+"/v2/a/manifests/"+reference))
+	}
+
+	res, err := http.Get(srv.URL + "/v2/a/manifests/missing")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	errRes := &specs.ErrorResponse{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(errRes))
+	require.Len(t, errRes.Errors, 1)
+	require.Equal(t, "MANIFEST_UNKNOWN", errRes.Errors[0].Code)
+}
+
+func TestHandlerFailures(t *testing.T) {
+	var (
+		// NB: b has no built channel, so its builds fail.
+		b   = &tagBackend{}
+		srv = httptest.NewServer(sindri.Handler(fakeDagger{}, b,
+			sindri.WithFailures(&failure.Cache{Backoff: time.Minute, MaxBackoff: time.Hour}),
+		))
+	)
+	t.Cleanup(srv.Close)
+
+	res, err := http.Get(srv.URL + "/v2/a/manifests/latest")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+
+	// The build failed recently, so the next pull fails fast with when to retry it.
+	res, err = http.Get(srv.URL + "/v2/a/manifests/latest")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	require.Equal(t, "60", res.Header.Get("Retry-After"))
+
+	errRes := &specs.ErrorResponse{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(errRes))
+	require.Len(t, errRes.Errors, 1)
+	require.Equal(t, "UNAVAILABLE", errRes.Errors[0].Code)
+}
+
+func getManifest(t *testing.T, url string) string {
+	t.Helper()
+
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode, string(body))
+
+	return string(body)
+}
+
+func TestHandlerStaleWhileRevalidate(t *testing.T) {
+	var (
+		manifest = `{"schemaVersion":2}`
+		d        = digest.FromString(manifest)
+		b        = &tagBackend{
+			tags:      map[string]digest.Digest{"latest": d},
+			storedAt:  time.Now().Add(-time.Minute * 30),
+			manifests: map[digest.Digest]string{d: manifest},
+			built:     make(chan string, 1),
+		}
+		srv = httptest.NewServer(sindri.Handler(fakeDagger{}, b,
+			sindri.WithTagMaxAge(time.Minute),
+			sindri.WithTagStaleWhileRevalidate(time.Hour),
+		))
+		url = srv.URL + "/v2/a/manifests/latest"
+	)
+	t.Cleanup(srv.Close)
+
+	// Stale tags are served as-is while they are rebuilt in the background.
+	require.Equal(t, manifest, getManifest(t, url))
+	require.Equal(t, "latest", <-b.built)
+
+	rebuilt := getManifest(t, url)
+	require.NotEqual(t, manifest, rebuilt)
+	require.Equal(t, rebuilt, getManifest(t, url))
+	require.Empty(t, b.built)
+
+	// Tags that are too stale are rebuilt before they are served.
+	b.mu.Lock()
+	b.storedAt = time.Now().Add(-time.Hour * 2)
+	b.mu.Unlock()
+
+	require.NotEqual(t, rebuilt, getManifest(t, url))
+	require.Equal(t, "latest", <-b.built)
+}
+
+func TestHandlerStaleWhileRevalidateLimits(t *testing.T) {
+	var (
+		manifest = `{"schemaVersion":2}`
+		d        = digest.FromString(manifest)
+		b        = &tagBackend{
+			tags:      map[string]digest.Digest{"latest": d},
+			storedAt:  time.Now().Add(-time.Minute * 30),
+			manifests: map[digest.Digest]string{d: manifest},
+			built:     make(chan string, 1),
+		}
+		status = func(url string) int {
+			res, err := http.Get(url)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			return res.StatusCode
+		}
+	)
+
+	// Stale tags are served to clients that may not build them, but not revalidated.
+	srv := httptest.NewServer(sindri.Handler(fakeDagger{}, b,
+		sindri.WithTagMaxAge(time.Minute),
+		sindri.WithTagStaleWhileRevalidate(time.Hour),
+		sindri.WithPolicy(&policy.Policy{
+			Rules: []policy.Rule{
+				{Effect: policy.EffectDeny, Actions: []string{policy.ActionBuild}},
+			},
+		}),
+	))
+	t.Cleanup(srv.Close)
+
+	require.Equal(t, manifest, getManifest(t, srv.URL+"/v2/a/manifests/latest"))
+	require.Equal(t, http.StatusForbidden, status(srv.URL+"/v2/a/manifests/v1"))
+	require.Empty(t, b.built)
+
+	// Nor are they held up by the rate limit, which only applies to revalidating them.
+	srv = httptest.NewServer(sindri.Handler(fakeDagger{}, b,
+		sindri.WithTagMaxAge(time.Minute),
+		sindri.WithTagStaleWhileRevalidate(time.Hour),
+		sindri.WithRateLimit(&limit.Rate{Limit: 0.001, Burst: 1}),
+	))
+	t.Cleanup(srv.Close)
+
+	require.Equal(t, manifest, getManifest(t, srv.URL+"/v2/a/manifests/latest"))
+	require.Equal(t, "latest", <-b.built)
+
+	// Age the revalidated tag so that it is stale again.
+	b.mu.Lock()
+	b.storedAt = time.Now().Add(-time.Minute * 30)
+	b.mu.Unlock()
+
+	require.NotEqual(t, manifest, getManifest(t, srv.URL+"/v2/a/manifests/latest"))
+	require.Equal(t, http.StatusTooManyRequests, status(srv.URL+"/v2/a/manifests/v1"))
+	require.Empty(t, b.built)
+}
+
+func TestHandlerInvalidations(t *testing.T) {
+	var (
+		manifest = `{"schemaVersion":2}`
+		d        = digest.FromString(manifest)
+		b        = &tagBackend{
+			tags:      map[string]digest.Digest{"main": d},
+			storedAt:  time.Now().Add(-time.Minute),
+			manifests: map[digest.Digest]string{d: manifest},
+			built:     make(chan string, 1),
+		}
+		invalidations = &rebuild.Invalidations{}
+		srv           = httptest.NewServer(sindri.Handler(fakeDagger{}, b,
+			sindri.WithTagMaxAge(time.Hour),
+			sindri.WithInvalidations(invalidations),
+		))
+		url = srv.URL + "/v2/github.com/org/repo/manifests/main"
+	)
+	t.Cleanup(srv.Close)
+
+	require.Equal(t, manifest, getManifest(t, url))
+	require.Empty(t, b.built)
+
+	// Invalidated tags are rebuilt before they are served, however fresh they are.
+	invalidations.Invalidate("github.com/org/repo", "main")
+
+	rebuilt := getManifest(t, url)
+	require.NotEqual(t, manifest, rebuilt)
+	require.Equal(t, "main", <-b.built)
+
+	require.Equal(t, rebuilt, getManifest(t, url))
+	require.Empty(t, b.built)
+}
+
+func TestHandlerPolicyReferences(t *testing.T) {
+	var (
+		blob     = "layer"
+		blobD    = digest.FromString(blob)
+		manifest = fmt.Sprintf(`{"schemaVersion":2,"layers":[{"digest":%q}]}`, blobD)
+		d        = digest.FromString(manifest)
+		b        = &tagBackend{
+			tags:      map[string]digest.Digest{"v1": d, "v1-rc1": d},
+			manifests: map[digest.Digest]string{d: manifest},
+			blobs:     map[digest.Digest]string{blobD: blob},
+		}
+		glob = func(pattern string) policy.Matcher {
+			g, err := auth.CompileGlob(pattern)
+			require.NoError(t, err)
+			return g
+		}
+		status = func(url string) int {
+			res, err := http.Get(url)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			return res.StatusCode
+		}
+	)
+
+	// Rules scoped to references deny only manifests of matching references, not every blob.
+	srv := httptest.NewServer(sindri.Handler(nil, b, sindri.WithNoBuild(true), sindri.WithPolicy(&policy.Policy{
+		Rules: []policy.Rule{
+			{Effect: policy.EffectDeny, Actions: []string{policy.ActionPull}, References: []policy.Matcher{glob("*-rc*")}},
+		},
+	})))
+	t.Cleanup(srv.Close)
+
+	require.Equal(t, manifest, getManifest(t, srv.URL+"/v2/a/manifests/v1"))
+	require.Equal(t, http.StatusOK, status(srv.URL+"/v2/a/blobs/"+blobD.String()))
+	require.Equal(t, http.StatusForbidden, status(srv.URL+"/v2/a/manifests/v1-rc1"))
+
+	// Nor do they allow every blob.
+	srv = httptest.NewServer(sindri.Handler(nil, b, sindri.WithNoBuild(true), sindri.WithPolicy(&policy.Policy{
+		Default: policy.EffectDeny,
+		Rules: []policy.Rule{
+			{Effect: policy.EffectAllow, Actions: []string{policy.ActionPull}, References: []policy.Matcher{glob("v1")}},
+		},
+	})))
+	t.Cleanup(srv.Close)
+
+	require.Equal(t, manifest, getManifest(t, srv.URL+"/v2/a/manifests/v1"))
+	require.Equal(t, http.StatusForbidden, status(srv.URL+"/v2/a/blobs/"+blobD.String()))
+	require.Equal(t, http.StatusForbidden, status(srv.URL+"/v2/a/manifests/v1-rc1"))
+}
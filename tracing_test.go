@@ -0,0 +1,91 @@
+package sindri_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/frantjc/sindri"
+	"github.com/frantjc/sindri/backend/registry"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHandlerTracing(t *testing.T) {
+	var (
+		recorder = tracetest.NewSpanRecorder()
+		tp       = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		blob     = "hello"
+		d        = digest.FromString(blob)
+		upstream = make(chan string, 1)
+	)
+	// Handler traces with the global TracerProvider and propagator, so put them back for other tests.
+	prevTP, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevPropagator)
+		_ = tp.Shutdown(t.Context())
+	})
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream <- r.Header.Get("Traceparent")
+		_, _ = io.WriteString(w, blob)
+	}))
+	t.Cleanup(up.Close)
+
+	u, err := url.Parse(up.URL)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(sindri.Handler(nil, &registry.Registry{
+		Scheme:     u.Scheme,
+		Host:       u.Host,
+		Repository: "sindri",
+	}))
+	t.Cleanup(srv.Close)
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/v2/a/blobs/"+d.String(), nil)
+	require.NoError(t, err)
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+spanID+"-01")
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, blob, string(b))
+
+	// The upstream is called with the client's trace.
+	require.Contains(t, <-upstream, traceID)
+
+	spans := map[trace.SpanKind]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.SpanKind()] = span
+	}
+
+	server, ok := spans[trace.SpanKindServer]
+	require.True(t, ok)
+	require.Equal(t, "GET blobs", server.Name())
+	require.Equal(t, traceID, server.SpanContext().TraceID().String())
+	require.Equal(t, spanID, server.Parent().SpanID().String())
+	require.True(t, server.Parent().IsRemote())
+	require.Contains(t, server.Attributes(), attribute.String("sindri.name", "a"))
+
+	client, ok := spans[trace.SpanKindClient]
+	require.True(t, ok)
+	require.Equal(t, server.SpanContext().SpanID(), client.Parent().SpanID())
+}